@@ -3,18 +3,27 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/cloudbees-io/checkout/internal/auth"
+	"github.com/cloudbees-io/checkout/internal/git"
 	"github.com/cloudbees-io/checkout/internal/helper"
 	format "github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/transport"
@@ -62,37 +71,176 @@ var (
 		SilenceUsage: true,
 		RunE:         doGet,
 	}
+	validateCmd = &cobra.Command{
+		Use:          "validate",
+		Short:        "Check that an SCM token can be fetched for each configured repository",
+		Long:         "Check that an SCM token can be fetched for each configured repository",
+		SilenceUsage: true,
+		RunE:         doValidate,
+	}
+	cleanCmd = &cobra.Command{
+		Use:          "clean",
+		Short:        "Remove credential helper installations that are no longer used",
+		Long:         "Remove credential helper installations that are not configured in the global credential.helper chain, and with --check-expired those whose CloudBees API tokens have expired",
+		SilenceUsage: true,
+		RunE:         doClean,
+	}
+	initCmd = &cobra.Command{
+		Use:          "init",
+		Short:        "Install the credential helper in the global git configuration",
+		Long:         "Install the credential helper in the global git configuration",
+		SilenceUsage: true,
+		RunE:         doInit,
+	}
+
+	listCmd = &cobra.Command{
+		Use:          "list",
+		Short:        "List the credentials in the helper configuration",
+		Long:         "List the credentials in the helper configuration",
+		SilenceUsage: true,
+		RunE:         doList,
+	}
+
+	rotateCmd = &cobra.Command{
+		Use:          "rotate",
+		Short:        "Replace the stored SCM tokens with fresh ones from the CloudBees API",
+		Long:         "Replace the stored SCM tokens with fresh ones from the CloudBees API",
+		SilenceUsage: true,
+		RunE:         doRotate,
+	}
 
-	helperConfigFile string
+	helperConfigFile  string
+	cleanCheckExpired bool
+	initOpts          initOptions
+	listOutput        string
+	rotateServerURL   string
+	rotateDryRun      bool
 )
 
-func init() {
-	helperCmd.AddCommand(getCmd, eraseCmd, storeCmd)
-	helperCmd.PersistentFlags().StringVarP(&helperConfigFile, "config-file", "c", "", "path to the helper configuration file to use")
+// initOptions are the flags of the init command
+type initOptions struct {
+	apiURL    string
+	apiToken  string
+	serverURL string
+	provider  string
+	dryRun    bool
+	force     bool
 }
 
-func doGet(command *cobra.Command, args []string) error {
-	_ = cliContext()
+func init() {
+	helperCmd.AddCommand(getCmd, eraseCmd, storeCmd, validateCmd, cleanCmd, initCmd, listCmd, rotateCmd)
+	cleanCmd.Flags().BoolVar(&cleanCheckExpired, "check-expired", false, "Also remove installations whose CloudBees API token has expired")
+	initCmd.Flags().StringVar(&initOpts.apiURL, "cloudbees-api-url", "", "CloudBees API root URL used to fetch SCM tokens")
+	initCmd.Flags().StringVar(&initOpts.apiToken, "cloudbees-api-token", "", "CloudBees API token used to fetch SCM tokens")
+	initCmd.Flags().StringVar(&initOpts.serverURL, "server-url", "", "URL of the SCM server to provide credentials for")
+	initCmd.Flags().StringVar(&initOpts.provider, "provider", "custom", "SCM provider of the server, one of github, gitlab, bitbucket or custom")
+	initCmd.Flags().BoolVar(&initOpts.dryRun, "dry-run", false, "Print what would be configured without modifying any files")
+	initCmd.Flags().BoolVar(&initOpts.force, "force", false, "Replace any credential helper already in the global git configuration")
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format, either table or json")
+	rotateCmd.Flags().StringVar(&rotateServerURL, "server-url", "", "Only rotate the credentials for repositories on this server, defaults to all")
+	rotateCmd.Flags().BoolVar(&rotateDryRun, "dry-run", false, "Print the credentials that would be rotated without modifying the configuration")
+	helperCmd.PersistentFlags().StringVarP(&helperConfigFile, "config-file", "c", "", "path to the helper configuration file to use, defaults to $XDG_CONFIG_HOME/"+helperConfigName+" or $HOME/.config/"+helperConfigName+" when they exist, otherwise the executable name with a .cfg suffix")
+}
 
+// helperConfigPath returns the path of the helper configuration file, either --config-file or helperDefaultConfigPath
+func helperConfigPath() (string, error) {
 	if helperConfigFile == "" {
-		self, err := os.Executable()
+		name, err := helperDefaultConfigPath()
 		if err != nil {
-			return fmt.Errorf("cannot infer config file from executable name: %w", err)
+			return "", err
+		}
+		helperConfigFile = name
+	}
+	return helperConfigFile, nil
+}
+
+// helperConfigName is the name of the helper configuration file in the user's configuration directory
+const helperConfigName = "cloudbees/git-credential-helper.cfg"
+
+// helperDefaultConfigPath returns the first of these helper configuration files that exists, falling back to the
+// last one, which is the file written by helper.InstallHelperFor:
+//
+//  1. $XDG_CONFIG_HOME/cloudbees/git-credential-helper.cfg
+//  2. $HOME/.config/cloudbees/git-credential-helper.cfg
+//  3. the executable name with a .cfg suffix
+func helperDefaultConfigPath() (string, error) {
+	var candidates []string
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		candidates = append(candidates, filepath.Join(xdgConfigHome, helperConfigName))
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		candidates = append(candidates, filepath.Join(home, ".config", helperConfigName))
+	}
+	for _, name := range candidates {
+		if stat, err := os.Stat(name); err == nil && !stat.IsDir() {
+			return name, nil
 		}
-		helperConfigFile = self + ".cfg"
 	}
 
-	bs, err := os.ReadFile(helperConfigFile)
+	self, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("could not read configuration from %s: %w", helperConfigFile, err)
+		return "", fmt.Errorf("cannot infer config file from executable name: %w", err)
+	}
+	return self + ".cfg", nil
+}
+
+// readHelperConfig reads the helper configuration file
+func readHelperConfig() (*format.Config, error) {
+	name, err := helperConfigPath()
+	if err != nil {
+		return nil, err
 	}
 
-	cfg := format.Config{}
+	return readHelperConfigFile(name)
+}
+
+func readHelperConfigFile(name string) (*format.Config, error) {
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration from %s: %w", name, err)
+	}
+
+	cfg := &format.Config{}
 
 	d := format.NewDecoder(bytes.NewReader(bs))
 
-	if err := d.Decode(&cfg); err != nil {
-		return fmt.Errorf("could not parse configuration file %s: %w", helperConfigFile, err)
+	if err := d.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("could not parse configuration file %s: %w", name, err)
+	}
+
+	return cfg, nil
+}
+
+// writeHelperConfigFile replaces the helper configuration file, via a rename so that a concurrent git never reads a
+// partially written file
+func writeHelperConfigFile(name string, cfg *format.Config) error {
+	var b bytes.Buffer
+	if err := format.NewEncoder(&b).Encode(cfg); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0666)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func doGet(command *cobra.Command, args []string) error {
+	ctx := command.Context()
+
+	cfg, err := readHelperConfig()
+	if err != nil {
+		return err
 	}
 
 	r := bufio.NewReader(os.Stdin)
@@ -137,7 +285,12 @@ func doGet(command *cobra.Command, args []string) error {
 		}
 	}
 
-	if closest.HasOption("cloudBeesApiToken") && closest.HasOption("cloudBeesApiUrl") {
+	if cred, err := rotatedToken(closest, time.Now()); err != nil {
+		return err
+	} else if cred != nil {
+		rsp.Password = cred.Password
+		rsp.PasswordExpiry = cred.PasswordExpiry
+	} else if closest.HasOption("cloudBeesApiToken") && closest.HasOption("cloudBeesApiUrl") {
 		var token string
 		if b, err := base64.StdEncoding.DecodeString(closest.Option("cloudBeesApiToken")); err == nil {
 			token = string(b)
@@ -147,97 +300,862 @@ func doGet(command *cobra.Command, args []string) error {
 
 		baseURL := closest.Option("cloudBeesApiUrl")
 
-		var resourceId string
-		if resourceId, err = getResourceIdFromAutomationToken(token); err != nil {
+		scmRepoURL := (&transport.Endpoint{
+			Protocol: req.Protocol,
+			Host:     req.Host,
+			Path:     req.Path,
+		}).String()
+
+		fallback := rsp.Password != "" && closest.Option("disableFallback") != "true"
+
+		var cred *helper.GitCredential
+		if cred, err = getTokenWithFallback(ctx, baseURL, token, scmRepoURL, fallback, withRequiredScopes(closest.Options.GetAll("requiredTokenScope")...)); err != nil {
 			return err
 		}
 
-		if o := os.Getenv("RESOURCE_ID_OVERRIDE"); o != "" {
-			resourceId = o
+		if cred != nil {
+			rsp.Password = cred.Password
+			rsp.PasswordExpiry = cred.PasswordExpiry
 		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+
+	if _, err = rsp.WriteTo(w); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func doValidate(command *cobra.Command, args []string) error {
+	cfg, err := readHelperConfig()
+	if err != nil {
+		return err
+	}
+
+	return validateHelperConfig(command.Context(), command.OutOrStdout(), cfg)
+}
+
+// validateHelperConfig fetches an SCM token for each repository in the helper configuration that is backed by the
+// CloudBees API and prints a summary line per repository, failing if any token could not be fetched
+func validateHelperConfig(ctx context.Context, w io.Writer, cfg *format.Config, opts ...cmdOption) error {
+	total, failed := 0, 0
+	for _, section := range cfg.Sections {
+		for _, ss := range section.Subsections {
+			scmRepoURL := section.Name + ":" + ss.Name
+
+			if !ss.HasOption("cloudBeesApiToken") || !ss.HasOption("cloudBeesApiUrl") {
+				_, _ = fmt.Fprintf(w, "➖ %s - SKIPPED: no CloudBees API token configured\n", scmRepoURL)
+				continue
+			}
+			total++
 
-		body := map[string]string{
-			"scmRepoUrl": (&transport.Endpoint{
-				Protocol: req.Protocol,
-				Host:     req.Host,
-				Path:     req.Path,
-			}).String(),
+			cred, err := fetchSubsectionToken(ctx, ss, scmRepoURL, opts...)
+			if err != nil {
+				failed++
+				var reqErr *tokenRequestError
+				if errors.As(err, &reqErr) {
+					_, _ = fmt.Fprintf(w, "❌ %s - FAILED: HTTP %d\n", scmRepoURL, reqErr.StatusCode)
+				} else {
+					_, _ = fmt.Fprintf(w, "❌ %s - FAILED: %v\n", scmRepoURL, err)
+				}
+				continue
+			}
+
+			if cred.PasswordExpiry != nil {
+				_, _ = fmt.Fprintf(w, "✅ %s - OK (token expires in %s)\n", scmRepoURL, formatExpiresIn(time.Until(*cred.PasswordExpiry)))
+			} else {
+				_, _ = fmt.Fprintf(w, "✅ %s - OK\n", scmRepoURL)
+			}
 		}
+	}
 
-		var bodyBytes []byte
-		if bodyBytes, err = json.Marshal(&body); err != nil {
-			return err
+	if failed > 0 {
+		return fmt.Errorf("could not fetch SCM tokens for %d of %d repositories", failed, total)
+	}
+	return nil
+}
+
+func fetchSubsectionToken(ctx context.Context, ss *format.Subsection, scmRepoURL string, opts ...cmdOption) (*helper.GitCredential, error) {
+	token, err := base64.StdEncoding.DecodeString(ss.Option("cloudBeesApiToken"))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode cloudBeesApiToken: %w", err)
+	}
+	opts = append(opts, withRequiredScopes(ss.Options.GetAll("requiredTokenScope")...))
+	return fetchSCMToken(ctx, ss.Option("cloudBeesApiUrl"), string(token), scmRepoURL, opts...)
+}
+
+func doList(command *cobra.Command, args []string) error {
+	cfg, err := readHelperConfig()
+	if err != nil {
+		return err
+	}
+
+	return listHelperConfig(command.OutOrStdout(), cfg, listOutput, time.Now())
+}
+
+const (
+	credentialAuthCloudBeesAPI = "cloudbees-api"
+	credentialAuthUserToken    = "user-token"
+	credentialAuthNone         = "none"
+)
+
+// helperCredential describes one repository of the helper configuration, without any secrets
+type helperCredential struct {
+	ServerURL string     `json:"serverUrl"`
+	Auth      string     `json:"auth"`
+	Subject   string     `json:"subject,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Expired   bool       `json:"expired"`
+}
+
+// listHelperConfig prints how each repository in the helper configuration authenticates, as either a table or JSON.
+// CloudBees API tokens are decoded without verification to report their subject and expiry.
+func listHelperConfig(w io.Writer, cfg *format.Config, output string, now time.Time) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unsupported output format '%s', expected table or json", output)
+	}
+
+	credentials := []helperCredential{}
+	for _, section := range cfg.Sections {
+		for _, ss := range section.Subsections {
+			c := helperCredential{ServerURL: section.Name + ":" + ss.Name, Auth: credentialAuthNone}
+			switch {
+			case ss.HasOption("cloudBeesApiToken") && ss.HasOption("cloudBeesApiUrl"):
+				c.Auth = credentialAuthCloudBeesAPI
+				if token, err := base64.StdEncoding.DecodeString(ss.Option("cloudBeesApiToken")); err == nil {
+					claims := jwt.MapClaims{}
+					if _, _, err := jwt.NewParser().ParseUnverified(string(token), claims); err == nil {
+						c.Subject, _ = claims.GetSubject()
+						if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+							expiresAt := exp.UTC()
+							c.ExpiresAt = &expiresAt
+							c.Expired = now.After(expiresAt)
+						}
+					}
+				}
+			case ss.HasOption("password"):
+				c.Auth = credentialAuthUserToken
+			}
+			credentials = append(credentials, c)
 		}
+	}
 
-		var reqURL string
-		if reqURL, err = url.JoinPath(baseURL, "reserved/v1/resources", resourceId, "scm-access-token"); err != nil {
-			return err
+	if output == "json" {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(credentials)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "SERVER URL\tAUTH\tSUBJECT\tEXPIRES\tEXPIRED")
+	for _, c := range credentials {
+		subject, expires, expired := "-", "-", "-"
+		if c.Subject != "" {
+			subject = c.Subject
+		}
+		if c.ExpiresAt != nil {
+			expires = c.ExpiresAt.Format(time.RFC3339)
+			expired = strconv.FormatBool(c.Expired)
 		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.ServerURL, c.Auth, subject, expires, expired)
+	}
+	return tw.Flush()
+}
 
-		client := &http.Client{}
+func doRotate(command *cobra.Command, args []string) error {
+	name, err := helperConfigPath()
+	if err != nil {
+		return err
+	}
 
-		var apiReq *http.Request
-		if apiReq, err = http.NewRequest(
-			"POST",
-			reqURL,
-			bytes.NewReader(bodyBytes),
-		); err != nil {
-			return err
+	return rotateHelperConfig(command.Context(), command.OutOrStdout(), name, rotateServerURL, rotateDryRun)
+}
+
+// rotatedToken returns the SCM token stored by rotate, or nil when there is none or it is about to expire
+func rotatedToken(ss *format.Subsection, now time.Time) (*helper.GitCredential, error) {
+	if !ss.HasOption("scmToken") {
+		return nil, nil
+	}
+	cred := &helper.GitCredential{}
+	if ss.HasOption("scmTokenExpiry") {
+		expiresAt, err := time.Parse(time.RFC3339, ss.Option("scmTokenExpiry"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid scmTokenExpiry '%s': %w", ss.Option("scmTokenExpiry"), err)
+		}
+		if expiresAt.Sub(now) < tokenRefreshWindow {
+			return nil, nil
 		}
+		cred.PasswordExpiry = &expiresAt
+	}
+	b, err := base64.StdEncoding.DecodeString(ss.Option("scmToken"))
+	if err != nil {
+		return nil, err
+	}
+	cred.Password = string(b)
+	return cred, nil
+}
 
-		apiReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-		apiReq.Header.Set("Content-Type", "application/json")
-		apiReq.Header.Set("Accept", "application/json")
+// rotateHelperConfig fetches a fresh SCM token from the CloudBees API for each repository in the helper configuration
+// file on the server, or for all repositories when serverURL is empty, and stores it as the scmToken along with its
+// expiry. get uses the stored token until it is about to expire. The file is only updated when every token could be
+// fetched.
+func rotateHelperConfig(ctx context.Context, w io.Writer, configFile string, serverURL string, dryRun bool, opts ...cmdOption) error {
+	cfg, err := readHelperConfigFile(configFile)
+	if err != nil {
+		return err
+	}
 
-		var res *http.Response
-		if res, err = client.Do(apiReq); err != nil {
-			return err
+	serverURL = strings.TrimSuffix(serverURL, "/")
+
+	total, failed := 0, 0
+	var rotated []string
+	for _, section := range cfg.Sections {
+		for _, ss := range section.Subsections {
+			scmRepoURL := section.Name + ":" + ss.Name
+			if serverURL != "" && scmRepoURL != serverURL && !strings.HasPrefix(scmRepoURL, serverURL+"/") {
+				continue
+			}
+			if !ss.HasOption("cloudBeesApiToken") || !ss.HasOption("cloudBeesApiUrl") {
+				continue
+			}
+			total++
+
+			if dryRun {
+				_, _ = fmt.Fprintf(w, "[DRY RUN] Would rotate the SCM token for %s\n", scmRepoURL)
+				continue
+			}
+
+			cred, err := fetchSubsectionToken(ctx, ss, scmRepoURL, opts...)
+			if err != nil {
+				failed++
+				var reqErr *tokenRequestError
+				if errors.As(err, &reqErr) {
+					_, _ = fmt.Fprintf(w, "❌ %s - FAILED: HTTP %d\n", scmRepoURL, reqErr.StatusCode)
+				} else {
+					_, _ = fmt.Fprintf(w, "❌ %s - FAILED: %v\n", scmRepoURL, err)
+				}
+				continue
+			}
+
+			ss.SetOption("scmToken", base64.StdEncoding.EncodeToString([]byte(cred.Password)))
+			if cred.PasswordExpiry != nil {
+				ss.SetOption("scmTokenExpiry", cred.PasswordExpiry.UTC().Format(time.RFC3339))
+				rotated = append(rotated, fmt.Sprintf("✅ %s - ROTATED (token expires in %s)", scmRepoURL, formatExpiresIn(time.Until(*cred.PasswordExpiry))))
+			} else {
+				ss.RemoveOption("scmTokenExpiry")
+				rotated = append(rotated, fmt.Sprintf("✅ %s - ROTATED", scmRepoURL))
+			}
 		}
+	}
 
-		defer func() { _ = res.Body.Close() }()
+	if total == 0 {
+		if serverURL != "" {
+			return fmt.Errorf("no repositories on %s are configured with a CloudBees API token", serverURL)
+		}
+		return fmt.Errorf("no repositories are configured with a CloudBees API token")
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not rotate SCM tokens for %d of %d repositories, %s was not changed", failed, total, configFile)
+	}
+	if dryRun {
+		return nil
+	}
 
-		if bodyBytes, err = io.ReadAll(res.Body); err != nil {
-			return err
+	if err := writeHelperConfigFile(configFile, cfg); err != nil {
+		return err
+	}
+	for _, line := range rotated {
+		_, _ = fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// formatExpiresIn formats d to minute precision, for example 47m or 1h5m
+func formatExpiresIn(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d <= 0 {
+		return "less than 1m"
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
+
+func doClean(command *cobra.Command, args []string) error {
+	cli, err := git.NewGitCLI(command.Context())
+	if err != nil {
+		return err
+	}
+
+	helpers, err := cli.GetAllConfig(true, "credential.helper")
+	if e := (&exec.ExitError{}); err != nil && !errors.As(err, &e) {
+		return err
+	}
+
+	return cleanHelperInstalls(command.OutOrStdout(), helper.InstallDir(), helpers, cleanCheckExpired)
+}
+
+// cleanHelperInstalls removes the helper installations under root that are not referenced by any of the configured
+// credential helpers. When checkExpired is set, installations whose CloudBees API tokens have all expired are removed
+// too, even if they are still referenced.
+func cleanHelperInstalls(w io.Writer, root string, helpers []string, checkExpired bool) error {
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
 		}
+		dir := filepath.Join(root, e.Name())
+		helperExecutable := filepath.Join(dir, helper.HelperExecutableName)
 
-		if res.StatusCode != 200 {
-			return fmt.Errorf("could not fetch SCM token: \nPOST %s\nHTTP/%d %s\n%s", reqURL, res.StatusCode, res.Status, string(bodyBytes))
+		inUse := false
+		for _, h := range helpers {
+			// the configured helper command is the executable followed by its arguments
+			if h == helperExecutable || strings.HasPrefix(h, helperExecutable+" ") {
+				inUse = true
+				break
+			}
+		}
+		if inUse && !(checkExpired && helperTokensExpired(helperExecutable+".cfg")) {
+			continue
 		}
 
-		if err = json.Unmarshal(bodyBytes, &body); err != nil {
-			return err
+		if err := forceRemoveAll(dir); err != nil {
+			errs = append(errs, err)
+			continue
 		}
+		_, _ = fmt.Fprintf(w, "Removed %s\n", dir)
+	}
+
+	return errors.Join(errs...)
+}
+
+// helperTokensExpired returns true if the helper configuration has CloudBees API tokens and all of them have expired
+func helperTokensExpired(configFile string) bool {
+	bs, err := os.ReadFile(configFile)
+	if err != nil {
+		return false
+	}
+	cfg := &format.Config{}
+	if err := format.NewDecoder(bytes.NewReader(bs)).Decode(cfg); err != nil {
+		return false
+	}
 
-		rsp.Password = body["accessToken"]
-		if expires, ok := body["expiresAt"]; ok && expires != "" {
-			// we need to parse the time but without pulling in all the swagger deps
-			re := regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})T(\d{2}):(\d{2}):(\d{2}).*`)
-			if matches := re.FindStringSubmatch(expires); matches != nil {
-				// we already confirmed that each submatch is a number so Atoi cannot error out
-				year, _ := strconv.Atoi(matches[1])
-				month, _ := strconv.Atoi(matches[2])
-				day, _ := strconv.Atoi(matches[3])
-				hour, _ := strconv.Atoi(matches[4])
-				minute, _ := strconv.Atoi(matches[5])
-				sec, _ := strconv.Atoi(matches[6])
-				expiresAt := time.Date(year, time.Month(month), day, hour, minute, sec, 0, time.UTC)
-				rsp.PasswordExpiry = &expiresAt
+	found := false
+	for _, section := range cfg.Sections {
+		for _, ss := range section.Subsections {
+			if !ss.HasOption("cloudBeesApiToken") {
+				continue
+			}
+			token, err := base64.StdEncoding.DecodeString(ss.Option("cloudBeesApiToken"))
+			if err != nil {
+				continue
 			}
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(string(token), claims); err != nil {
+				continue
+			}
+			exp, err := claims.GetExpirationTime()
+			if err != nil || exp == nil || !time.Now().After(exp.Add(automationTokenLeeway)) {
+				return false
+			}
+			found = true
 		}
 	}
+	return found
+}
 
-	w := bufio.NewWriter(os.Stdout)
+// forceRemoveAll removes dir even when it contains read-only files, such as the installed helper executable
+func forceRemoveAll(dir string) error {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil {
+			if info, err := d.Info(); err == nil {
+				_ = os.Chmod(path, info.Mode()|0222)
+			}
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
 
-	if _, err = rsp.WriteTo(w); err != nil {
+func doInit(command *cobra.Command, args []string) error {
+	cli, err := git.NewGitCLI(command.Context())
+	if err != nil {
 		return err
 	}
 
-	return w.Flush()
+	return initHelper(command.OutOrStdout(), cli, initOpts)
 }
 
-func getResourceIdFromAutomationToken(token string) (string, error) {
+// initHelper installs the credential helper for the server URL and configures it in $HOME/.gitconfig, refusing to
+// replace an existing credential helper unless forced
+func initHelper(w io.Writer, cli *git.GitCLI, o initOptions) error {
+	if o.serverURL == "" {
+		return fmt.Errorf("--server-url is required")
+	}
+	if o.apiURL == "" || o.apiToken == "" {
+		return fmt.Errorf("--cloudbees-api-url and --cloudbees-api-token are required")
+	}
+	if _, err := transport.NewEndpoint(o.serverURL); err != nil {
+		return fmt.Errorf("invalid --server-url '%s': %w", o.serverURL, err)
+	}
+
+	gitconfigPath := filepath.Join(os.Getenv("HOME"), ".gitconfig")
+
+	if existing, _ := cli.GetConfig(true, "credential.helper"); existing != "" && !o.force {
+		return fmt.Errorf("a credential helper is already configured in %s, use --force to replace it", gitconfigPath)
+	}
+
+	if o.dryRun {
+		_, _ = fmt.Fprintf(w, "[DRY RUN] Would install a credential helper under %s for:\n", helper.InstallDir())
+		_, _ = fmt.Fprintf(w, "  %s (CloudBees API %s)\n", o.serverURL, o.apiURL)
+		_, _ = fmt.Fprintf(w, "[DRY RUN] Would set credential.helper and credential.useHttpPath in %s\n", gitconfigPath)
+		return nil
+	}
+
+	// git only writes to the global configuration file that GitCLI.GlobalConfigPath finds when it already exists
+	f, err := os.OpenFile(gitconfigPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	cleaner, _, err := auth.ConfigureToken(cli, "", true, o.serverURL, auth.TokenAuth{
+		Provider: o.provider,
+		ApiURL:   o.apiURL,
+		ApiToken: o.apiToken,
+	})
+	if err != nil {
+		return errors.Join(err, cleaner())
+	}
+
+	_, _ = fmt.Fprintf(w, "✅ Configured the credential helper in %s for:\n", gitconfigPath)
+	_, _ = fmt.Fprintf(w, "  %s (CloudBees API %s)\n", o.serverURL, o.apiURL)
+	return nil
+}
+
+// tokenRefreshWindow is how close to expiry a SCM token can be before the helper requests a fresh one
+const tokenRefreshWindow = 60 * time.Second
+
+// defaultAPITimeout is how long a request to the CloudBees API can take unless overridden by CLOUDBEES_API_TIMEOUT_SECONDS
+const defaultAPITimeout = 30 * time.Second
+
+// cmdOption customises how the credential helper talks to the CloudBees API
+type cmdOption func(*cmdOptions)
+
+type cmdOptions struct {
+	client         *http.Client
+	requiredScopes []string
+}
+
+// withHTTPClient replaces the HTTP client used to talk to the CloudBees API
+func withHTTPClient(c *http.Client) cmdOption {
+	return func(o *cmdOptions) {
+		o.client = c
+	}
+}
+
+// withRequiredScopes fails the SCM token request if the returned token does not have all of the scopes
+func withRequiredScopes(scopes ...string) cmdOption {
+	return func(o *cmdOptions) {
+		o.requiredScopes = append(o.requiredScopes, scopes...)
+	}
+}
+
+func newCmdOptions(opts []cmdOption) *cmdOptions {
+	o := &cmdOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.client == nil {
+		o.client = &http.Client{Timeout: apiTimeout()}
+	}
+	return o
+}
+
+// apiTimeout returns the CloudBees API request timeout configured by CLOUDBEES_API_TIMEOUT_SECONDS
+func apiTimeout() time.Duration {
+	v := os.Getenv("CLOUDBEES_API_TIMEOUT_SECONDS")
+	if v == "" {
+		return defaultAPITimeout
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: ignoring invalid CLOUDBEES_API_TIMEOUT_SECONDS '%s', using %s\n", v, defaultAPITimeout)
+		return defaultAPITimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// tokenRetryDelay is how long the helper waits before retrying a failed SCM token request
+var tokenRetryDelay = 2 * time.Second
+
+// fetchSCMToken fetches a SCM token for scmRepoURL from the CloudBees API, failing if no token is returned
+func fetchSCMToken(ctx context.Context, baseURL, apiToken, scmRepoURL string, opts ...cmdOption) (*helper.GitCredential, error) {
+	cred, err := getToken(ctx, baseURL, apiToken, scmRepoURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Password == "" {
+		return nil, fmt.Errorf("could not fetch SCM token: no access token returned for %s", scmRepoURL)
+	}
+	return cred, nil
+}
+
+// getTokenWithFallback fetches a SCM token for scmRepoURL from the CloudBees API, retrying once on failure. If the
+// retry also fails and fallback is set, no credential is returned so the user provided password is used instead.
+// A token missing the required scopes fails immediately, without a retry or fallback.
+func getTokenWithFallback(ctx context.Context, baseURL, apiToken, scmRepoURL string, fallback bool, opts ...cmdOption) (*helper.GitCredential, error) {
+	cred, err := fetchSCMToken(ctx, baseURL, apiToken, scmRepoURL, opts...)
+	if err == nil {
+		return cred, nil
+	}
+	var scopeErr *TokenScopeError
+	if errors.As(err, &scopeErr) {
+		return nil, err
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "warning: could not fetch SCM token, retrying in %s: %v\n", tokenRetryDelay, err)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(tokenRetryDelay):
+	}
+
+	if cred, err = fetchSCMToken(ctx, baseURL, apiToken, scmRepoURL, opts...); err == nil {
+		return cred, nil
+	}
+	if !fallback {
+		return nil, err
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "warning: could not fetch SCM token, falling back to the configured password: %v\n", err)
+	return nil, nil
+}
+
+// getToken fetches a SCM token for scmRepoURL from the CloudBees API, refreshing it if it is about to expire
+func getToken(ctx context.Context, baseURL, apiToken, scmRepoURL string, opts ...cmdOption) (*helper.GitCredential, error) {
+	o := newCmdOptions(opts)
+	cred, err := requestToken(ctx, o, baseURL, apiToken, scmRepoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if cred.PasswordExpiry != nil && time.Until(*cred.PasswordExpiry) < tokenRefreshWindow {
+		refreshed, err := refreshToken(ctx, o, baseURL, apiToken, scmRepoURL)
+		if err != nil {
+			// the original token is still valid for a little while, so let git try it
+			_, _ = fmt.Fprintf(os.Stderr, "warning: could not refresh SCM token expiring at %s: %v\n", cred.PasswordExpiry.Format(time.RFC3339), err)
+			return cred, nil
+		}
+		cred = refreshed
+	}
+
+	return cred, nil
+}
+
+// refreshToken requests a replacement SCM token for scmRepoURL from the CloudBees API
+func refreshToken(ctx context.Context, o *cmdOptions, baseURL, apiToken, scmRepoURL string) (*helper.GitCredential, error) {
+	cred, err := requestToken(ctx, o, baseURL, apiToken, scmRepoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if cred.PasswordExpiry != nil && time.Until(*cred.PasswordExpiry) < tokenRefreshWindow {
+		return nil, fmt.Errorf("refreshed SCM token expires at %s", cred.PasswordExpiry.Format(time.RFC3339))
+	}
+
+	return cred, nil
+}
+
+// tokenRequestAttempts is the maximum number of times a rate limited SCM token request is attempted
+const tokenRequestAttempts = 3
+
+// tokenRequestBackoff is the initial delay between rate limited SCM token requests without a Retry-After header
+var tokenRequestBackoff = time.Second
+
+// maxRetryAfter caps the delay requested by a Retry-After header, so that a misbehaving server cannot stall the helper
+const maxRetryAfter = 60 * time.Second
+
+// doGetWithRetry sends the request, retrying when the CloudBees API responds with HTTP 429 Too Many Requests
+func doGetWithRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	backoff := tokenRequestBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusTooManyRequests {
+			return res, nil
+		}
+
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if attempt >= tokenRequestAttempts {
+			return nil, fmt.Errorf("could not fetch SCM token after %d attempts: \n%s %s\nHTTP/%d %s\n%s", attempt, req.Method, req.URL, res.StatusCode, res.Status, string(body))
+		}
+
+		delay, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			delay = backoff
+			backoff *= 2
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseRetryAfter parses a Retry-After header value given either in seconds or as an HTTP-date, clamped to
+// maxRetryAfter
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// compared in seconds as a large value would overflow the duration
+		return time.Duration(min(seconds, int(maxRetryAfter/time.Second))) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return min(max(at.Sub(now), 0), maxRetryAfter), true
+	}
+	return 0, false
+}
+
+// tokenRequestError reports an unsuccessful response from the CloudBees API to a SCM token request
+type tokenRequestError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *tokenRequestError) Error() string {
+	return fmt.Sprintf("could not fetch SCM token: \nPOST %s\nHTTP/%d %s\n%s", e.URL, e.StatusCode, e.Status, e.Body)
+}
+
+// scmTokenResponse is the response of the CloudBees API to a SCM token request
+type scmTokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresAt   string `json:"expiresAt"`
+	// Scopes is nil when the SCM provider does not report the scopes of its tokens
+	Scopes []string `json:"scopes"`
+}
+
+// TokenScopeError reports a SCM token that was not granted all of the required scopes. Requesting the token again
+// will not grant the missing scopes, so it is never retried or replaced by a fallback password.
+type TokenScopeError struct {
+	Missing []string
+	Granted []string
+}
+
+func (e *TokenScopeError) Error() string {
+	return fmt.Sprintf("SCM token is missing the required scopes %s, it has %s", strings.Join(e.Missing, ", "), strings.Join(e.Granted, ", "))
+}
+
+// validateTokenScopes checks that every one of the required scopes was granted to the SCM token
+func validateTokenScopes(scopes []string, required []string) error {
+	var missing []string
+	for _, r := range required {
+		if !slices.Contains(scopes, r) {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		return &TokenScopeError{Missing: missing, Granted: scopes}
+	}
+	return nil
+}
+
+func requestToken(ctx context.Context, o *cmdOptions, baseURL, apiToken, scmRepoURL string) (*helper.GitCredential, error) {
+	resourceId, err := getResourceIdFromAutomationToken(apiToken, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if o := os.Getenv("RESOURCE_ID_OVERRIDE"); o != "" {
+		resourceId = o
+	}
+
+	body := map[string]string{
+		"scmRepoUrl": scmRepoURL,
+	}
+
+	var bodyBytes []byte
+	if bodyBytes, err = json.Marshal(&body); err != nil {
+		return nil, err
+	}
+
+	var reqURL string
+	if reqURL, err = url.JoinPath(baseURL, "reserved/v1/resources", resourceId, "scm-access-token"); err != nil {
+		return nil, err
+	}
+
+	var apiReq *http.Request
+	if apiReq, err = http.NewRequestWithContext(
+		ctx,
+		"POST",
+		reqURL,
+		bytes.NewReader(bodyBytes),
+	); err != nil {
+		return nil, err
+	}
+
+	apiReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+	apiReq.Header.Set("Content-Type", "application/json")
+	apiReq.Header.Set("Accept", "application/json")
+
+	var res *http.Response
+	if res, err = doGetWithRetry(o.client, apiReq); err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	if bodyBytes, err = io.ReadAll(res.Body); err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		return nil, &tokenRequestError{URL: reqURL, StatusCode: res.StatusCode, Status: res.Status, Body: string(bodyBytes)}
+	}
+
+	var token scmTokenResponse
+	if err = json.Unmarshal(bodyBytes, &token); err != nil {
+		return nil, err
+	}
+
+	if len(o.requiredScopes) > 0 {
+		if token.Scopes == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: the SCM token scopes were not returned, skipping the check for the required scopes %s\n", strings.Join(o.requiredScopes, ", "))
+		} else if err := validateTokenScopes(token.Scopes, o.requiredScopes); err != nil {
+			return nil, err
+		}
+	}
+
+	cred := &helper.GitCredential{Password: token.AccessToken}
+	if expires := token.ExpiresAt; expires != "" {
+		// we need to parse the time but without pulling in all the swagger deps
+		re := regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})T(\d{2}):(\d{2}):(\d{2}).*`)
+		if matches := re.FindStringSubmatch(expires); matches != nil {
+			// we already confirmed that each submatch is a number so Atoi cannot error out
+			year, _ := strconv.Atoi(matches[1])
+			month, _ := strconv.Atoi(matches[2])
+			day, _ := strconv.Atoi(matches[3])
+			hour, _ := strconv.Atoi(matches[4])
+			minute, _ := strconv.Atoi(matches[5])
+			sec, _ := strconv.Atoi(matches[6])
+			expiresAt := time.Date(year, time.Month(month), day, hour, minute, sec, 0, time.UTC)
+			cred.PasswordExpiry = &expiresAt
+		}
+	}
+
+	return cred, nil
+}
+
+var (
+	// automationTokenIssuerPattern is the issuer expected in CloudBees automation tokens
+	automationTokenIssuerPattern = regexp.MustCompile(`^https://([a-z0-9-]+\.)*cloudbees\.(io|com)(/.*)?$`)
+	// automationTokenLeeway is the clock skew tolerated when checking the expiry of CloudBees automation tokens
+	automationTokenLeeway = 30 * time.Second
+)
+
+// TokenValidationError reports a CloudBees API token that cannot be used to fetch SCM tokens
+type TokenValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *TokenValidationError) Error() string {
+	return fmt.Sprintf("cloudbees api token %s: %v", e.Reason, e.Err)
+}
+
+func (e *TokenValidationError) Unwrap() error {
+	return e.Err
+}
+
+// audienceMatches reports whether the aud claim entry is exactly the API URL, ignoring case and a trailing slash,
+// or its host name
+func audienceMatches(aud string, apiURL *url.URL) bool {
+	if !strings.Contains(aud, "://") {
+		return strings.EqualFold(aud, apiURL.Hostname())
+	}
+	u, err := url.Parse(aud)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, apiURL.Scheme) && strings.EqualFold(u.Host, apiURL.Host) &&
+		strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(apiURL.Path, "/")
+}
+
+// validateAutomationTokenClaims checks that the token has not expired and was issued by CloudBees for apiURL
+func validateAutomationTokenClaims(claims jwt.MapClaims, apiURL string) error {
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return &TokenValidationError{Reason: "has an invalid exp claim", Err: err}
+	}
+	if exp != nil && time.Now().After(exp.Add(automationTokenLeeway)) {
+		return &TokenValidationError{
+			Reason: "has expired",
+			Err:    fmt.Errorf("%w: expired at %s", jwt.ErrTokenExpired, exp.UTC().Format(time.RFC3339)),
+		}
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Hostname() == "" {
+		return &TokenValidationError{Reason: "cannot be checked", Err: fmt.Errorf("invalid cloudbees api url '%s'", apiURL)}
+	}
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return &TokenValidationError{Reason: "has an invalid aud claim", Err: err}
+	}
+	if !slices.ContainsFunc(aud, func(a string) bool { return audienceMatches(a, u) }) {
+		return &TokenValidationError{
+			Reason: "was not issued for " + u.Hostname(),
+			Err:    fmt.Errorf("%w: %v", jwt.ErrTokenInvalidAudience, []string(aud)),
+		}
+	}
+
+	iss, err := claims.GetIssuer()
+	if err != nil {
+		return &TokenValidationError{Reason: "has an invalid iss claim", Err: err}
+	}
+	if !automationTokenIssuerPattern.MatchString(iss) {
+		return &TokenValidationError{
+			Reason: "was not issued by CloudBees",
+			Err:    fmt.Errorf("%w: '%s'", jwt.ErrTokenInvalidIssuer, iss),
+		}
+	}
+
+	return nil
+}
+
+func getResourceIdFromAutomationToken(token string, apiURL string) (string, error) {
 	claims := jwt.MapClaims{}
 	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return "", &TokenValidationError{Reason: "is not a valid JWT", Err: err}
+	}
+
+	if err := validateAutomationTokenClaims(claims, apiURL); err != nil {
 		return "", err
 	}
 
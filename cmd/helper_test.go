@@ -0,0 +1,869 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbees-io/checkout/internal/auth"
+	"github.com/cloudbees-io/checkout/internal/git"
+	"github.com/cloudbees-io/checkout/internal/helper"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func testAutomationToken(t *testing.T) string {
+	t.Helper()
+	return testAutomationTokenWithClaims(t, jwt.MapClaims{
+		"aud": []string{"127.0.0.1"},
+		"iss": "https://api.cloudbees.io",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func testAutomationTokenWithClaims(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["https://www.cloudbees.com/automation"] = map[string]interface{}{
+		"identity": map[string]interface{}{
+			"resource_id": "resource-1",
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test"))
+	require.NoError(t, err)
+	return token
+}
+
+func Test_getResourceIdFromAutomationToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		apiURL  string
+		wantErr error
+	}{
+		{
+			name: "valid",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://api.cloudbees.io"},
+				"iss": "https://api.cloudbees.io",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			},
+			apiURL: "https://api.cloudbees.io",
+		},
+		{
+			name: "single audience",
+			claims: jwt.MapClaims{
+				"aud": "https://API.cloudbees.io/",
+				"iss": "https://api.cloudbees.io",
+			},
+			apiURL: "https://api.cloudbees.io",
+		},
+		{
+			name: "expired",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://api.cloudbees.io"},
+				"iss": "https://api.cloudbees.io",
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			},
+			apiURL:  "https://api.cloudbees.io",
+			wantErr: jwt.ErrTokenExpired,
+		},
+		{
+			name: "wrong audience",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://api.saas-preprod.beescloud.com"},
+				"iss": "https://api.cloudbees.io",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			},
+			apiURL:  "https://api.cloudbees.io",
+			wantErr: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name: "host audience",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://other.example.com", "api.cloudbees.io"},
+				"iss": "https://api.cloudbees.io",
+			},
+			apiURL: "https://api.cloudbees.io",
+		},
+		{
+			name: "audience containing the host",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://api.cloudbees.io.example.com", "https://example.com/api.cloudbees.io", "api.cloudbees.io.example.com"},
+				"iss": "https://api.cloudbees.io",
+			},
+			apiURL:  "https://api.cloudbees.io",
+			wantErr: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name: "missing audience",
+			claims: jwt.MapClaims{
+				"iss": "https://api.cloudbees.io",
+			},
+			apiURL:  "https://api.cloudbees.io",
+			wantErr: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name: "wrong issuer",
+			claims: jwt.MapClaims{
+				"aud": []string{"https://api.cloudbees.io"},
+				"iss": "https://cloudbees.io.example.com",
+			},
+			apiURL:  "https://api.cloudbees.io",
+			wantErr: jwt.ErrTokenInvalidIssuer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getResourceIdFromAutomationToken(testAutomationTokenWithClaims(t, tt.claims), tt.apiURL)
+			if tt.wantErr != nil {
+				var validationErr *TokenValidationError
+				require.True(t, errors.As(err, &validationErr))
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "resource-1", got)
+		})
+	}
+}
+
+func Test_getResourceIdFromAutomationToken_issuerOverride(t *testing.T) {
+	saved := automationTokenIssuerPattern
+	defer func() { automationTokenIssuerPattern = saved }()
+	automationTokenIssuerPattern = regexp.MustCompile(`^https://issuer\.example\.com$`)
+
+	_, err := getResourceIdFromAutomationToken(testAutomationTokenWithClaims(t, jwt.MapClaims{
+		"aud": "api.example.com",
+		"iss": "https://issuer.example.com",
+	}), "https://api.example.com")
+	require.NoError(t, err)
+}
+
+func Test_getToken(t *testing.T) {
+	nearExpiry := time.Now().UTC().Add(30 * time.Second).Truncate(time.Second)
+	fresh := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		responses  []map[string]string
+		statuses   []int
+		want       string
+		wantExpiry time.Time
+		wantCalls  int
+	}{
+		{
+			name: "not expiring",
+			responses: []map[string]string{
+				{"accessToken": "first", "expiresAt": fresh.Format(time.RFC3339)},
+			},
+			statuses:   []int{200},
+			want:       "first",
+			wantExpiry: fresh,
+			wantCalls:  1,
+		},
+		{
+			name: "refreshed",
+			responses: []map[string]string{
+				{"accessToken": "first", "expiresAt": nearExpiry.Format(time.RFC3339)},
+				{"accessToken": "second", "expiresAt": fresh.Format(time.RFC3339)},
+			},
+			statuses:   []int{200, 200},
+			want:       "second",
+			wantExpiry: fresh,
+			wantCalls:  2,
+		},
+		{
+			name: "refresh fails",
+			responses: []map[string]string{
+				{"accessToken": "first", "expiresAt": nearExpiry.Format(time.RFC3339)},
+				{"message": "unavailable"},
+			},
+			statuses:   []int{200, 503},
+			want:       "first",
+			wantExpiry: nearExpiry,
+			wantCalls:  2,
+		},
+		{
+			name: "refresh also near expiry",
+			responses: []map[string]string{
+				{"accessToken": "first", "expiresAt": nearExpiry.Format(time.RFC3339)},
+				{"accessToken": "second", "expiresAt": nearExpiry.Format(time.RFC3339)},
+			},
+			statuses:   []int{200, 200},
+			want:       "first",
+			wantExpiry: nearExpiry,
+			wantCalls:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/reserved/v1/resources/resource-1/scm-access-token", r.URL.Path)
+				var body map[string]string
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				require.Equal(t, "https://github.com/example/repo.git", body["scmRepoUrl"])
+				i := min(calls, len(tt.responses)-1)
+				calls++
+				w.WriteHeader(tt.statuses[i])
+				require.NoError(t, json.NewEncoder(w).Encode(tt.responses[i]))
+			}))
+			defer server.Close()
+
+			got, err := getToken(context.Background(), server.URL, testAutomationToken(t), "https://github.com/example/repo.git", withHTTPClient(server.Client()))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Password)
+			require.NotNil(t, got.PasswordExpiry)
+			require.True(t, tt.wantExpiry.Equal(*got.PasswordExpiry))
+			require.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{value: "", wantOk: false},
+		{value: "5", want: 5 * time.Second, wantOk: true},
+		{value: "-1", wantOk: false},
+		{value: now.Add(10 * time.Second).Format(http.TimeFormat), want: 10 * time.Second, wantOk: true},
+		{value: now.Add(-10 * time.Second).Format(http.TimeFormat), want: 0, wantOk: true},
+		{value: "soon", wantOk: false},
+		{value: "3600", want: maxRetryAfter, wantOk: true},
+		{value: "9223372036854775807", want: maxRetryAfter, wantOk: true},
+		{value: now.Add(time.Hour).Format(http.TimeFormat), want: maxRetryAfter, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_doGetWithRetry(t *testing.T) {
+	saved := tokenRequestBackoff
+	defer func() { tokenRequestBackoff = saved }()
+	tokenRequestBackoff = time.Millisecond
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		limited    int
+		wantErr    bool
+		wantCalls  int
+	}{
+		{name: "retry after", retryAfter: "0", limited: 2, wantCalls: 3},
+		{name: "backoff", limited: 2, wantCalls: 3},
+		{name: "gives up", retryAfter: "0", limited: 5, wantErr: true, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				var body map[string]string
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				require.Equal(t, "value", body["key"])
+				if calls <= tt.limited {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					_, _ = w.Write([]byte("slow down"))
+					return
+				}
+				_, _ = w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"key":"value"}`))
+			require.NoError(t, err)
+
+			res, err := doGetWithRetry(server.Client(), req)
+			require.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "slow down")
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = res.Body.Close() }()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+		})
+	}
+}
+
+func Test_doGetWithRetry_cancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = doGetWithRetry(server.Client(), req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second, "the Retry-After wait stops when the context is done")
+}
+
+func Test_getToken_timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	_, err := getToken(context.Background(), server.URL, testAutomationToken(t), "https://github.com/example/repo.git",
+		withHTTPClient(&http.Client{Timeout: time.Millisecond}))
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = getToken(ctx, server.URL, testAutomationToken(t), "https://github.com/example/repo.git", withHTTPClient(server.Client()))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_validateTokenScopes(t *testing.T) {
+	require.NoError(t, validateTokenScopes([]string{"repo", "read:org"}, nil))
+	require.NoError(t, validateTokenScopes([]string{"repo", "read:org"}, []string{"repo"}))
+	require.NoError(t, validateTokenScopes([]string{"repo", "read:org"}, []string{"read:org", "repo"}))
+	require.EqualError(t, validateTokenScopes([]string{"read:org"}, []string{"repo", "read:org", "write:packages"}),
+		"SCM token is missing the required scopes repo, write:packages, it has read:org")
+	require.Error(t, validateTokenScopes([]string{}, []string{"repo"}))
+}
+
+func Test_getToken_requiredScopes(t *testing.T) {
+	expiry := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name     string
+		response string
+		wantErr  string
+	}{
+		{name: "granted", response: `{"accessToken":"token","expiresAt":"` + expiry + `","scopes":["repo","read:org"]}`},
+		{name: "missing", response: `{"accessToken":"token","expiresAt":"` + expiry + `","scopes":["read:org"]}`, wantErr: "missing the required scopes repo"},
+		{name: "not reported", response: `{"accessToken":"token","expiresAt":"` + expiry + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			got, err := getToken(context.Background(), server.URL, testAutomationToken(t), "https://github.com/example/repo.git",
+				withHTTPClient(server.Client()), withRequiredScopes("repo"))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "token", got.Password)
+		})
+	}
+}
+
+func Test_apiTimeout(t *testing.T) {
+	t.Setenv("CLOUDBEES_API_TIMEOUT_SECONDS", "")
+	require.Equal(t, defaultAPITimeout, apiTimeout())
+	t.Setenv("CLOUDBEES_API_TIMEOUT_SECONDS", "5")
+	require.Equal(t, 5*time.Second, apiTimeout())
+	t.Setenv("CLOUDBEES_API_TIMEOUT_SECONDS", "never")
+	require.Equal(t, defaultAPITimeout, apiTimeout())
+}
+
+func Test_getTokenWithFallback(t *testing.T) {
+	saved := tokenRetryDelay
+	defer func() { tokenRetryDelay = saved }()
+	tokenRetryDelay = time.Millisecond
+
+	fresh := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name      string
+		statuses  []int
+		scopes    []string
+		fallback  bool
+		want      string
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "first attempt", statuses: []int{200}, want: "token", wantCalls: 1},
+		{name: "retried", statuses: []int{503, 200}, want: "token", wantCalls: 2},
+		{name: "falls back", statuses: []int{503, 503}, fallback: true, wantCalls: 2},
+		{name: "fallback disabled", statuses: []int{503, 503}, wantErr: true, wantCalls: 2},
+		{name: "missing scopes", statuses: []int{200}, scopes: []string{"read:org"}, fallback: true, wantErr: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[min(calls, len(tt.statuses)-1)]
+				calls++
+				w.WriteHeader(status)
+				require.NoError(t, json.NewEncoder(w).Encode(scmTokenResponse{AccessToken: "token", ExpiresAt: fresh.Format(time.RFC3339), Scopes: tt.scopes}))
+			}))
+			defer server.Close()
+
+			got, err := getTokenWithFallback(context.Background(), server.URL, testAutomationToken(t), "https://github.com/example/repo.git", tt.fallback,
+				withHTTPClient(server.Client()), withRequiredScopes("repo"))
+			require.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				require.Error(t, err)
+				if tt.scopes != nil {
+					var scopeErr *TokenScopeError
+					require.ErrorAs(t, err, &scopeErr)
+					require.Equal(t, []string{"repo"}, scopeErr.Missing)
+				}
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				require.Nil(t, got)
+			} else {
+				require.Equal(t, tt.want, got.Password)
+			}
+		})
+	}
+}
+
+func Test_doGet_tokenFallback(t *testing.T) {
+	saved, savedConfigFile := tokenRetryDelay, helperConfigFile
+	defer func() { tokenRetryDelay, helperConfigFile = saved, savedConfigFile }()
+	tokenRetryDelay = time.Millisecond
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	get := func(t *testing.T, disableFallback bool) (string, error) {
+		dir := t.TempDir()
+		cli, err := git.NewGitCLI(context.Background())
+		require.NoError(t, err)
+		cli.SetCwd(dir)
+		cli.SetQuiet(true)
+		require.NoError(t, cli.Init(dir))
+
+		cleaner, helperCommand, err := auth.ConfigureToken(cli, "", false, "https://github.com", auth.TokenAuth{
+			Provider:        "github",
+			ScmToken:        "user-token",
+			ApiURL:          server.URL,
+			ApiToken:        testAutomationToken(t),
+			DisableFallback: disableFallback,
+		})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cleaner()) }()
+		_, helperConfigFile, _ = strings.Cut(helperCommand, " --config-file ")
+
+		stdin, err := os.CreateTemp(t.TempDir(), "stdin")
+		require.NoError(t, err)
+		_, err = stdin.WriteString("protocol=https\nhost=github.com\npath=example/repo.git\n")
+		require.NoError(t, err)
+		_, err = stdin.Seek(0, 0)
+		require.NoError(t, err)
+		stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+		require.NoError(t, err)
+		savedStdin, savedStdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = stdin, stdout
+		defer func() { os.Stdin, os.Stdout = savedStdin, savedStdout }()
+
+		command := &cobra.Command{}
+		command.SetContext(context.Background())
+		err = doGet(command, nil)
+		out, readErr := os.ReadFile(stdout.Name())
+		require.NoError(t, readErr)
+		return string(out), err
+	}
+
+	out, err := get(t, false)
+	require.NoError(t, err)
+	require.Contains(t, out, "password=user-token\n")
+
+	_, err = get(t, true)
+	require.Error(t, err)
+}
+
+func Test_validateHelperConfig(t *testing.T) {
+	fresh := time.Now().UTC().Add(47*time.Minute + 30*time.Second).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if strings.Contains(body["scmRepoUrl"], "gitlab") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]string{"accessToken": "token", "expiresAt": fresh.Format(time.RFC3339)}))
+	}))
+	defer server.Close()
+
+	token := base64.StdEncoding.EncodeToString([]byte(testAutomationToken(t)))
+	cfg := &format.Config{}
+	github := cfg.Section("https").Subsection("//github.com/example/repo.git")
+	github.SetOption("cloudBeesApiToken", token)
+	github.SetOption("cloudBeesApiUrl", server.URL)
+
+	var out bytes.Buffer
+	require.NoError(t, validateHelperConfig(context.Background(), &out, cfg, withHTTPClient(server.Client())))
+	require.Equal(t, "✅ https://github.com/example/repo.git - OK (token expires in 47m)\n", out.String())
+
+	gitlab := cfg.Section("https").Subsection("//gitlab.example.com/example/repo.git")
+	gitlab.SetOption("cloudBeesApiToken", token)
+	gitlab.SetOption("cloudBeesApiUrl", server.URL)
+	cfg.Section("https").Subsection("//bitbucket.org/example/repo.git").SetOption("username", "x-token-auth")
+
+	out.Reset()
+	require.ErrorContains(t, validateHelperConfig(context.Background(), &out, cfg, withHTTPClient(server.Client())), "1 of 2 repositories")
+	require.Equal(t, `✅ https://github.com/example/repo.git - OK (token expires in 47m)
+❌ https://gitlab.example.com/example/repo.git - FAILED: HTTP 403
+➖ https://bitbucket.org/example/repo.git - SKIPPED: no CloudBees API token configured
+`, out.String())
+}
+
+func Test_formatExpiresIn(t *testing.T) {
+	require.Equal(t, "47m", formatExpiresIn(47*time.Minute+59*time.Second))
+	require.Equal(t, "1h5m", formatExpiresIn(time.Hour+5*time.Minute))
+	require.Equal(t, "less than 1m", formatExpiresIn(30*time.Second))
+}
+
+func Test_cleanHelperInstalls(t *testing.T) {
+	root := t.TempDir()
+	install := func(name string, token string) string {
+		dir := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		exe := filepath.Join(dir, helper.HelperExecutableName)
+		require.NoError(t, os.WriteFile(exe, []byte("binary"), 0555))
+		cfg := &format.Config{}
+		ss := cfg.Section("https").Subsection("//github.com/example/repo.git")
+		ss.SetOption("cloudBeesApiToken", base64.StdEncoding.EncodeToString([]byte(token)))
+		ss.SetOption("cloudBeesApiUrl", "https://127.0.0.1")
+		var b bytes.Buffer
+		require.NoError(t, format.NewEncoder(&b).Encode(cfg))
+		require.NoError(t, os.WriteFile(exe+".cfg", b.Bytes(), 0666))
+		return exe
+	}
+
+	expiredToken := testAutomationTokenWithClaims(t, jwt.MapClaims{
+		"aud": []string{"127.0.0.1"},
+		"iss": "https://api.cloudbees.io",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	current := install("current", testAutomationToken(t))
+	expired := install("expired", expiredToken)
+	install("stale", testAutomationToken(t))
+	install("orphaned", expiredToken)
+	helpers := []string{
+		"",
+		current + " credential-helper --config-file " + current + ".cfg",
+		expired + " credential-helper --config-file " + expired + ".cfg",
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, cleanHelperInstalls(&out, root, helpers, false))
+	require.Equal(t, "Removed "+filepath.Join(root, "orphaned")+"\nRemoved "+filepath.Join(root, "stale")+"\n", out.String())
+	require.DirExists(t, filepath.Join(root, "current"))
+	require.DirExists(t, filepath.Join(root, "expired"))
+
+	out.Reset()
+	require.NoError(t, cleanHelperInstalls(&out, root, helpers, true))
+	require.Equal(t, "Removed "+filepath.Join(root, "expired")+"\n", out.String())
+
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "current", entries[0].Name())
+
+	require.NoError(t, cleanHelperInstalls(&out, filepath.Join(root, "missing"), helpers, true))
+}
+
+func Test_initHelper(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetQuiet(true)
+
+	gitconfigPath := filepath.Join(home, ".gitconfig")
+	o := initOptions{
+		apiURL:    "https://api.cloudbees.io",
+		apiToken:  "api-token",
+		serverURL: "https://github.com",
+		provider:  "github",
+	}
+
+	var out bytes.Buffer
+	require.ErrorContains(t, initHelper(&out, cli, initOptions{apiURL: o.apiURL, apiToken: o.apiToken}), "--server-url is required")
+	require.ErrorContains(t, initHelper(&out, cli, initOptions{serverURL: o.serverURL}), "--cloudbees-api-url and --cloudbees-api-token are required")
+
+	dryRun := o
+	dryRun.dryRun = true
+	require.NoError(t, initHelper(&out, cli, dryRun))
+	require.Contains(t, out.String(), "[DRY RUN] Would set credential.helper and credential.useHttpPath in "+gitconfigPath)
+	require.NotContains(t, out.String(), o.apiToken)
+	require.NoFileExists(t, gitconfigPath)
+	require.NoDirExists(t, helper.InstallDir())
+
+	out.Reset()
+	require.NoError(t, initHelper(&out, cli, o))
+	require.Equal(t, "✅ Configured the credential helper in "+gitconfigPath+" for:\n  https://github.com (CloudBees API https://api.cloudbees.io)\n", out.String())
+
+	helperCommand, err := cli.GetConfig(true, "credential.helper")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(helperCommand, helper.InstallDir()), helperCommand)
+	useHttpPath, err := cli.GetConfig(true, "credential.useHttpPath")
+	require.NoError(t, err)
+	require.Equal(t, "true", useHttpPath)
+
+	configFile := helperCommand[strings.LastIndex(helperCommand, " ")+1:]
+	bs, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	cfg := &format.Config{}
+	require.NoError(t, format.NewDecoder(bytes.NewReader(bs)).Decode(cfg))
+	ss := cfg.Section("https").Subsection("//github.com")
+	require.Equal(t, "x-access-token", ss.Option("username"))
+	require.Equal(t, "https://api.cloudbees.io", ss.Option("cloudBeesApiUrl"))
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("api-token")), ss.Option("cloudBeesApiToken"))
+
+	// an existing helper is only replaced when forced
+	require.NoError(t, cli.SetConfigStr(true, "credential.helper", "store"))
+	require.ErrorContains(t, initHelper(&out, cli, o), "use --force to replace it")
+	got, err := cli.GetConfig(true, "credential.helper")
+	require.NoError(t, err)
+	require.Equal(t, "store", got)
+
+	forced := o
+	forced.force = true
+	require.NoError(t, initHelper(&out, cli, forced))
+	got, err = cli.GetConfig(true, "credential.helper")
+	require.NoError(t, err)
+	require.Equal(t, helperCommand, got)
+}
+
+func Test_listHelperConfig(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &format.Config{}
+	github := cfg.Section("https").Subsection("//github.com/example/repo.git")
+	github.SetOption("username", "x-access-token")
+	github.SetOption("cloudBeesApiUrl", "https://api.cloudbees.io")
+	github.SetOption("cloudBeesApiToken", base64.StdEncoding.EncodeToString([]byte(testAutomationTokenWithClaims(t, jwt.MapClaims{
+		"sub": "automation-1",
+		"exp": now.Add(time.Hour).Unix(),
+	}))))
+	gitlab := cfg.Section("https").Subsection("//gitlab.example.com/example/repo.git")
+	gitlab.SetOption("cloudBeesApiUrl", "https://api.cloudbees.io")
+	gitlab.SetOption("cloudBeesApiToken", base64.StdEncoding.EncodeToString([]byte(testAutomationTokenWithClaims(t, jwt.MapClaims{
+		"sub": "automation-2",
+		"exp": now.Add(-time.Hour).Unix(),
+	}))))
+	bitbucket := cfg.Section("https").Subsection("//bitbucket.org/example/repo.git")
+	bitbucket.SetOption("username", "x-token-auth")
+	bitbucket.SetOption("password", base64.StdEncoding.EncodeToString([]byte("secret")))
+	cfg.Section("https").Subsection("//git.example.com/example/repo.git").SetOption("username", "git")
+
+	var out bytes.Buffer
+	require.NoError(t, listHelperConfig(&out, cfg, "table", now))
+	require.Equal(t, `SERVER URL                                   AUTH           SUBJECT       EXPIRES               EXPIRED
+https://github.com/example/repo.git          cloudbees-api  automation-1  2024-06-01T13:00:00Z  false
+https://gitlab.example.com/example/repo.git  cloudbees-api  automation-2  2024-06-01T11:00:00Z  true
+https://bitbucket.org/example/repo.git       user-token     -             -                     -
+https://git.example.com/example/repo.git     none           -             -                     -
+`, out.String())
+	require.NotContains(t, out.String(), "secret")
+
+	out.Reset()
+	require.NoError(t, listHelperConfig(&out, cfg, "json", now))
+	var got []helperCredential
+	require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	require.Len(t, got, 4)
+	require.Equal(t, "https://github.com/example/repo.git", got[0].ServerURL)
+	require.Equal(t, credentialAuthCloudBeesAPI, got[0].Auth)
+	require.Equal(t, "automation-1", got[0].Subject)
+	require.Equal(t, now.Add(time.Hour), *got[0].ExpiresAt)
+	require.False(t, got[0].Expired)
+	require.True(t, got[1].Expired)
+	require.Equal(t, credentialAuthUserToken, got[2].Auth)
+	require.Nil(t, got[2].ExpiresAt)
+	require.Equal(t, credentialAuthNone, got[3].Auth)
+
+	require.ErrorContains(t, listHelperConfig(&out, cfg, "yaml", now), "unsupported output format 'yaml'")
+}
+
+func Test_rotateHelperConfig(t *testing.T) {
+	fresh := time.Now().UTC().Add(47*time.Minute + 30*time.Second).Truncate(time.Second)
+	var requests []string
+	failGitLab := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, strings.HasSuffix(r.URL.Path, "/scm-access-token"), r.URL.Path)
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, body["scmRepoUrl"])
+		if failGitLab && strings.Contains(body["scmRepoUrl"], "gitlab") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]string{"accessToken": "fresh-" + body["scmRepoUrl"], "expiresAt": fresh.Format(time.RFC3339)}))
+	}))
+	defer server.Close()
+
+	token := base64.StdEncoding.EncodeToString([]byte(testAutomationToken(t)))
+	cfg := &format.Config{}
+	for _, name := range []string{"//github.com/example/repo.git", "//gitlab.example.com/example/repo.git"} {
+		ss := cfg.Section("https").Subsection(name)
+		ss.SetOption("cloudBeesApiToken", token)
+		ss.SetOption("cloudBeesApiUrl", server.URL)
+		ss.SetOption("password", base64.StdEncoding.EncodeToString([]byte("stale")))
+	}
+	cfg.Section("https").Subsection("//bitbucket.org/example/repo.git").SetOption("password", base64.StdEncoding.EncodeToString([]byte("user-token")))
+
+	configFile := filepath.Join(t.TempDir(), "helper.cfg")
+	require.NoError(t, writeHelperConfigFile(configFile, cfg))
+	stored := func(name string) (string, string, string) {
+		t.Helper()
+		cfg, err := readHelperConfigFile(configFile)
+		require.NoError(t, err)
+		ss := cfg.Section("https").Subsection(name)
+		password, err := base64.StdEncoding.DecodeString(ss.Option("password"))
+		require.NoError(t, err)
+		token, err := base64.StdEncoding.DecodeString(ss.Option("scmToken"))
+		require.NoError(t, err)
+		return string(password), string(token), ss.Option("scmTokenExpiry")
+	}
+	ctx := context.Background()
+	var out bytes.Buffer
+
+	// dry run
+	require.NoError(t, rotateHelperConfig(ctx, &out, configFile, "", true, withHTTPClient(server.Client())))
+	require.Equal(t, `[DRY RUN] Would rotate the SCM token for https://github.com/example/repo.git
+[DRY RUN] Would rotate the SCM token for https://gitlab.example.com/example/repo.git
+`, out.String())
+	require.Empty(t, requests)
+	_, scmToken, _ := stored("//github.com/example/repo.git")
+	require.Empty(t, scmToken)
+
+	// a single server
+	out.Reset()
+	require.NoError(t, rotateHelperConfig(ctx, &out, configFile, "https://github.com/", false, withHTTPClient(server.Client())))
+	require.Equal(t, "✅ https://github.com/example/repo.git - ROTATED (token expires in 47m)\n", out.String())
+	require.Equal(t, []string{"https://github.com/example/repo.git"}, requests)
+	password, scmToken, expiry := stored("//github.com/example/repo.git")
+	require.Equal(t, "stale", password, "the fallback password is left alone")
+	require.Equal(t, "fresh-https://github.com/example/repo.git", scmToken)
+	require.Equal(t, fresh.Format(time.RFC3339), expiry)
+	_, scmToken, _ = stored("//gitlab.example.com/example/repo.git")
+	require.Empty(t, scmToken)
+
+	require.ErrorContains(t, rotateHelperConfig(ctx, &out, configFile, "https://github.community", false, withHTTPClient(server.Client())), "no repositories on https://github.community")
+
+	// any failure leaves the configuration unchanged and reports nothing as rotated
+	before, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	failGitLab = true
+	out.Reset()
+	require.ErrorContains(t, rotateHelperConfig(ctx, &out, configFile, "", false, withHTTPClient(server.Client())), "could not rotate SCM tokens for 1 of 2 repositories")
+	require.Equal(t, "❌ https://gitlab.example.com/example/repo.git - FAILED: HTTP 403\n", out.String())
+	after, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, string(before), string(after))
+
+	// the results are only reported once the file is written
+	require.NoError(t, os.Mkdir(configFile+".tmp", 0o755))
+	failGitLab = false
+	out.Reset()
+	require.Error(t, rotateHelperConfig(ctx, &out, configFile, "", false, withHTTPClient(server.Client())))
+	require.Empty(t, out.String())
+	require.NoError(t, os.Remove(configFile+".tmp"))
+
+	// all servers
+	require.NoError(t, rotateHelperConfig(ctx, &out, configFile, "", false, withHTTPClient(server.Client())))
+	_, scmToken, _ = stored("//gitlab.example.com/example/repo.git")
+	require.Equal(t, "fresh-https://gitlab.example.com/example/repo.git", scmToken)
+	password, scmToken, expiry = stored("//bitbucket.org/example/repo.git")
+	require.Equal(t, "user-token", password)
+	require.Empty(t, scmToken)
+	require.Empty(t, expiry)
+}
+
+func Test_rotatedToken(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ss := (&format.Config{}).Section("https").Subsection("//github.com/example/repo.git")
+
+	got, err := rotatedToken(ss, now)
+	require.NoError(t, err)
+	require.Nil(t, got, "nothing was rotated")
+
+	ss.SetOption("scmToken", base64.StdEncoding.EncodeToString([]byte("rotated")))
+	ss.SetOption("scmTokenExpiry", now.Add(time.Hour).Format(time.RFC3339))
+	got, err = rotatedToken(ss, now)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", got.Password)
+	require.Equal(t, now.Add(time.Hour), *got.PasswordExpiry)
+
+	ss.SetOption("scmTokenExpiry", now.Add(30*time.Second).Format(time.RFC3339))
+	got, err = rotatedToken(ss, now)
+	require.NoError(t, err)
+	require.Nil(t, got, "about to expire")
+
+	ss.SetOption("scmTokenExpiry", "tomorrow")
+	_, err = rotatedToken(ss, now)
+	require.ErrorContains(t, err, "invalid scmTokenExpiry")
+}
+
+func Test_helperDefaultConfigPath(t *testing.T) {
+	home := t.TempDir()
+	xdgConfigHome := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", xdgConfigHome)
+
+	self, err := os.Executable()
+	require.NoError(t, err)
+
+	// neither configuration directory has the file
+	got, err := helperDefaultConfigPath()
+	require.NoError(t, err)
+	require.Equal(t, self+".cfg", got)
+
+	homeConfig := filepath.Join(home, ".config", "cloudbees", "git-credential-helper.cfg")
+	require.NoError(t, os.MkdirAll(filepath.Dir(homeConfig), 0755))
+	require.NoError(t, os.WriteFile(homeConfig, nil, 0644))
+	got, err = helperDefaultConfigPath()
+	require.NoError(t, err)
+	require.Equal(t, homeConfig, got)
+
+	xdgConfig := filepath.Join(xdgConfigHome, "cloudbees", "git-credential-helper.cfg")
+	require.NoError(t, os.MkdirAll(filepath.Dir(xdgConfig), 0755))
+	require.NoError(t, os.WriteFile(xdgConfig, nil, 0644))
+	got, err = helperDefaultConfigPath()
+	require.NoError(t, err)
+	require.Equal(t, xdgConfig, got)
+
+	// XDG_CONFIG_HOME is only used when set
+	t.Setenv("XDG_CONFIG_HOME", "")
+	got, err = helperDefaultConfigPath()
+	require.NoError(t, err)
+	require.Equal(t, homeConfig, got)
+}
@@ -2,27 +2,49 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/cloudbees-io/checkout/internal/auth"
 	"github.com/cloudbees-io/checkout/internal/checkout"
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/cloudbees-io/checkout/internal/version"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
 	cmd = &cobra.Command{
-		Use:          "checkout",
-		Short:        "Implements the actions/checkout",
-		Long:         "Implements the actions/checkout",
-		SilenceUsage: true,
-		RunE:         doCheckout,
+		Use:               "checkout",
+		Short:             "Implements the actions/checkout",
+		Long:              "Implements the actions/checkout",
+		SilenceUsage:      true,
+		Version:           version.String(),
+		PersistentPreRunE: doPreRun,
+		RunE:              doCheckout,
 	}
-	cfg checkout.Config
+	cfg                 checkout.Config
+	outputFormat        string
+	writeTiming         bool
+	normalisedURLOutput bool
+	submoduleURLMap     string
+	sshKeys             string
+	commandTimeout      time.Duration
 )
 
 func Execute() error {
-	return cmd.Execute()
+	executed, err := cmd.ExecuteC()
+	if err != nil && executed != nil && executed.Context() != nil && errors.Is(executed.Context().Err(), context.DeadlineExceeded) {
+		// report the timeout rather than only the failure it caused, such as a git command being killed
+		return fmt.Errorf("%w: %w", context.Cause(executed.Context()), err)
+	}
+	return err
 }
 
 func init() {
@@ -33,38 +55,232 @@ func init() {
 	cmd.Flags().StringVar(&cfg.CloudBeesApiURL, "cloudbees-api-url", "", "CloudBees API root URL to fetch authentication from")
 	cmd.Flags().StringVar(&cfg.Token, "token", "", "Personal access token (PAT) used to fetch the repository")
 	cmd.Flags().StringVar(&cfg.SSHKey, "ssh-key", "", "SSH key used to fetch the repository")
+	cmd.Flags().StringVar(&sshKeys, "ssh-keys", "", "JSON array of {\"host\": ..., \"key\": ...} SSH keys used to fetch the repository and its submodules, each key is only offered to its host, or to every host when the host is empty, takes precedence over --ssh-key")
 	cmd.Flags().StringVar(&cfg.SSHKnownHosts, "ssh-known-hosts", "", "Known hosts in addition to the user and global host key database")
 	cmd.Flags().BoolVar(&cfg.SSHStrict, "ssh-strict", true, "Whether to perform strict host key checking")
+	cmd.Flags().StringVar(&cfg.SSHProxyJump, "ssh-proxy-jump", "", "Bastion host to connect through when fetching the repository over SSH, as accepted by the ssh ProxyJump option")
+	cmd.Flags().StringVar(&cfg.SSHProxyJumpKey, "ssh-proxy-jump-key", "", "SSH key used to connect to the ssh-proxy-jump bastion host")
+	cmd.Flags().StringVar(&cfg.SSHProxyKnownHosts, "ssh-proxy-known-hosts", "", "Known hosts entries for the ssh-proxy-jump bastion hosts, added to the known hosts used for the checkout")
+	cmd.Flags().StringVar(&cfg.HTTPProxy, "http-proxy", "", "HTTP proxy, as a host or URL, used to fetch the repository over HTTPS")
+	cmd.Flags().StringVar(&cfg.HTTPProxyUser, "http-proxy-user", "", "User name used to authenticate with the http-proxy")
+	cmd.Flags().StringVar(&cfg.HTTPProxyPassword, "http-proxy-password", "", "Password used to authenticate with the http-proxy")
+	cmd.Flags().StringVar(&cfg.HTTPVersion, "http-version", "", "HTTP protocol version used by git, either HTTP/1.1 or HTTP/2, defaults to the git default")
+	cmd.Flags().StringVar(&cfg.SSLCABundle, "ssl-ca-bundle", "", "PEM encoded CA certificates used to verify the repository server over HTTPS")
+	cmd.Flags().StringVar(&cfg.SSLCAPath, "ssl-ca-path", "", "Directory of CA certificates used to verify the repository server over HTTPS")
 	cmd.Flags().BoolVar(&cfg.PersistCredentials, "persist-credentials", true, "Whether to configure the token or SSH key with the local git config")
 	cmd.Flags().StringVar(&cfg.Path, "path", "", "Relative path under $CLOUDBEES_WORKSPACE to place the repository")
 	cmd.Flags().BoolVar(&cfg.Clean, "clean", false, "Whether to execute git clean -ffdx && git reset --hard HEAD before fetching")
-	cmd.Flags().StringVar(&cfg.SparseCheckout, "sparse-checkout", "", "Do a sparse checkout on given patterns. Each pattern should be separated with new lines")
+	cmd.Flags().BoolVar(&cfg.StashBeforeClean, "stash-before-clean", false, "Whether to stash local changes, including untracked files, before cleaning and restore them after the checkout")
+	cmd.Flags().StringVar(&cfg.SparseCheckout, "sparse-checkout", "", "Do a sparse checkout on given patterns. Each pattern should be separated with new lines, or @<path> to read the patterns from a file relative to the workspace")
 	cmd.Flags().BoolVar(&cfg.SparseCheckoutConeMode, "sparse-checkout-cone-mode", false, "Specifies whether to use cone-mode when doing a sparse checkout.")
 	cmd.Flags().IntVar(&cfg.FetchDepth, "fetch-depth", 1, "Number of commits to fetch")
+	cmd.Flags().StringVar(&cfg.ShallowSince, "shallow-since", "", "ISO 8601 date, such as 2024-01-31, to fetch the history since instead of a number of commits, overrides fetch-depth")
 	cmd.Flags().BoolVar(&cfg.Lfs, "lfs", false, "Whether to download Git-LFS files")
+	cmd.Flags().BoolVar(&cfg.LfsPointerOnly, "lfs-pointer-only", false, "Whether to leave Git-LFS pointers in the working tree instead of downloading the files, requires lfs")
 	cmd.Flags().StringVar(&cfg.Submodules, "submodules", "false", "Whether to checkout submodules, one of `true`, `false`, or `recursive`")
 	cmd.Flags().BoolVar(&cfg.SetSafeDirectory, "set-safe-directory", true, "Add repository path as safe.directory for Git global config")
 	cmd.Flags().StringVar(&cfg.GithubServerURL, "github-server-url", "", "The base URL for the GitHub instance that you are trying to clone from")
 	cmd.Flags().StringVar(&cfg.BitbucketServerURL, "bitbucket-server-url", "", "The base URL for the Bitbucket instance that you are trying to clone from")
 	cmd.Flags().StringVar(&cfg.GitlabServerURL, "gitlab-server-url", "", "The base URL for the GitLab instance that you are trying to clone from")
+	cmd.Flags().BoolVar(&normalisedURLOutput, "normalised-url-output", true, "Whether to write the normalised clone URL to the repository-url output")
+	cmd.Flags().BoolVar(&cfg.OriginalURLOutput, "original-url-output", false, "Whether to write the repository as supplied to the original-repository-url output")
+	cmd.Flags().BoolVar(&cfg.IgnorePathCase, "ignore-path-case", false, "Whether to treat paths case-insensitively when checking out on a case-sensitive filesystem")
+	cmd.Flags().BoolVar(&cfg.CheckoutPathListOutput, "checkout-path-list", false, "Whether to write the list of checked out files to the checked-out-files output")
+	cmd.Flags().IntVar(&cfg.CheckoutPathListLimit, "checkout-path-list-limit", 0, "Maximum number of entries to write to the checked-out-files output, 0 indicates no limit")
+	cmd.Flags().IntVar(&cfg.SparseCheckoutConeDepth, "sparse-checkout-cone-depth", 0, "Number of directory levels beneath each sparse checkout pattern to expand into cone-mode patterns, 0 disables expansion")
+	cmd.Flags().StringVar(&cfg.CloneFilter, "clone-filter", "", "Partial clone filter to fetch with, such as blob:none or tree:0, overrides the default filter used for sparse checkouts")
+	cmd.Flags().BoolVar(&cfg.Quiet, "quiet", false, "Whether to suppress the output of git commands")
+	cmd.Flags().IntVar(&cfg.GitConfigCountMax, "git-config-count-max", 200, "Maximum number of git config entries that can be injected into git commands via environment variables")
+	cmd.Flags().StringVar(&cfg.WorktreePath, "worktree", "", "Relative path under $CLOUDBEES_WORKSPACE at which to check out the repository as a worktree of a bare clone shared at $CLOUDBEES_WORKSPACE/.git-main-clone, instead of --path")
+	cmd.Flags().StringVar(&submoduleURLMap, "submodule-url-map", "", "Pairs of submodule URLs, formatted old=new and separated with commas or new lines, to fetch submodules from a mirror instead")
+	cmd.Flags().StringSliceVar(&cfg.SubmodulePathPatterns, "submodule-paths", nil, "Glob patterns, separated with commas, of the submodule paths to checkout, all submodules are checked out when empty")
+	cmd.Flags().IntVar(&cfg.SubmoduleJobs, "submodule-jobs", 1, "Number of submodules to fetch in parallel, values above the number of logical CPUs are clamped")
+	cmd.Flags().Int64Var(&cfg.GitHubAppID, "github-app-id", 0, "ID of the GitHub App used to fetch the repository")
+	cmd.Flags().Int64Var(&cfg.GitHubAppInstallationID, "github-app-installation-id", 0, "ID of the GitHub App installation used to fetch the repository")
+	cmd.Flags().StringVar(&cfg.GitHubAppPrivateKey, "github-app-private-key", "", "PEM encoded private key of the GitHub App used to fetch the repository")
+	cmd.Flags().BoolVar(&cfg.WriteManifest, "write-manifest", false, "Whether to write the mode, object name, stage and path of each checked out file to the manifest.jsonl output")
+	cmd.Flags().BoolVar(&cfg.WriteCommitMetadata, "write-commit-metadata", false, "Whether to write the author, committer date and subject of the checked out commit to the commit-* outputs")
+	cmd.Flags().BoolVar(&cfg.WriteDescribe, "write-describe", false, "Whether to write the checked out commit named after the most recent tag, as git describe --tags --always, to the describe output")
+	cmd.Flags().StringVar(&cfg.PostCheckoutScript, "post-checkout-script", "", "Script to run in the repository path after the checkout, the checkout fails if the script fails")
+	cmd.Flags().StringVar(&cfg.PostCheckoutScriptShell, "post-checkout-script-shell", "sh", "Shell to run the post-checkout script with, as <shell> -c <script>")
+	cmd.Flags().StringSliceVar(&cfg.AllowedRepositories, "allowed-repositories", nil, "Glob patterns, separated with commas, of the host and path of the repositories that may be checked out, such as github.com/org/*, all repositories are allowed when empty")
+	cmd.Flags().StringVar(&cfg.AllowedRepositoriesFile, "allowed-repositories-file", "", "Path, relative to $CLOUDBEES_WORKSPACE unless absolute, of a file listing additional allowed-repositories patterns, one per line")
+	cmd.Flags().BoolVar(&cfg.OptimizeAfterCheckout, "optimize", false, "Whether to repack the objects, pack the refs and write the commit-graph after the checkout to speed up later git commands")
+	cmd.Flags().BoolVar(&cfg.AggressiveRepack, "aggressive-repack", false, "Whether the optimize repack recomputes all deltas, which is slow but produces the smallest pack")
+	cmd.Flags().BoolVar(&cfg.NoCheckout, "no-checkout", false, "Whether to only fetch the repository and point HEAD at the commit, without checking out any files")
+	cmd.Flags().StringVar(&cfg.MergeBaseRef, "merge-base-ref", "", "Ref to find the merge base of the checked out commit with, written to the merge-base-commit output, defaults to the base commit of a pull request event")
+	cmd.Flags().StringSliceVar(&cfg.ExtraRefs, "extra-ref", nil, "Additional refs, separated with commas or by repeating the flag, to fetch alongside the checked out ref, the fetched commits are written to the extra-ref-commits output")
+	cmd.Flags().DurationVar(&cfg.IndexLockTimeout, "index-lock-timeout", 30*time.Second, "How long to wait for another git process to release the index.lock of an existing repository before deleting it")
+	cmd.Flags().StringSliceVar(&cfg.RequiredTokenScopes, "require-token-scope", nil, "Scopes, separated with commas or by repeating the flag, that the SCM token fetched from the CloudBees API must have, checked only when the SCM provider reports the token scopes")
+	cmd.Flags().BoolVar(&cfg.DisableTokenFallback, "disable-token-fallback", false, "Fail instead of using the --token value when the SCM token cannot be fetched from the CloudBees API")
+	cmd.Flags().BoolVar(&writeTiming, "write-timing", true, "Whether to write the elapsed time of the checkout and of its fetch, working-tree and submodules phases to the *-duration-ms outputs")
+	cmd.Flags().BoolVar(&cfg.DryRun, "dry-run", false, "Log the git commands that would be run without executing them")
+	cmd.Flags().BoolVar(&cfg.SkipDiskSpaceCheck, "no-check-disk-space", false, "Skip checking there is enough disk space available before fetching")
+	cmd.Flags().StringVar(&cfg.ArchiveOutput, "archive-output", "", "Path, relative to $CLOUDBEES_WORKSPACE unless absolute, to write an archive of the checked out commit to, the format is tar, tar.gz or zip based on the extension")
+	cmd.Flags().BoolVar(&cfg.RunFSCK, "run-fsck", false, "Whether to verify the integrity of the repository objects with git fsck after the checkout")
+	cmd.Flags().StringVar(&cfg.AuditLog, "audit-log", "", "Path of a file to append a JSON line to for each git command that is run")
+	cmd.Flags().StringVar(&outputFormat, "output-format", "text", "Format of the output, one of `text` or `json`")
+
+	documentEnvFallbacks(cmd.Flags())
+
+	cmd.PersistentFlags().DurationVar(&commandTimeout, "timeout", 0, "Maximum time the command can take, such as 10m, 0 for no limit")
+	documentEnvFallbacks(cmd.PersistentFlags())
+
+	// --version is handled by cobra before any command runs
+	cmd.SetVersionTemplate("{{.Version}}\n")
 
 	cmd.AddCommand(helperCmd)
 }
 
+// cliContext returns a context that is cancelled by SIGINT, SIGTERM and SIGPIPE, and when the --timeout expires
 func cliContext() context.Context {
-	ctx, cancel := context.WithCancel(context.Background())
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if commandTimeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(context.Background(), commandTimeout, fmt.Errorf("checkout timed out after %s: %w", commandTimeout, context.DeadlineExceeded))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	// catching SIGPIPE means a write to a closed stdout, such as when piped to `jq` or `head`, fails with EPIPE
+	// instead of killing the process before the deferred cleanup has run. SIGPIPE is not set to SIG_IGN for the git
+	// subprocesses, as signal.Ignore would also stop this notification. A caught signal is reset to the default across
+	// exec, so git keeps the disposition it expects and exits quietly when its reader goes away, as in a shell pipeline.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGPIPE)
 	go func() {
-		<-c
-		cancel() // exit gracefully
-		<-c
-		os.Exit(1) // exit immediately on 2nd signal
+		interrupted := false
+		for sig := range c {
+			if sig == syscall.SIGPIPE {
+				cancel() // nobody is reading the output any more, exit gracefully
+				continue
+			}
+			if interrupted {
+				os.Exit(1) // exit immediately on 2nd signal
+			}
+			interrupted = true
+			cancel() // exit gracefully
+		}
 	}()
 	return ctx
 }
 
+// doPreRun sets up the context of every command, including the credential helper subcommands
+func doPreRun(command *cobra.Command, args []string) error {
+	// the context depends on --timeout, so its fallback cannot wait for the command to load the others
+	if err := loadConfigFromEnv(command.Root().PersistentFlags()); err != nil {
+		return err
+	}
+	command.SetContext(cliContext())
+	return nil
+}
+
+// envFallbackName returns the environment variable that provides the default value of the flag
+func envFallbackName(flag string) string {
+	return "CHECKOUT_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// documentEnvFallbacks appends the environment variable that provides the default value to the usage of each flag
+func documentEnvFallbacks(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		f.Usage = fmt.Sprintf("%s (env: %s)", f.Usage, envFallbackName(f.Name))
+	})
+}
+
+// loadConfigFromEnv sets each flag that was not supplied on the command line from its CHECKOUT_<FLAG> environment
+// variable, if set, so that the command line takes precedence over the environment
+func loadConfigFromEnv(flags *pflag.FlagSet) error {
+	var errs []error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			return
+		}
+		name := envFallbackName(f.Name)
+		value, found := os.LookupEnv(name)
+		if !found {
+			return
+		}
+		// the flag value parses booleans and numbers with strconv, as it does for the command line
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value '%s' for %s: %w", value, name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
 func doCheckout(command *cobra.Command, args []string) error {
-	ctx := cliContext()
-	return cfg.Run(ctx)
+	ctx := command.Context()
+	if err := loadConfigFromEnv(command.Flags()); err != nil {
+		return err
+	}
+	cfg.SkipTiming = !writeTiming
+	cfg.SkipNormalisedURLOutput = !normalisedURLOutput
+	var err error
+	if cfg.SubmoduleURLMap, err = parseSubmoduleURLMap(submoduleURLMap); err != nil {
+		return err
+	}
+	if cfg.SSHKeys, err = parseSSHKeys(sshKeys); err != nil {
+		return err
+	}
+	switch outputFormat {
+	case "text":
+		_, err := cfg.RunWithResult(ctx)
+		return categorizeError(err)
+	case "json":
+		core.StartRecording()
+		result, err := cfg.RunWithResult(ctx)
+		err = categorizeError(err)
+		result.Logs = core.StopRecording()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if encErr := json.NewEncoder(os.Stdout).Encode(result); encErr != nil && err == nil {
+			err = encErr
+		}
+		return err
+	default:
+		return fmt.Errorf("unsupported output format: '%s', expected text/json", outputFormat)
+	}
+}
+
+// parseSubmoduleURLMap parses old=new URL pairs separated with commas or new lines
+func parseSubmoduleURLMap(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		oldURL, newURL, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(oldURL) == "" || strings.TrimSpace(newURL) == "" {
+			return nil, fmt.Errorf("invalid submodule-url-map entry: '%s', expected old=new", pair)
+		}
+		result[strings.TrimSpace(oldURL)] = strings.TrimSpace(newURL)
+	}
+	return result, nil
+}
+
+// parseSSHKeys parses a JSON array of host and key objects, an empty string is no keys
+func parseSSHKeys(s string) ([]auth.SSHKeyEntry, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var result []auth.SSHKeyEntry
+	if err := json.Unmarshal([]byte(s), &result); err != nil {
+		return nil, fmt.Errorf("invalid ssh-keys, expected a JSON array of {\"host\": ..., \"key\": ...} objects: %w", err)
+	}
+	for i, entry := range result {
+		if strings.TrimSpace(entry.Key) == "" {
+			return nil, fmt.Errorf("invalid ssh-keys entry %d for host '%s': the key is empty", i, entry.Host)
+		}
+	}
+	return result, nil
+}
+
+// categorizeError prefixes checkout errors with their category so failures can be triaged at a glance
+func categorizeError(err error) error {
+	var checkoutErr *checkout.CheckoutError
+	if errors.As(err, &checkoutErr) {
+		return fmt.Errorf("%s error: %w", checkoutErr.Category, err)
+	}
+	return err
 }
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudbees-io/checkout/internal/auth"
+	"github.com/cloudbees-io/checkout/internal/version"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSubmoduleURLMap(t *testing.T) {
+	got, err := parseSubmoduleURLMap("")
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	got, err = parseSubmoduleURLMap("https://github.com/org/lib.git=https://mirror.example.com/org/lib.git,\n git@github.com:org/tools.git = https://mirror.example.com/org/tools.git\n")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"https://github.com/org/lib.git": "https://mirror.example.com/org/lib.git",
+		"git@github.com:org/tools.git":   "https://mirror.example.com/org/tools.git",
+	}, got)
+
+	_, err = parseSubmoduleURLMap("https://github.com/org/lib.git")
+	require.Error(t, err)
+}
+
+func Test_parseSSHKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []auth.SSHKeyEntry
+		wantErr string
+	}{
+		{name: "empty", input: ""},
+		{name: "blank", input: " \n"},
+		{
+			name:  "per host",
+			input: `[{"host": "github.com", "key": "github key\n"}, {"host": "gitlab.example.com", "key": "gitlab key\n"}]`,
+			want:  []auth.SSHKeyEntry{{Host: "github.com", Key: "github key\n"}, {Host: "gitlab.example.com", Key: "gitlab key\n"}},
+		},
+		{
+			name:  "any host",
+			input: `[{"key": "any key"}]`,
+			want:  []auth.SSHKeyEntry{{Key: "any key"}},
+		},
+		{name: "not json", input: "github.com=key", wantErr: "invalid ssh-keys"},
+		{name: "object", input: `{"host": "github.com", "key": "key"}`, wantErr: "invalid ssh-keys"},
+		{name: "missing key", input: `[{"host": "github.com"}]`, wantErr: "invalid ssh-keys entry 0 for host 'github.com'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSSHKeys(tt.input)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_versionFlag(t *testing.T) {
+	t.Cleanup(func() {
+		_ = cmd.Flags().Set("version", "false")
+		cmd.SetArgs(nil)
+		cmd.SetOut(nil)
+	})
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--version"})
+
+	require.NoError(t, Execute())
+	require.Equal(t, version.String()+"\n", out.String())
+}
+
+func Test_loadConfigFromEnv(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	repository := flags.String("repository", "", "Repository name with owner")
+	ref := flags.String("ref", "", "The branch, tag or SHA to checkout")
+	fetchDepth := flags.Int("fetch-depth", 1, "Number of commits to fetch")
+	lfs := flags.Bool("lfs", false, "Whether to download Git-LFS files")
+	paths := flags.StringSlice("submodule-paths", nil, "Glob patterns of the submodule paths to checkout")
+	documentEnvFallbacks(flags)
+	require.Equal(t, "Number of commits to fetch (env: CHECKOUT_FETCH_DEPTH)", flags.Lookup("fetch-depth").Usage)
+
+	t.Setenv("CHECKOUT_REPOSITORY", "org/from-env")
+	t.Setenv("CHECKOUT_REF", "refs/heads/from-env")
+	t.Setenv("CHECKOUT_FETCH_DEPTH", "0")
+	t.Setenv("CHECKOUT_LFS", "true")
+	t.Setenv("CHECKOUT_SUBMODULE_PATHS", "lib,vendor/*")
+
+	require.NoError(t, flags.Parse([]string{"--ref=refs/heads/from-flag"}))
+	require.NoError(t, loadConfigFromEnv(flags))
+
+	require.Equal(t, "org/from-env", *repository)
+	require.Equal(t, "refs/heads/from-flag", *ref, "the command line takes precedence")
+	require.Equal(t, 0, *fetchDepth)
+	require.True(t, *lfs)
+	require.Equal(t, []string{"lib", "vendor/*"}, *paths)
+}
+
+func Test_loadConfigFromEnv_invalid(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Int("fetch-depth", 1, "Number of commits to fetch")
+	flags.Bool("lfs", false, "Whether to download Git-LFS files")
+
+	t.Setenv("CHECKOUT_FETCH_DEPTH", "deep")
+	t.Setenv("CHECKOUT_LFS", "maybe")
+
+	require.NoError(t, flags.Parse(nil))
+	err := loadConfigFromEnv(flags)
+	require.ErrorContains(t, err, "CHECKOUT_FETCH_DEPTH")
+	require.ErrorContains(t, err, "CHECKOUT_LFS")
+}
+
+func Test_cliContext_sigpipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGPIPE cannot be sent on windows")
+	}
+
+	ctx := cliContext()
+	// stands in for the cleanup of a checkout, which runs once the context is cancelled
+	cleanedUp := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(cleanedUp)
+	}()
+
+	self, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, self.Signal(syscall.SIGPIPE))
+	select {
+	case <-cleanedUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cleanup did not run after SIGPIPE")
+	}
+	// reaching here means SIGPIPE cancelled the context without killing the process
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func Test_cliContext_sigpipeChildDisposition(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the signal dispositions are read from /proc")
+	}
+
+	cliContext()
+	out, err := exec.Command("sh", "-c", "grep -E '^Sig(Ign|Cgt):' /proc/self/status").Output()
+	require.NoError(t, err)
+	sigpipe := uint64(1) << (uint(syscall.SIGPIPE) - 1)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, mask, _ := strings.Cut(line, ":")
+		bits, err := strconv.ParseUint(strings.TrimSpace(mask), 16, 64)
+		require.NoError(t, err)
+		require.Zero(t, bits&sigpipe, "SIGPIPE is in %s of the child, it keeps the default disposition", name)
+	}
+}
+
+func Test_timeoutFlag(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake git is a shell script")
+	}
+	t.Cleanup(func() {
+		commandTimeout = 0
+		cmd.SetArgs(nil)
+		cmd.SetOut(nil)
+		cmd.SetErr(nil)
+	})
+
+	// a git that never finishes
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "git"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{"credential-helper", "clean", "--timeout", "1ms"})
+
+	start := time.Now()
+	err := Execute()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "checkout timed out after 1ms")
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// from the environment
+	require.NoError(t, cmd.PersistentFlags().Set("timeout", "0"))
+	cmd.PersistentFlags().Lookup("timeout").Changed = false
+	t.Setenv("CHECKOUT_TIMEOUT", "1ms")
+	cmd.SetArgs([]string{"credential-helper", "clean"})
+	err = Execute()
+	require.ErrorContains(t, err, "checkout timed out after 1ms")
+	require.Contains(t, cmd.PersistentFlags().Lookup("timeout").Usage, "(env: CHECKOUT_TIMEOUT)")
+}
@@ -18,7 +18,9 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/cloudbees-io/checkout/internal/core"
 	"github.com/cloudbees-io/checkout/internal/git"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/alessio/shellescape.v1"
 )
 
@@ -41,6 +43,18 @@ type TokenAuth struct {
 	ScmToken string
 	ApiURL   string
 	ApiToken string
+
+	GitHubAppPrivateKey     string
+	GitHubAppID             int64
+	GitHubAppInstallationID int64
+
+	// DisableFallback stops the credential helper from falling back to ScmToken when the CloudBees API fails, the
+	// fallback is only possible when both ScmToken and ApiToken are set
+	DisableFallback bool
+
+	// RequiredScopes are the scopes the SCM token fetched from the CloudBees API must have, when the SCM provider
+	// reports them
+	RequiredScopes []string
 }
 
 func (a *TokenAuth) providerUsername() string {
@@ -65,11 +79,19 @@ func (a *TokenAuth) providerUsername() string {
 func (a *TokenAuth) options() map[string][]string {
 	options := make(map[string][]string)
 	options["username"] = []string{a.providerUsername()}
+	// the helper prefers the CloudBees API and falls back to the password when the API fails
 	if a.ScmToken != "" {
 		options["password"] = []string{base64.StdEncoding.EncodeToString([]byte(a.ScmToken))}
-	} else if a.ApiToken != "" && a.ApiURL != "" {
+	}
+	if a.ApiToken != "" && a.ApiURL != "" {
 		options["cloudBeesApiUrl"] = []string{a.ApiURL}
 		options["cloudBeesApiToken"] = []string{base64.StdEncoding.EncodeToString([]byte(a.ApiToken))}
+		if len(a.RequiredScopes) > 0 {
+			options["requiredTokenScope"] = a.RequiredScopes
+		}
+	}
+	if a.DisableFallback {
+		options["disableFallback"] = []string{"true"}
 	}
 	return options
 }
@@ -83,6 +105,14 @@ func ConfigureToken(cli *git.GitCLI, configPath string, globalConfig bool, serve
 		configPath = filepath.Join(cli.Cwd(), ".git", "config")
 	}
 
+	if token.GitHubAppPrivateKey != "" && token.GitHubAppID != 0 && token.GitHubAppInstallationID != 0 {
+		appToken, _, err := NewGitHubAppToken(serverURL, token.GitHubAppPrivateKey, token.GitHubAppID, token.GitHubAppInstallationID)
+		if err != nil {
+			return noOpClean, "", err
+		}
+		token.ScmToken = appToken
+	}
+
 	var err error
 	if globalConfig {
 		if configPath, err = cli.GlobalConfigPath(); err != nil {
@@ -134,7 +164,9 @@ func ConfigureToken(cli *git.GitCLI, configPath string, globalConfig bool, serve
 	return fullCleaner, helperCommand, nil
 }
 
-func ConfigureSubmoduleTokenAuth(cli *git.GitCLI, recursive bool, serverURL string, token string) error {
+// ConfigureSubmoduleTokenAuth persists the token in the local config of each submodule, and the sshCommand in the
+// local config of each submodule with an SSH URL
+func ConfigureSubmoduleTokenAuth(cli *git.GitCLI, recursive bool, serverURL string, token string, sshCommand string) error {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return err
@@ -167,7 +199,35 @@ func ConfigureSubmoduleTokenAuth(cli *git.GitCLI, recursive bool, serverURL stri
 		}
 	}
 
-	return nil
+	return configureSubmoduleSSHCommand(cli, recursive, sshCommand)
+}
+
+// configureSubmoduleSSHCommand sets core.sshCommand in the local config of each submodule with an SSH URL, the
+// token does not apply to them
+func configureSubmoduleSSHCommand(cli *git.GitCLI, recursive bool, sshCommand string) error {
+	submodules, err := cli.SubmoduleList()
+	if err != nil {
+		return err
+	}
+	var sshPaths []string
+	for _, s := range submodules {
+		if git.IsSSHURL(s.URL) {
+			sshPaths = append(sshPaths, s.Path)
+		}
+	}
+	if len(sshPaths) == 0 {
+		return nil
+	}
+	if sshCommand == "" {
+		core.Info("Warning: submodules %s use SSH URLs but no SSH key is configured, skipping their credentials", strings.Join(sshPaths, ", "))
+		return nil
+	}
+
+	// nested submodules are only known from within their parent, so each submodule checks its own URL
+	script := fmt.Sprintf(`case "$(%s config --get remote.origin.url)" in http://*|https://*) ;; ssh://*|*@*:*) %s config --local core.sshCommand "$1" ;; esac`,
+		shellescape.Quote(cli.Executable()), shellescape.Quote(cli.Executable()))
+	_, err = cli.SubmoduleForeach(recursive, "sh", "-c", script, "sh", sshCommand)
+	return err
 }
 
 func replaceTokenPlaceholder(configPath string, token string) error {
@@ -188,7 +248,24 @@ func replaceTokenPlaceholder(configPath string, token string) error {
 	return os.WriteFile(configPath, content, stat.Mode())
 }
 
+// validateSSHPrivateKey checks that the key is an unencrypted private key that ssh can use, in the OpenSSH, PEM RSA,
+// PEM EC or PKCS#8 format, so that a bad key is reported up front rather than as an opaque ssh failure
+func validateSSHPrivateKey(pem string) error {
+	_, err := ssh.ParsePrivateKey([]byte(pem))
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		return fmt.Errorf("invalid ssh private key: keys protected by a passphrase are not supported")
+	} else if err != nil {
+		// the parse error never includes the key material
+		return fmt.Errorf("invalid ssh private key, expected an OpenSSH, RSA, EC or Ed25519 private key: %w", err)
+	}
+	return nil
+}
+
 func GenerateSSHKey(ctx context.Context, tempDir string, prefix string, inputKey string) (string, error) {
+	if err := validateSSHPrivateKey(inputKey); err != nil {
+		return "", err
+	}
 	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
 		return "", err
 	}
@@ -233,7 +310,36 @@ func GenerateSSHKey(ctx context.Context, tempDir string, prefix string, inputKey
 	return keyPath, nil
 }
 
-func GenerateSSHCommand(sshKeyPath string, sshStrict bool, sshKnownHostsPath string) (string, error) {
+// SSHKeyEntry is an SSH private key together with the host it should be offered to.
+// An empty Host offers the key to every host.
+type SSHKeyEntry struct {
+	Host string `json:"host"`
+	Key  string `json:"key"`
+}
+
+// GenerateSSHKeys writes each of the supplied keys to a unique path in tempDir and returns
+// the entries with Key replaced by the path of the written key. The keys already written are
+// removed when one of them cannot be written.
+func GenerateSSHKeys(ctx context.Context, tempDir string, prefix string, inputKeys []SSHKeyEntry) ([]SSHKeyEntry, error) {
+	keys := make([]SSHKeyEntry, 0, len(inputKeys))
+	for i, entry := range inputKeys {
+		keyPath, err := GenerateSSHKey(ctx, tempDir, fmt.Sprintf("%s_%d", prefix, i), entry.Key)
+		if err != nil {
+			for _, key := range keys {
+				_ = os.Remove(key.Key)
+			}
+			return nil, fmt.Errorf("ssh key %d for host '%s': %w", i, entry.Host, err)
+		}
+		keys = append(keys, SSHKeyEntry{Host: entry.Host, Key: keyPath})
+	}
+	return keys, nil
+}
+
+// GenerateSSHCommand builds the GIT_SSH_COMMAND for the supplied key paths. When all the keys are for the
+// same host they are passed as -i flags, otherwise an ssh_config with a Host stanza per key is written to
+// sshConfigPath and referenced via -F. The jump hosts of proxyJump are connected to by a separate ssh process
+// that only inherits the -F config, so their options are always written to the ssh_config.
+func GenerateSSHCommand(sshKeys []SSHKeyEntry, sshStrict bool, sshKnownHostsPath string, sshConfigPath string, proxyJump string, proxyJumpKeyPath string) (string, error) {
 	ssh, err := exec.LookPath("ssh")
 	if err != nil && !errors.Is(err, exec.ErrDot) {
 		return "", fmt.Errorf("cannot find ssh: %v", err)
@@ -242,7 +348,27 @@ func GenerateSSHCommand(sshKeyPath string, sshStrict bool, sshKnownHostsPath str
 			return "", fmt.Errorf("cannot find ssh: %v", err)
 		}
 	}
-	cmd := fmt.Sprintf("%s -i %s", shellescape.Quote(ssh), shellescape.Quote(sshKeyPath))
+	cmd := shellescape.Quote(ssh)
+	var config strings.Builder
+	if proxyJump != "" {
+		config.WriteString(generateProxyJumpConfig(proxyJump, proxyJumpKeyPath, sshKnownHostsPath, sshStrict))
+	}
+	if sshKeysShareHost(sshKeys) {
+		for _, key := range sshKeys {
+			cmd = cmd + " -i " + shellescape.Quote(key.Key)
+		}
+	} else {
+		config.WriteString(generateSSHConfig(sshKeys))
+	}
+	if config.Len() > 0 {
+		if err := os.WriteFile(sshConfigPath, []byte(config.String()), 0600); err != nil {
+			return "", err
+		}
+		cmd = cmd + " -F $RUNNER_TEMP/" + filepath.Base(sshConfigPath)
+	}
+	if proxyJump != "" {
+		cmd = cmd + " -o " + shellescape.Quote("ProxyJump="+proxyJump)
+	}
 	if sshStrict {
 		cmd = cmd + " -o StrictHostKeyChecking=yes -o CheckHostIP=no"
 	}
@@ -250,7 +376,121 @@ func GenerateSSHCommand(sshKeyPath string, sshStrict bool, sshKnownHostsPath str
 	return cmd, nil
 }
 
-func GenerateSSHKnownHosts(home string, tempDir string, prefix string, inputKnownHosts string) (_ string, retErr error) {
+// proxyJumpHosts returns the host names of the comma separated [user@]host[:port] or ssh:// URI jump hosts
+func proxyJumpHosts(proxyJump string) []string {
+	var hosts []string
+	for _, hop := range strings.Split(proxyJump, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		if at := strings.LastIndex(hop, "@"); at >= 0 {
+			hop = hop[at+1:]
+		}
+		if strings.HasPrefix(hop, "[") {
+			if end := strings.Index(hop, "]"); end > 0 {
+				hop = hop[1:end]
+			}
+		} else if host, _, found := strings.Cut(hop, ":"); found {
+			hop = host
+		}
+		if hop != "" {
+			hosts = append(hosts, hop)
+		}
+	}
+	return hosts
+}
+
+// generateProxyJumpConfig returns a Host stanza for the jump hosts, which are connected to without any of the
+// command line options of the ssh command. The known hosts file includes the ssh-proxy-known-hosts entries.
+func generateProxyJumpConfig(proxyJump string, proxyJumpKeyPath string, sshKnownHostsPath string, sshStrict bool) string {
+	hosts := proxyJumpHosts(proxyJump)
+	if len(hosts) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s\n", strings.Join(hosts, " "))
+	if proxyJumpKeyPath != "" {
+		fmt.Fprintf(&b, "  IdentityFile \"%s\"\n  IdentitiesOnly yes\n", proxyJumpKeyPath)
+	}
+	fmt.Fprintf(&b, "  UserKnownHostsFile \"%s\"\n", sshKnownHostsPath)
+	if sshStrict {
+		b.WriteString("  StrictHostKeyChecking yes\n  CheckHostIP no\n")
+	}
+	return b.String()
+}
+
+func sshKeysShareHost(sshKeys []SSHKeyEntry) bool {
+	for _, key := range sshKeys {
+		if !strings.EqualFold(key.Host, sshKeys[0].Host) {
+			return false
+		}
+	}
+	return true
+}
+
+func generateSSHConfig(sshKeys []SSHKeyEntry) string {
+	var b strings.Builder
+	// ssh uses the first value it obtains for most options, but accumulates IdentityFile
+	// so host specific keys come first and keys for any host are offered last
+	for _, key := range sshKeys {
+		if key.Host != "" {
+			fmt.Fprintf(&b, "Host %s\n  IdentityFile \"%s\"\n  IdentitiesOnly yes\n", key.Host, key.Key)
+		}
+	}
+	for _, key := range sshKeys {
+		if key.Host == "" {
+			fmt.Fprintf(&b, "Host *\n  IdentityFile \"%s\"\n", key.Key)
+		}
+	}
+	return b.String()
+}
+
+var knownHostsKeyTypes = map[string]bool{
+	"ssh-rsa":             true,
+	"ecdsa-sha2-nistp256": true,
+	"ecdsa-sha2-nistp384": true,
+	"ecdsa-sha2-nistp521": true,
+	"ssh-ed25519":         true,
+}
+
+// validateKnownHosts checks each entry follows the [marker] hostnames keytype key [comment] grammar of sshd(8)
+func validateKnownHosts(content string) error {
+	var invalid []string
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if strings.HasPrefix(fields[0], "@") {
+			if fields[0] != "@cert-authority" && fields[0] != "@revoked" {
+				invalid = append(invalid, strconv.Itoa(i+1))
+				continue
+			}
+			fields = fields[1:]
+		}
+		if len(fields) < 3 || !knownHostsKeyTypes[fields[1]] {
+			invalid = append(invalid, strconv.Itoa(i+1))
+			continue
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[2]); err != nil {
+			invalid = append(invalid, strconv.Itoa(i+1))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid ssh known hosts entries on lines: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// GenerateSSHKnownHosts writes the known hosts file used for the checkout, combining the user known hosts, the
+// input known hosts, the host keys of any proxy hosts the connection is routed through, and the public SCM providers
+func GenerateSSHKnownHosts(home string, tempDir string, prefix string, inputKnownHosts string, proxyKnownHosts string) (_ string, retErr error) {
+	if err := validateKnownHosts(inputKnownHosts); err != nil {
+		return "", err
+	}
+	if err := validateKnownHosts(proxyKnownHosts); err != nil {
+		return "", fmt.Errorf("invalid proxy known hosts: %w", err)
+	}
+
 	tmpl := template.New("ssh_known_hosts")
 	tmpl, err := tmpl.Parse(sshKnownHostsTemplate)
 	if err != nil {
@@ -285,10 +525,12 @@ func GenerateSSHKnownHosts(home string, tempDir string, prefix string, inputKnow
 		UserKnownHosts     string
 		UserKnownHostsPath string
 		SSHKnownHosts      string
+		SSHProxyKnownHosts string
 	}{
 		UserKnownHosts:     userKnownHosts,
 		UserKnownHostsPath: userKnownHostsPath,
 		SSHKnownHosts:      inputKnownHosts,
+		SSHProxyKnownHosts: proxyKnownHosts,
 	})
 	return knownHostsPath, err
 }
@@ -0,0 +1,52 @@
+package checkout
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+)
+
+// configureSSLCA points git at the custom CA certificates, writing the CA bundle to tempDir, returning a function
+// that removes the config and the written bundle again
+func (cfg *Config) configureSSLCA(cli localConfigurer, tempDir string, prefix string) (func() error, error) {
+	var keys []string
+	var bundlePath string
+	cleaner := func() error {
+		var errs []error
+		for _, key := range keys {
+			if _, err := cli.UnsetConfig(false, key); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if bundlePath != "" {
+			if err := os.Remove(bundlePath); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	if cfg.SSLCABundle != "" {
+		core.Info("Configuring the custom CA bundle")
+		bundlePath = filepath.Join(tempDir, prefix+"_ca_bundle.pem")
+		if err := os.WriteFile(bundlePath, []byte(cfg.SSLCABundle), 0600); err != nil {
+			return nil, err
+		}
+		keys = append(keys, "http.sslCAInfo")
+		if err := cli.SetConfigStr(false, "http.sslCAInfo", bundlePath); err != nil {
+			return nil, errors.Join(err, cleaner())
+		}
+	}
+
+	if cfg.SSLCAPath != "" {
+		core.Info("Configuring the custom CA path")
+		keys = append(keys, "http.sslCAPath")
+		if err := cli.SetConfigStr(false, "http.sslCAPath", cfg.SSLCAPath); err != nil {
+			return nil, errors.Join(err, cleaner())
+		}
+	}
+
+	return cleaner, nil
+}
@@ -0,0 +1,46 @@
+package checkout
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_configureSSLCA(t *testing.T) {
+	const bundle = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	tempDir := t.TempDir()
+	cli := &fakeConfigurer{config: map[string]string{}}
+	cfg := &Config{SSLCABundle: bundle, SSLCAPath: "/etc/ssl/certs"}
+
+	cleaner, err := cfg.configureSSLCA(cli, tempDir, "id")
+	require.NoError(t, err)
+
+	bundlePath := filepath.Join(tempDir, "id_ca_bundle.pem")
+	require.Equal(t, map[string]string{"http.sslCAInfo": bundlePath, "http.sslCAPath": "/etc/ssl/certs"}, cli.config)
+	content, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	require.Equal(t, bundle, string(content))
+
+	require.NoError(t, cleaner())
+	require.Empty(t, cli.config)
+	require.NoFileExists(t, bundlePath)
+}
+
+func TestConfig_configureSSLCA_pathOnly(t *testing.T) {
+	tempDir := t.TempDir()
+	cli := &fakeConfigurer{config: map[string]string{}}
+	cfg := &Config{SSLCAPath: "/etc/ssl/certs"}
+
+	cleaner, err := cfg.configureSSLCA(cli, tempDir, "id")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"http.sslCAPath": "/etc/ssl/certs"}, cli.config)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, cleaner())
+	require.Empty(t, cli.config)
+}
@@ -0,0 +1,76 @@
+package checkout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/cloudbees-io/checkout/internal/git"
+)
+
+// incrementalSpaceFactor is the share of the existing object store that a fetch into an existing clone is assumed to
+// need, the fetch only transfers the objects the clone does not already have
+const incrementalSpaceFactor = 0.1
+
+// availableSpace returns the number of bytes available on the filesystem containing a path, replaced in tests
+var availableSpace = filesystemAvailableSpace
+
+// estimateRequiredSpace estimates the number of bytes a full history fetch into the repository of cli will need from
+// the size of its existing object store. Only local data is used: git does not advertise the size of a remote
+// repository, so the estimate is zero for a new clone.
+func estimateRequiredSpace(cli *git.GitCLI) (int64, error) {
+	counts, err := cli.CountObjects()
+	if err != nil {
+		return 0, err
+	}
+	local := (counts["size"] + counts["size-pack"]) * 1024
+	return int64(float64(local) * incrementalSpaceFactor), nil
+}
+
+// checkDiskSpace returns an error if the filesystem containing repositoryPath does not have enough space
+// available for the fetch. The check is skipped when either the estimate or the available space is unknown.
+func checkDiskSpace(cli *git.GitCLI, repositoryPath string) error {
+	required, err := estimateRequiredSpace(cli)
+	if err != nil {
+		core.Debug("Unable to estimate the space required for the checkout, skipping disk space check: %v", err)
+		return nil
+	}
+	if required == 0 {
+		core.Debug("No local objects to estimate the space required for the checkout, skipping disk space check")
+		return nil
+	}
+
+	available, err := availableSpace(repositoryPath)
+	if err != nil {
+		core.Debug("Unable to determine the available disk space, skipping disk space check: %v", err)
+		return nil
+	}
+
+	core.Debug("disk space required = %d, available = %d", required, available)
+	if available < required {
+		return fmt.Errorf("insufficient disk space for checkout at '%s': %d bytes available but an estimated %d bytes are required, use --no-check-disk-space to skip this check", repositoryPath, available, required)
+	}
+
+	return nil
+}
+
+// diskUsage returns the total size in bytes of the files under path, like du -s. Symbolic links are not followed,
+// so only the size of the link itself is counted.
+func diskUsage(path string) (int64, error) {
+	var total int64
+	err := filepath.Walk(path, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
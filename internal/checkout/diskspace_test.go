@@ -0,0 +1,114 @@
+package checkout
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/cloudbees-io/checkout/internal/git"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_availableSpace(t *testing.T) {
+	available, err := availableSpace(t.TempDir())
+	require.NoError(t, err)
+	require.Greater(t, available, int64(0))
+}
+
+func Test_diskUsage(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), make([]byte, 100), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.txt"), make([]byte, 50), 0644))
+
+	usage, err := diskUsage(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(150), usage)
+
+	if runtime.GOOS != "windows" {
+		// the target of a symbolic link is not counted
+		outside := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(outside, "big.bin"), make([]byte, 4096), 0644))
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+
+		usage, err = diskUsage(dir)
+		require.NoError(t, err)
+		require.Less(t, usage, int64(150+4096))
+	}
+
+	_, err = diskUsage(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func Test_removeDirectoryContents_reportsFreedSpace(t *testing.T) {
+	t.Setenv("RUNNER_DEBUG", "1")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), make([]byte, 100), 0644))
+
+	core.StartRecording()
+	err := removeDirectoryContents(dir)
+	logs := core.StopRecording()
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	var messages []string
+	for _, l := range logs {
+		messages = append(messages, l.Message)
+	}
+	require.Contains(t, strings.Join(messages, "\n"), "Freed 100 bytes by deleting "+dir)
+}
+
+func TestConfig_Run_diskSpace(t *testing.T) {
+	saved := availableSpace
+	defer func() { availableSpace = saved }()
+	availableSpace = func(string) (int64, error) { return 0, nil }
+
+	// a new clone has no local objects to estimate from, so it is never refused
+	f := newRunFixture(t)
+	cfg := f.config()
+	cfg.FetchDepth = 0
+	require.NoError(t, cfg.Run(context.Background()))
+
+	// a full fetch into the existing clone needs a share of its object store
+	err := cfg.Run(context.Background())
+	require.ErrorContains(t, err, "insufficient disk space")
+	var checkoutErr *CheckoutError
+	require.ErrorAs(t, err, &checkoutErr)
+	require.Equal(t, ErrCategoryFS, checkoutErr.Category)
+
+	// shallow fetches are not checked
+	cfg.FetchDepth = 1
+	require.NoError(t, cfg.Run(context.Background()))
+
+	// the check is on by default for library callers, and skipped when asked
+	cfg.FetchDepth = 0
+	cfg.SkipDiskSpaceCheck = true
+	require.NoError(t, cfg.Run(context.Background()))
+}
+
+func Test_checkDiskSpace(t *testing.T) {
+	saved := availableSpace
+	defer func() { availableSpace = saved }()
+
+	dir := t.TempDir()
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetCwd(dir)
+	cli.SetQuiet(true)
+	require.NoError(t, cli.Init(dir))
+
+	required, err := estimateRequiredSpace(cli)
+	require.NoError(t, err)
+	require.Zero(t, required)
+
+	availableSpace = func(string) (int64, error) { return 0, nil }
+	require.NoError(t, checkDiskSpace(cli, dir))
+}
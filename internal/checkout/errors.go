@@ -0,0 +1,80 @@
+package checkout
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCategory classifies why a checkout failed
+type ErrorCategory int
+
+const (
+	ErrCategoryGit     ErrorCategory = iota // a git command failed
+	ErrCategoryNetwork                      // the remote repository could not be reached
+	ErrCategoryAuth                         // credentials could not be set up
+	ErrCategoryConfig                       // the inputs or environment are invalid
+	ErrCategoryFS                           // the workspace could not be read or written
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrCategoryGit:
+		return "git"
+	case ErrCategoryNetwork:
+		return "network"
+	case ErrCategoryAuth:
+		return "auth"
+	case ErrCategoryConfig:
+		return "config"
+	case ErrCategoryFS:
+		return "filesystem"
+	default:
+		return fmt.Sprintf("ErrorCategory(%d)", int(c))
+	}
+}
+
+// CheckoutError is returned by Config.Run when a step of the checkout fails
+type CheckoutError struct {
+	Category   ErrorCategory
+	Op         string
+	Underlying error
+}
+
+func (e *CheckoutError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Underlying)
+}
+
+func (e *CheckoutError) Unwrap() error {
+	return e.Underlying
+}
+
+// wrapError categorizes err as having happened during op, errors that are already categorized are returned as is
+func wrapError(category ErrorCategory, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var checkoutErr *CheckoutError
+	if errors.As(err, &checkoutErr) {
+		return err
+	}
+	return &CheckoutError{Category: category, Op: op, Underlying: err}
+}
+
+// MergeError is returned when the merge binary fails to merge a pull request and reports why, such as a conflict
+type MergeError struct {
+	Kind             string
+	ConflictingFiles []string
+	Underlying       error
+}
+
+func (e *MergeError) Error() string {
+	if len(e.ConflictingFiles) > 0 {
+		return fmt.Sprintf("merge failed with %s in %s: %v", e.Kind, strings.Join(e.ConflictingFiles, ", "), e.Underlying)
+	}
+	return fmt.Sprintf("merge failed with %s: %v", e.Kind, e.Underlying)
+}
+
+func (e *MergeError) Unwrap() error {
+	return e.Underlying
+}
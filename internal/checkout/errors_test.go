@@ -0,0 +1,99 @@
+package checkout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_wrapError(t *testing.T) {
+	require.NoError(t, wrapError(ErrCategoryGit, "op", nil))
+
+	underlying := errors.New("boom")
+	err := wrapError(ErrCategoryNetwork, "fetching the repository", underlying)
+	require.EqualError(t, err, "fetching the repository: boom")
+	require.ErrorIs(t, err, underlying)
+
+	var checkoutErr *CheckoutError
+	require.True(t, errors.As(fmt.Errorf("outer: %w", err), &checkoutErr))
+	require.Equal(t, ErrCategoryNetwork, checkoutErr.Category)
+	require.Equal(t, "network", checkoutErr.Category.String())
+
+	// the category closest to the origin wins
+	rewrapped := wrapError(ErrCategoryGit, "other", err)
+	require.True(t, errors.As(rewrapped, &checkoutErr))
+	require.Equal(t, ErrCategoryNetwork, checkoutErr.Category)
+}
+
+func TestConfig_Run_errorCategories(t *testing.T) {
+	tests := []struct {
+		name      string
+		workspace bool
+		cfg       Config
+		want      ErrorCategory
+	}{
+		{
+			name: "config",
+			cfg:  Config{Provider: GitHubProvider, Repository: "org/repo", Submodules: "false"},
+			want: ErrCategoryConfig,
+		},
+		{
+			name:      "auth",
+			workspace: true,
+			cfg: Config{
+				Provider:      CustomProvider,
+				Repository:    "git@git.example.com:org/repo.git",
+				Ref:           "main",
+				SSHKey:        "key",
+				SSHKnownHosts: "not a known hosts entry",
+				Submodules:    "false",
+			},
+			want: ErrCategoryAuth,
+		},
+		{
+			name:      "network",
+			workspace: true,
+			cfg: Config{
+				Provider:   CustomProvider,
+				Repository: filepath.Join(t.TempDir(), "missing.git"),
+				Ref:        "main",
+				Token:      "token",
+				FetchDepth: 1,
+				Submodules: "false",
+			},
+			want: ErrCategoryNetwork,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRunFixture(t)
+			if !tt.workspace {
+				t.Setenv("CLOUDBEES_WORKSPACE", filepath.Join(t.TempDir(), "missing"))
+			}
+
+			err := tt.cfg.Run(context.Background())
+			var checkoutErr *CheckoutError
+			require.True(t, errors.As(err, &checkoutErr), "unexpected error: %v", err)
+			require.Equal(t, tt.want, checkoutErr.Category, "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestConfig_Run_errorCategories_afterCheckout(t *testing.T) {
+	f := newRunFixture(t)
+	shell := filepath.Join(t.TempDir(), "debug-shell")
+	require.NoError(t, os.WriteFile(shell, []byte("#!/bin/sh\nexit 3\n"), 0o755))
+	t.Setenv("DEBUG_SHELL", shell)
+
+	cfg := f.config()
+	err := cfg.Run(context.Background())
+	var checkoutErr *CheckoutError
+	require.True(t, errors.As(err, &checkoutErr), "unexpected error: %v", err)
+	require.Equal(t, ErrCategoryConfig, checkoutErr.Category, "unexpected error: %v", err)
+	require.ErrorContains(t, err, "running the debug shell")
+}
@@ -0,0 +1,35 @@
+package checkout
+
+import (
+	"time"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+)
+
+// repositoryOptimizer is the subset of git.GitCLI used to optimize the repository after the checkout
+type repositoryOptimizer interface {
+	Repack(aggressive bool) error
+	PackRefs(all bool) error
+	CommitGraph(reachable bool) error
+}
+
+// optimizeRepository rearranges the object store of a freshly fetched repository for local access, logging how long
+// each step took
+func optimizeRepository(cli repositoryOptimizer, aggressive bool) error {
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "repack", run: func() error { return cli.Repack(aggressive) }},
+		{name: "pack-refs", run: func() error { return cli.PackRefs(true) }},
+		{name: "commit-graph", run: func() error { return cli.CommitGraph(true) }},
+	}
+	for _, step := range steps {
+		start := time.Now()
+		if err := step.run(); err != nil {
+			return err
+		}
+		core.Info("%s took %s", step.name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package checkout
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingOptimizer struct {
+	calls   []string
+	failing string
+}
+
+func (r *recordingOptimizer) record(call string) error {
+	r.calls = append(r.calls, call)
+	if call == r.failing {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (r *recordingOptimizer) Repack(aggressive bool) error {
+	return r.record(fmt.Sprintf("repack %v", aggressive))
+}
+
+func (r *recordingOptimizer) PackRefs(all bool) error {
+	return r.record(fmt.Sprintf("pack-refs %v", all))
+}
+
+func (r *recordingOptimizer) CommitGraph(reachable bool) error {
+	return r.record(fmt.Sprintf("commit-graph %v", reachable))
+}
+
+func Test_optimizeRepository(t *testing.T) {
+	cli := &recordingOptimizer{}
+	core.StartRecording()
+	require.NoError(t, optimizeRepository(cli, false))
+	logs := core.StopRecording()
+	require.Equal(t, []string{"repack false", "pack-refs true", "commit-graph true"}, cli.calls)
+	require.Len(t, logs, 3)
+	require.Regexp(t, `^repack took \S+$`, logs[0].Message)
+
+	cli = &recordingOptimizer{}
+	require.NoError(t, optimizeRepository(cli, true))
+	require.Equal(t, "repack true", cli.calls[0])
+
+	cli = &recordingOptimizer{failing: "pack-refs true"}
+	require.Error(t, optimizeRepository(cli, false))
+	require.Equal(t, []string{"repack false", "pack-refs true"}, cli.calls)
+}
@@ -0,0 +1,298 @@
+package checkout
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/cloudbees-io/checkout/internal/git"
+)
+
+// RunResult is the outcome of a checkout, suitable for structured output
+type RunResult struct {
+	RepositoryURL   string            `json:"repository-url,omitempty"`
+	Commit          string            `json:"commit,omitempty"`
+	ShortCommit     string            `json:"short-commit,omitempty"`
+	Ref             string            `json:"ref,omitempty"`
+	DurationMs      int64             `json:"checkout-duration-ms"`
+	CommitInfo      *git.CommitInfo   `json:"commit-info,omitempty"`
+	FsckStatus      string            `json:"fsck-status,omitempty"`
+	Describe        string            `json:"describe,omitempty"`
+	MergeBase       string            `json:"merge-base-commit,omitempty"`
+	ExtraRefCommits map[string]string `json:"extra-ref-commits,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	phases          phaseTimer
+	Logs            []core.LogEntry `json:"logs"`
+	// resolvedRef is Ref qualified the same way the checkout resolved it
+	resolvedRef string
+}
+
+// writeActionOutputs writes the action outputs to the $CLOUDBEES_OUTPUTS directory, one file per output
+func (cfg *Config) writeActionOutputs(result *RunResult) error {
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	resolvedRef := result.resolvedRef
+	if resolvedRef == "" {
+		resolvedRef = result.Ref
+	}
+	outputs := map[string]string{
+		"commit":       result.Commit,
+		"short-commit": result.ShortCommit,
+		"ref":          result.Ref,
+		"branch":       shortBranchName(resolvedRef),
+		"tag":          shortTagName(resolvedRef),
+	}
+
+	if !cfg.SkipNormalisedURLOutput {
+		outputs["repository-url"] = result.RepositoryURL
+	}
+
+	if cfg.OriginalURLOutput {
+		outputs["original-repository-url"] = cfg.Repository
+	}
+
+	if cfg.WriteDescribe {
+		outputs["describe"] = result.Describe
+	}
+
+	if cfg.MergeBaseRef != "" || result.MergeBase != "" {
+		outputs["merge-base-commit"] = result.MergeBase
+	}
+
+	if len(cfg.ExtraRefs) > 0 {
+		var lines strings.Builder
+		for _, ref := range cfg.ExtraRefs {
+			fmt.Fprintf(&lines, "%s=%s\n", ref, result.ExtraRefCommits[ref])
+		}
+		outputs["extra-ref-commits"] = lines.String()
+	}
+
+	if result.CommitInfo != nil {
+		outputs["commit-author-name"] = result.CommitInfo.AuthorName
+		outputs["commit-author-email"] = result.CommitInfo.AuthorEmail
+		outputs["commit-committer-date-unix"] = strconv.FormatInt(result.CommitInfo.CommitterDate.Unix(), 10)
+		outputs["commit-message-subject"] = result.CommitInfo.Subject
+	}
+
+	if cfg.DryRun {
+		if cfg.WriteCommitMetadata {
+			for _, name := range []string{"commit-author-name", "commit-author-email", "commit-committer-date-unix", "commit-message-subject"} {
+				outputs[name] = ""
+			}
+		}
+		for name := range outputs {
+			outputs[name] = "dry-run"
+		}
+	}
+
+	for name, value := range outputs {
+		if err := writeAtomicFile(outputsDir, name, value, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shortBranchName returns the branch name of a refs/heads/ ref, or an empty string for any other ref
+func shortBranchName(ref string) string {
+	if branch, found := strings.CutPrefix(ref, "refs/heads/"); found {
+		return branch
+	}
+	return ""
+}
+
+// shortTagName returns the tag name of a refs/tags/ ref, or an empty string for any other ref
+func shortTagName(ref string) string {
+	if tag, found := strings.CutPrefix(ref, "refs/tags/"); found {
+		return tag
+	}
+	return ""
+}
+
+// archiveFormat returns the git archive format for an archive path based on its extension, defaulting to tar
+func archiveFormat(archivePath string) string {
+	lower := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	default:
+		return "tar"
+	}
+}
+
+// timedPhases are the phases of the checkout whose elapsed time is written to the <phase>-duration-ms outputs
+var timedPhases = []string{"fetch", "working-tree", "submodules"}
+
+// phaseTimer accumulates the elapsed time of each phase of the checkout
+type phaseTimer struct {
+	durations map[string]time.Duration
+}
+
+// start starts timing the phase, returning the func that stops it
+func (p *phaseTimer) start(phase string) func() {
+	started := time.Now()
+	return func() {
+		if p.durations == nil {
+			p.durations = make(map[string]time.Duration)
+		}
+		p.durations[phase] += time.Since(started)
+	}
+}
+
+// writeDurationOutput writes the elapsed time of the checkout to the checkout-duration-ms output, and of each of
+// its phases to the <phase>-duration-ms outputs, where a phase that was skipped took 0ms
+func writeDurationOutput(result *RunResult) error {
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	if err := writeAtomicFile(outputsDir, "checkout-duration-ms", strconv.FormatInt(result.DurationMs, 10), 0644); err != nil {
+		return err
+	}
+	for _, phase := range timedPhases {
+		ms := result.phases.durations[phase].Milliseconds()
+		if err := writeAtomicFile(outputsDir, phase+"-duration-ms", strconv.FormatInt(ms, 10), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFsckStatusOutput writes the outcome of the repository integrity check, if one was run, to the fsck-status output
+func writeFsckStatusOutput(result *RunResult) error {
+	if result.FsckStatus == "" {
+		return nil
+	}
+
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	return writeAtomicFile(outputsDir, "fsck-status", result.FsckStatus, 0644)
+}
+
+// writeMergeConflictsOutput writes the files that conflicted when merging a pull request to the merge-conflicts output
+func writeMergeConflictsOutput(files []string) error {
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	content := strings.Join(files, "\n")
+	if len(files) > 0 {
+		content += "\n"
+	}
+
+	return writeAtomicFile(outputsDir, "merge-conflicts", content, 0644)
+}
+
+// writeCheckedOutFiles writes the list of files in the working tree to the checked-out-files output
+func (cfg *Config) writeCheckedOutFiles(cli *git.GitCLI) error {
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	var files []string
+	// with no-checkout the index describes the commit, but none of its files are in the working tree
+	if !cfg.NoCheckout {
+		if files, err = cli.ListFiles(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.CheckoutPathListLimit > 0 && len(files) > cfg.CheckoutPathListLimit {
+		files = append(files[:cfg.CheckoutPathListLimit], fmt.Sprintf("[truncated after %d entries]", cfg.CheckoutPathListLimit))
+	}
+
+	content := strings.Join(files, "\n")
+	if len(files) > 0 {
+		content += "\n"
+	}
+
+	return writeAtomicFile(outputsDir, "checked-out-files", content, 0644)
+}
+
+// manifestLister is the subset of the GitCLI used to build the checkout manifest
+type manifestLister interface {
+	LsFiles(staged bool) ([]git.ManifestEntry, error)
+}
+
+// writeManifest writes the staged files in the index as newline-delimited JSON to the manifest.jsonl output
+func (cfg *Config) writeManifest(cli manifestLister) error {
+	outputsDir, err := actionOutputsDir()
+	if err != nil || outputsDir == "" {
+		return err
+	}
+
+	entries, err := cli.LsFiles(true)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	enc := json.NewEncoder(&content)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return writeAtomicFile(outputsDir, "manifest.jsonl", content.String(), 0644)
+}
+
+// writeAtomicFile writes content to a temporary file in dir and then renames it to name, so that readers
+// never observe a partially written file
+func writeAtomicFile(dir string, name string, content string, perm os.FileMode) (retErr error) {
+	f, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+// actionOutputsDir returns the $CLOUDBEES_OUTPUTS directory, creating it if necessary, or the empty string if
+// action outputs are not available
+func actionOutputsDir() (string, error) {
+	outputsDir, found := os.LookupEnv("CLOUDBEES_OUTPUTS")
+	if !found || outputsDir == "" {
+		core.Debug("CLOUDBEES_OUTPUTS is not defined, skipping action outputs")
+		return "", nil
+	}
+
+	if err := os.MkdirAll(outputsDir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	return outputsDir, nil
+}
@@ -0,0 +1,265 @@
+package checkout
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cloudbees-io/checkout/internal/git"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeManifestLister []git.ManifestEntry
+
+func (f fakeManifestLister) LsFiles(staged bool) ([]git.ManifestEntry, error) {
+	return f, nil
+}
+
+func TestConfig_writeManifest(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	cfg := &Config{WriteManifest: true}
+	require.NoError(t, cfg.writeManifest(fakeManifestLister{
+		{Mode: "100644", SHA: "8ab686eafeb1f44702738c8b0f24f2567c36da6d", Stage: 0, Path: "README.md"},
+		{Mode: "100755", SHA: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", Stage: 0, Path: "bin/run\ttab.sh"},
+	}))
+
+	content, err := os.ReadFile(filepath.Join(outputsDir, "manifest.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, `{"mode":"100644","sha":"8ab686eafeb1f44702738c8b0f24f2567c36da6d","stage":0,"path":"README.md"}
+{"mode":"100755","sha":"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391","stage":0,"path":"bin/run\ttab.sh"}
+`, string(content))
+}
+
+func Test_writeAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, writeAtomicFile(dir, "commit", "first", 0644))
+	require.NoError(t, writeAtomicFile(dir, "commit", "second", 0644))
+
+	content, err := os.ReadFile(filepath.Join(dir, "commit"))
+	require.NoError(t, err)
+	require.Equal(t, "second", string(content))
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dir, "commit"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.Error(t, writeAtomicFile(filepath.Join(dir, "missing"), "commit", "third", 0644))
+}
+
+func Test_writeDurationOutput(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	require.NoError(t, writeDurationOutput(&RunResult{DurationMs: 1234}))
+
+	content, err := os.ReadFile(filepath.Join(outputsDir, "checkout-duration-ms"))
+	require.NoError(t, err)
+	require.Equal(t, "1234", string(content))
+
+	for _, phase := range timedPhases {
+		content, err := os.ReadFile(filepath.Join(outputsDir, phase+"-duration-ms"))
+		require.NoError(t, err)
+		require.Equal(t, "0", string(content), phase)
+	}
+}
+
+func Test_phaseTimer(t *testing.T) {
+	var p phaseTimer
+	stop := p.start("fetch")
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	stop = p.start("fetch")
+	time.Sleep(10 * time.Millisecond)
+	stop()
+
+	require.GreaterOrEqual(t, p.durations["fetch"], 20*time.Millisecond)
+	require.Zero(t, p.durations["submodules"])
+}
+
+func TestConfig_writeActionOutputs_dryRun(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	cfg := &Config{DryRun: true, WriteCommitMetadata: true}
+	require.NoError(t, cfg.writeActionOutputs(&RunResult{RepositoryURL: "https://github.com/org/repo.git", Ref: "main"}))
+
+	entries, err := os.ReadDir(outputsDir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+		content, err := os.ReadFile(filepath.Join(outputsDir, e.Name()))
+		require.NoError(t, err)
+		require.Equal(t, "dry-run", string(content), e.Name())
+	}
+	require.Equal(t, []string{
+		"branch",
+		"commit",
+		"commit-author-email",
+		"commit-author-name",
+		"commit-committer-date-unix",
+		"commit-message-subject",
+		"ref",
+		"repository-url",
+		"short-commit",
+		"tag",
+	}, names)
+}
+
+func Test_shortBranchName(t *testing.T) {
+	require.Equal(t, "main", shortBranchName("refs/heads/main"))
+	require.Equal(t, "feature/x", shortBranchName("refs/heads/feature/x"))
+	require.Equal(t, "", shortBranchName("refs/tags/v1.0.0"))
+	require.Equal(t, "", shortBranchName("refs/pull/1/head"))
+	require.Equal(t, "", shortBranchName(""))
+}
+
+func Test_shortTagName(t *testing.T) {
+	require.Equal(t, "v1.0.0", shortTagName("refs/tags/v1.0.0"))
+	require.Equal(t, "", shortTagName("refs/heads/main"))
+	require.Equal(t, "", shortTagName(""))
+}
+
+func TestConfig_writeActionOutputs_branchAndTag(t *testing.T) {
+	tests := []struct {
+		ref        string
+		wantBranch string
+		wantTag    string
+	}{
+		{ref: "refs/heads/main", wantBranch: "main"},
+		{ref: "refs/tags/v1.0.0", wantTag: "v1.0.0"},
+		{ref: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			outputsDir := t.TempDir()
+			t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+			cfg := &Config{}
+			require.NoError(t, cfg.writeActionOutputs(&RunResult{Ref: tt.ref}))
+
+			branch, err := os.ReadFile(filepath.Join(outputsDir, "branch"))
+			require.NoError(t, err)
+			require.Equal(t, tt.wantBranch, string(branch))
+			tag, err := os.ReadFile(filepath.Join(outputsDir, "tag"))
+			require.NoError(t, err)
+			require.Equal(t, tt.wantTag, string(tag))
+		})
+	}
+}
+
+func TestConfig_writeActionOutputs_repositoryURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		normalised   bool
+		original     bool
+		wantOutputs  map[string]string
+		wantNoOutput []string
+	}{
+		{
+			name:         "normalised",
+			normalised:   true,
+			wantOutputs:  map[string]string{"repository-url": "https://github.com/org/repo.git"},
+			wantNoOutput: []string{"original-repository-url"},
+		},
+		{
+			name:         "original",
+			original:     true,
+			wantOutputs:  map[string]string{"original-repository-url": "org/repo"},
+			wantNoOutput: []string{"repository-url"},
+		},
+		{
+			name:       "both",
+			normalised: true,
+			original:   true,
+			wantOutputs: map[string]string{
+				"repository-url":          "https://github.com/org/repo.git",
+				"original-repository-url": "org/repo",
+			},
+		},
+		{
+			name:         "neither",
+			wantNoOutput: []string{"repository-url", "original-repository-url"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputsDir := t.TempDir()
+			t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+			cfg := &Config{Repository: "org/repo", SkipNormalisedURLOutput: !tt.normalised, OriginalURLOutput: tt.original}
+			require.NoError(t, cfg.writeActionOutputs(&RunResult{RepositoryURL: "https://github.com/org/repo.git"}))
+
+			for name, want := range tt.wantOutputs {
+				content, err := os.ReadFile(filepath.Join(outputsDir, name))
+				require.NoError(t, err)
+				require.Equal(t, want, string(content), name)
+			}
+			for _, name := range tt.wantNoOutput {
+				require.NoFileExists(t, filepath.Join(outputsDir, name))
+			}
+		})
+	}
+}
+
+func Test_archiveFormat(t *testing.T) {
+	require.Equal(t, "zip", archiveFormat("snapshot.ZIP"))
+	require.Equal(t, "tar.gz", archiveFormat("snapshot.tar.gz"))
+	require.Equal(t, "tar.gz", archiveFormat("/tmp/snapshot.tgz"))
+	require.Equal(t, "tar", archiveFormat("snapshot.tar"))
+	require.Equal(t, "tar", archiveFormat("snapshot"))
+}
+
+func Test_writeFsckStatusOutput(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	require.NoError(t, writeFsckStatusOutput(&RunResult{}))
+	require.NoFileExists(t, filepath.Join(outputsDir, "fsck-status"))
+
+	require.NoError(t, writeFsckStatusOutput(&RunResult{FsckStatus: "failed"}))
+	content, err := os.ReadFile(filepath.Join(outputsDir, "fsck-status"))
+	require.NoError(t, err)
+	require.Equal(t, "failed", string(content))
+}
+
+func TestConfig_writeActionOutputs_mergeBase(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	cfg := &Config{}
+	require.NoError(t, cfg.writeActionOutputs(&RunResult{}))
+	require.NoFileExists(t, filepath.Join(outputsDir, "merge-base-commit"))
+
+	require.NoError(t, cfg.writeActionOutputs(&RunResult{MergeBase: "0123456789abcdef0123456789abcdef01234567"}))
+	content, err := os.ReadFile(filepath.Join(outputsDir, "merge-base-commit"))
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abcdef0123456789abcdef01234567", string(content))
+}
+
+func TestConfig_writeActionOutputs_extraRefCommits(t *testing.T) {
+	outputsDir := t.TempDir()
+	t.Setenv("CLOUDBEES_OUTPUTS", outputsDir)
+
+	cfg := &Config{ExtraRefs: []string{"release", "refs/heads/develop"}}
+	require.NoError(t, cfg.writeActionOutputs(&RunResult{ExtraRefCommits: map[string]string{
+		"refs/heads/develop": "1111111111111111111111111111111111111111",
+		"release":            "2222222222222222222222222222222222222222",
+	}}))
+
+	content, err := os.ReadFile(filepath.Join(outputsDir, "extra-ref-commits"))
+	require.NoError(t, err)
+	require.Equal(t, "release=2222222222222222222222222222222222222222\nrefs/heads/develop=1111111111111111111111111111111111111111\n", string(content))
+}
@@ -0,0 +1,59 @@
+package checkout
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/cloudbees-io/checkout/internal/core"
+)
+
+// localConfigurer is the subset of git.GitCLI needed to set and remove local config entries
+type localConfigurer interface {
+	SetConfigStr(global bool, key string, val string) error
+	UnsetConfig(global bool, key string) (bool, error)
+}
+
+// proxyConfigurer is the subset of git.GitCLI needed to configure the HTTP proxy
+type proxyConfigurer interface {
+	InjectConfig(key string, val string) error
+	AddMask(secret string)
+}
+
+// httpProxyURL returns the HTTP proxy URL with the proxy credentials embedded
+func (cfg *Config) httpProxyURL() (string, error) {
+	proxy := cfg.HTTPProxy
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid http-proxy '%s', expects a host or URL", cfg.HTTPProxy)
+	}
+	if cfg.HTTPProxyUser != "" {
+		if cfg.HTTPProxyPassword != "" {
+			u.User = url.UserPassword(cfg.HTTPProxyUser, cfg.HTTPProxyPassword)
+		} else {
+			u.User = url.User(cfg.HTTPProxyUser)
+		}
+	}
+	return u.String(), nil
+}
+
+// configureHTTPProxy injects http.proxy into all subsequent git commands. The proxy URL can carry the proxy
+// credentials so it is never written to the git config.
+func (cfg *Config) configureHTTPProxy(cli proxyConfigurer) error {
+	proxyURL, err := cfg.httpProxyURL()
+	if err != nil {
+		return err
+	}
+
+	if cfg.HTTPProxyPassword != "" {
+		cli.AddMask(cfg.HTTPProxyPassword)
+		// the password is percent-encoded in the URL
+		cli.AddMask(strings.TrimPrefix(url.UserPassword("", cfg.HTTPProxyPassword).String(), ":"))
+	}
+
+	core.Info("Configuring the HTTP proxy")
+	return cli.InjectConfig("http.proxy", proxyURL)
+}
@@ -5,13 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/url"
 	"os"
 	"os/exec"
 	path2 "path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/cloudbees-io/checkout/internal/auth"
 	"github.com/cloudbees-io/checkout/internal/core"
@@ -22,25 +27,75 @@ import (
 type Config struct {
 	Provider                     string
 	Repository                   string
-	Ref                          string
+	Ref                          string // also accepts Gerrit change refs, refs/changes/<last two digits of change>/<change>/<patchset>, when the remote is Gerrit
 	CloudBeesApiToken            string
 	CloudBeesApiURL              string
 	Token                        string
+	GitHubAppID                  int64
+	GitHubAppInstallationID      int64
+	GitHubAppPrivateKey          string
 	SSHKey                       string
+	SSHKeys                      []auth.SSHKeyEntry
 	SSHKnownHosts                string
 	SSHStrict                    bool
+	SSHProxyJump                 string
+	SSHProxyJumpKey              string
+	SSHProxyKnownHosts           string
+	HTTPProxy                    string
+	HTTPProxyUser                string
+	HTTPProxyPassword            string
+	HTTPVersion                  string
+	SSLCABundle                  string
+	SSLCAPath                    string
 	PersistCredentials           bool
 	Path                         string
 	Clean                        bool
+	StashBeforeClean             bool
 	SparseCheckout               string
 	SparseCheckoutConeMode       bool
+	SparseCheckoutConeDepth      int
+	CloneFilter                  string
 	FetchDepth                   int
+	ShallowSince                 string
 	Lfs                          bool
+	LfsPointerOnly               bool
 	Submodules                   string
+	SubmoduleURLMap              map[string]string
+	SubmoduleJobs                int
+	SubmodulePathPatterns        []string
 	SetSafeDirectory             bool
+	Quiet                        bool
+	GitConfigCountMax            int
+	WorktreePath                 string
 	GithubServerURL              string
 	BitbucketServerURL           string
 	GitlabServerURL              string
+	OriginalURLOutput            bool
+	SkipNormalisedURLOutput      bool
+	IgnorePathCase               bool
+	CheckoutPathListOutput       bool
+	CheckoutPathListLimit        int
+	WriteManifest                bool
+	SkipDiskSpaceCheck           bool
+	WriteCommitMetadata          bool
+	DryRun                       bool
+	ArchiveOutput                string
+	RunFSCK                      bool
+	AuditLog                     string
+	WriteDescribe                bool
+	PostCheckoutScript           string
+	PostCheckoutScriptShell      string
+	AllowedRepositories          []string
+	AllowedRepositoriesFile      string
+	OptimizeAfterCheckout        bool
+	AggressiveRepack             bool
+	NoCheckout                   bool
+	MergeBaseRef                 string
+	ExtraRefs                    []string
+	IndexLockTimeout             time.Duration
+	RequiredTokenScopes          []string
+	DisableTokenFallback         bool
+	SkipTiming                   bool
 	Commit                       string
 	githubWorkflowOrganizationId string
 }
@@ -50,17 +105,37 @@ const (
 	GitLabProvider    = "gitlab"
 	BitbucketProvider = "bitbucket"
 	CustomProvider    = "custom"
+	GiteaProvider     = "gitea" // only detected from repository URLs, Gitea and Forgejo use the custom provider
 )
 
-var shaRegex = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+// shaRegex matches a full SHA-1 or SHA-256 object name
+var shaRegex = regexp.MustCompile(`^[0-9a-fA-F]{40}$|^[0-9a-fA-F]{64}$`)
 
-func (cfg *Config) validate() error {
-	// Load event context
-	eventContext, err := findEventContext()
-	if err != nil {
-		return fmt.Errorf("loading event context: %w", err)
+// cloneFilterRegex matches the partial clone filter specs accepted by the clone-filter input
+var cloneFilterRegex = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmgKMG]?|tree:[0-9]+|sparse:oid=\S+)$`)
+
+func validateCloneFilter(filter string) error {
+	if !cloneFilterRegex.MatchString(filter) {
+		return fmt.Errorf("unsupported clone-filter: '%s', expected blob:none, blob:limit=<size>, tree:<depth> or sparse:oid=<oid>", filter)
+	}
+	return nil
+}
+
+// shallowSinceLayouts are the ISO 8601 layouts accepted by the shallow-since input
+var shallowSinceLayouts = []string{"2006-01-02", "2006-01-02T15:04:05", time.RFC3339}
+
+func validateShallowSince(date string) error {
+	for _, layout := range shallowSinceLayouts {
+		if _, err := time.Parse(layout, date); err == nil {
+			return nil
+		}
 	}
+	return fmt.Errorf("invalid shallow-since: '%s', expected an ISO 8601 date such as 2024-01-31 or 2024-01-31T12:00:00Z", date)
+}
 
+// Validate checks the configuration against the event context, filling in defaults such as the provider, ref and
+// server URLs. It does not modify the filesystem or access the network.
+func (cfg *Config) Validate(eventContext map[string]interface{}) error {
 	// CloudBees Workspace
 	workspacePath, found := os.LookupEnv("CLOUDBEES_WORKSPACE")
 	if !found {
@@ -82,7 +157,7 @@ func (cfg *Config) validate() error {
 		return fmt.Errorf("input required and not supplied: provider")
 	}
 	core.Debug("provider = %s", cfg.Provider)
-	core.Debug("repository = %s", cfg.Repository)
+	core.Debug("repository = %s", git.StripCredentialsFromURL(cfg.Repository))
 
 	// Repository
 	if cfg.Provider != CustomProvider {
@@ -90,6 +165,8 @@ func (cfg *Config) validate() error {
 		if len(splitRepository) != 2 || splitRepository[0] == "" || splitRepository[1] == "" {
 			return fmt.Errorf("invalid repository '%s', expected format {owner}/{repo}", cfg.Repository)
 		}
+	} else if isGitProtocolURL(cfg.Repository) && (cfg.SSHKey != "" || len(cfg.SSHKeys) > 0) {
+		return fmt.Errorf("ssh-key cannot be used with the unauthenticated git:// repository '%s'", cfg.Repository)
 	}
 
 	// Repository Path
@@ -103,6 +180,22 @@ func (cfg *Config) validate() error {
 		return fmt.Errorf("repository path '%s' is not under '%s'", filepath.Join(workspacePath, cfg.Path), workspacePath)
 	}
 
+	// Worktree Path
+	if cfg.WorktreePath != "" {
+		if cfg.Path != "." {
+			return fmt.Errorf("path cannot be used with worktree, the repository is checked out at the worktree path")
+		}
+		worktreePath := filepath.Join(cleanWorkspacePath, cfg.WorktreePath)
+		if !strings.HasPrefix(worktreePath, cleanWorkspacePath+string(os.PathSeparator)) {
+			return fmt.Errorf("worktree path '%s' is not a directory under '%s'", filepath.Join(workspacePath, cfg.WorktreePath), workspacePath)
+		}
+		mainClonePath := filepath.Join(cleanWorkspacePath, mainCloneDir)
+		if worktreePath == mainClonePath || strings.HasPrefix(worktreePath, mainClonePath+string(os.PathSeparator)) {
+			return fmt.Errorf("worktree path '%s' cannot be inside the main clone '%s'", worktreePath, mainClonePath)
+		}
+		core.Debug("worktree path = %s", worktreePath)
+	}
+
 	// workflow repository ?
 	isWorkflowRepository := cfg.isWorkflowRepository(eventContext)
 	core.Debug("isWorkflowRepository = %v", isWorkflowRepository)
@@ -133,12 +226,28 @@ func (cfg *Config) validate() error {
 
 	// Clean
 	core.Debug("clean = %v", cfg.Clean)
+	core.Debug("stash before clean = %v", cfg.StashBeforeClean)
 
 	// Sparse checkout
 	core.Debug("sparse checkout = %s", cfg.SparseCheckout)
+	core.Debug("sparse checkout cone depth = %d", cfg.SparseCheckoutConeDepth)
+
+	// Clone filter
+	if cfg.CloneFilter != "" {
+		if err := validateCloneFilter(cfg.CloneFilter); err != nil {
+			return err
+		}
+	}
+	core.Debug("clone filter = %s", cfg.CloneFilter)
 
 	// Fetch depth
 	core.Debug("fetch depth = %d", cfg.FetchDepth)
+	if cfg.ShallowSince != "" {
+		if err := validateShallowSince(cfg.ShallowSince); err != nil {
+			return err
+		}
+	}
+	core.Debug("shallow since = %s", cfg.ShallowSince)
 
 	// LFS
 	core.Debug("lfs = %v", cfg.Lfs)
@@ -157,18 +266,62 @@ func (cfg *Config) validate() error {
 	default:
 		return fmt.Errorf("unsupported submodules: '%s', expected true/false/recursive", cfg.Submodules)
 	}
+	core.Debug("submodule jobs = %d", cfg.SubmoduleJobs)
+	for _, pattern := range cfg.SubmodulePathPatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid submodule-paths pattern: '%s': %w", pattern, err)
+		}
+	}
 
 	// Auth token
-	if cfg.Token == "" && cfg.CloudBeesApiToken == "" && cfg.CloudBeesApiURL == "" && cfg.SSHKey == "" {
+	if cfg.Token == "" && cfg.CloudBeesApiToken == "" && cfg.CloudBeesApiURL == "" && cfg.SSHKey == "" && len(cfg.SSHKeys) == 0 && cfg.GitHubAppPrivateKey == "" {
 		return fmt.Errorf("input required and not supplied: token")
 	}
 
+	if cfg.HTTPProxy == "" && (cfg.HTTPProxyUser != "" || cfg.HTTPProxyPassword != "") {
+		return fmt.Errorf("http-proxy is required with http-proxy-user and http-proxy-password")
+	}
+
+	if cfg.HTTPVersion != "" && !git.ValidHTTPVersion(cfg.HTTPVersion) {
+		return fmt.Errorf("invalid http-version '%s', expected HTTP/1.1 or HTTP/2", cfg.HTTPVersion)
+	}
+
+	if cfg.StashBeforeClean && !cfg.Clean {
+		return fmt.Errorf("clean is required with stash-before-clean")
+	}
+
+	if cfg.NoCheckout && (cfg.WorktreePath != "" || cfg.SparseCheckout != "") {
+		return fmt.Errorf("no-checkout cannot be used with worktree or sparse-checkout")
+	}
+
+	if cfg.AggressiveRepack && !cfg.OptimizeAfterCheckout {
+		return fmt.Errorf("optimize is required with aggressive-repack")
+	}
+
+	if cfg.LfsPointerOnly && !cfg.Lfs {
+		return fmt.Errorf("lfs is required with lfs-pointer-only")
+	}
+
+	if cfg.SSHProxyJumpKey != "" && cfg.SSHProxyJump == "" {
+		return fmt.Errorf("ssh-proxy-jump is required with ssh-proxy-jump-key")
+	}
+
+	if cfg.SSHProxyKnownHosts != "" && cfg.SSHProxyJump == "" {
+		return fmt.Errorf("ssh-proxy-jump is required with ssh-proxy-known-hosts")
+	}
+
+	if cfg.GitHubAppPrivateKey != "" {
+		if cfg.Provider != GitHubProvider {
+			return fmt.Errorf("github-app-private-key is only supported for the %s provider", GitHubProvider)
+		}
+		if cfg.GitHubAppID == 0 || cfg.GitHubAppInstallationID == 0 {
+			return fmt.Errorf("github-app-id and github-app-installation-id are required with github-app-private-key")
+		}
+	}
+
 	// Workflow organization ID
 	if cfg.Provider == GitHubProvider {
-		raw, _ := getMapFromMap(eventContext, "raw")
-		repo, _ := getMapFromMap(raw, "repository")
-		owner, _ := getMapFromMap(repo, "owner")
-		cfg.githubWorkflowOrganizationId, _ = getStringFromMap(owner, "id")
+		cfg.githubWorkflowOrganizationId, _ = getNestedString(eventContext, "raw.repository.owner.id")
 	}
 
 	// Determine the provider URL that the repository is being hosted from
@@ -199,42 +352,115 @@ func (cfg *Config) validate() error {
 		core.Debug("Bitbucket Host URL = %s", cfg.GitlabServerURL)
 	}
 
+	// Allowed repositories
+	allowedRepositories := cfg.AllowedRepositories
+	if cfg.AllowedRepositoriesFile != "" {
+		allowedPath := cfg.AllowedRepositoriesFile
+		if !filepath.IsAbs(allowedPath) {
+			allowedPath = filepath.Join(workspacePath, allowedPath)
+		}
+		patterns, err := readPatternFile(allowedPath)
+		if err != nil {
+			return fmt.Errorf("could not read allowed-repositories-file: %w", err)
+		}
+		allowedRepositories = append(append([]string{}, cfg.AllowedRepositories...), patterns...)
+	}
+	if len(allowedRepositories) > 0 {
+		cloneURL, err := cfg.fetchURL(cfg.SSHKey != "" || len(cfg.SSHKeys) > 0)
+		if err != nil {
+			return err
+		}
+		if err := checkAllowedRepository(cloneURL, allowedRepositories); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func findEventContext() (map[string]interface{}, error) {
 	if eventPath, found := os.LookupEnv("CLOUDBEES_EVENT_PATH"); found {
-		return loadEventContext(eventPath)
+		eventContext, err := loadEventContext(eventPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateEventContext(eventContext); err != nil {
+			return nil, fmt.Errorf("invalid event file '%s': %w", eventPath, err)
+		}
+		return eventContext, nil
 	}
 	return make(map[string]interface{}), nil
 }
 
-func (cfg *Config) Run(ctx context.Context) (retErr error) {
+func (cfg *Config) Run(ctx context.Context) error {
+	_, err := cfg.RunWithResult(ctx)
+	return err
+}
+
+// RunWithResult checks out the repository and returns a summary of what was checked out. The result is
+// returned even on error, populated with whatever was known at the point of failure.
+func (cfg *Config) RunWithResult(ctx context.Context) (*RunResult, error) {
+	start := time.Now()
+	result := &RunResult{}
+	err := cfg.run(ctx, result)
+	result.DurationMs = time.Since(start).Milliseconds()
+	if !cfg.SkipTiming {
+		if outErr := writeDurationOutput(result); outErr != nil && err == nil {
+			err = outErr
+		}
+	}
+	// written even on error, as a failed integrity check fails the checkout
+	if outErr := writeFsckStatusOutput(result); outErr != nil && err == nil {
+		err = outErr
+	}
+	return result, err
+}
+
+func (cfg *Config) run(ctx context.Context, result *RunResult) (retErr error) {
+	// Load event context
+	eventContext, err := findEventContext()
+	if err != nil {
+		return wrapError(ErrCategoryConfig, "loading event context", err)
+	}
+
 	// validate the configuration
-	if err := cfg.validate(); err != nil {
-		return err
+	if err := cfg.Validate(eventContext); err != nil {
+		return wrapError(ErrCategoryConfig, "validating inputs", err)
 	}
+	result.Ref = cfg.Ref
 
 	// now start getting the source code
 
-	useSSH := cfg.SSHKey != ""
+	useSSH := cfg.SSHKey != "" || len(cfg.SSHKeys) > 0
 
 	cli, err := git.NewGitCLI(ctx)
 	if err != nil {
-		return err
+		return wrapError(ErrCategoryGit, "locating git", err)
+	}
+	// git output would corrupt structured output so treat it the same as quiet
+	cli.SetQuiet(cfg.Quiet || core.Recording())
+	cli.SetDryRun(cfg.DryRun)
+	if cfg.GitConfigCountMax > 0 {
+		cli.SetMaxConfigEntries(cfg.GitConfigCountMax)
+	}
+	if cfg.AuditLog != "" {
+		if err := cli.SetAuditLog(cfg.AuditLog); err != nil {
+			return wrapError(ErrCategoryFS, "opening the audit log", err)
+		}
 	}
 
 	repositoryURL, err := cfg.fetchURL(useSSH)
 	if err != nil {
-		return err
+		return wrapError(ErrCategoryConfig, "determining the repository URL", err)
 	}
-	fmt.Printf("Syncing Repository: %s\n", repositoryURL)
+	result.RepositoryURL = repositoryURL
+	core.Info("Syncing Repository: %s", git.StripCredentialsFromURL(repositoryURL))
 
 	// Remove conflicting file path
 
 	homePath, haveHome := os.LookupEnv("HOME")
 	if !haveHome {
-		return fmt.Errorf("missing HOME environment variable")
+		return wrapError(ErrCategoryConfig, "locating the home directory", fmt.Errorf("missing HOME environment variable"))
 	}
 
 	workspacePath, haveWork := os.LookupEnv("CLOUDBEES_WORKSPACE")
@@ -243,7 +469,7 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 	}
 
 	if err := os.MkdirAll(workspacePath, os.ModePerm); err != nil {
-		return err
+		return wrapError(ErrCategoryFS, "creating the workspace", err)
 	}
 
 	// best effort canonicalize the workspace Path
@@ -256,6 +482,9 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 	}
 
 	repositoryPath := path2.Join(workspacePath, cfg.Path)
+	if cfg.WorktreePath != "" {
+		repositoryPath = path2.Join(workspacePath, cfg.WorktreePath)
+	}
 
 	// best effort canonicalize the Repository Path
 	if r, err := filepath.EvalSymlinks(repositoryPath); err == nil {
@@ -266,25 +495,38 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 	}
 
 	if !strings.HasPrefix(repositoryPath+string(os.PathSeparator), workspacePath+string(os.PathSeparator)) {
-		return fmt.Errorf("Repository Path '%s' is not under '%s'", repositoryPath, workspacePath)
+		return wrapError(ErrCategoryConfig, "resolving the Repository Path", fmt.Errorf("Repository Path '%s' is not under '%s'", repositoryPath, workspacePath))
+	}
+
+	// Sparse checkout patterns, read from a file in the workspace when prefixed with @
+	sparsePatterns := strings.Split(cfg.SparseCheckout, "\n")
+	if strings.HasPrefix(cfg.SparseCheckout, "@") {
+		if sparsePatterns, err = loadSparsePatterns(filepath.Join(workspacePath, strings.TrimPrefix(cfg.SparseCheckout, "@"))); err != nil {
+			return wrapError(ErrCategoryConfig, "reading the sparse checkout patterns", err)
+		}
 	}
 
 	// if repositoryPath exists but is a file, remove the file
-	if stat, err := os.Stat(repositoryPath); err == nil && !stat.IsDir() {
+	if cfg.DryRun {
+		core.Info("[DRY RUN] Skipping preparation of the Repository Path")
+	} else if stat, err := os.Stat(repositoryPath); err == nil && !stat.IsDir() {
 		if err := os.Remove(repositoryPath); err != nil {
-			return fmt.Errorf("could not remove conflicting file at Repository Path '%s': %v", repositoryPath, err)
+			return wrapError(ErrCategoryFS, "preparing the Repository Path", fmt.Errorf("could not remove conflicting file at Repository Path '%s': %v", repositoryPath, err))
 		}
 	}
 
 	// Create directory
-	if _, err := os.Stat(repositoryPath); err != nil {
+	if _, err := os.Stat(repositoryPath); err != nil && !cfg.DryRun {
 		if err := os.MkdirAll(repositoryPath, os.ModePerm); err != nil {
-			return fmt.Errorf("could not create directory '%s': %v", repositoryPath, err)
+			return wrapError(ErrCategoryFS, "preparing the Repository Path", fmt.Errorf("could not create directory '%s': %v", repositoryPath, err))
 		}
 	}
 
 	// Set up Git CLI
 	uniqueID := uuid.New().String()
+	stashRef := ""
+	var mainClonePath string
+	var worktreeReused, worktreeAdded bool
 
 	temp, haveTemp := os.LookupEnv("RUNNER_TEMP")
 	if !haveTemp {
@@ -293,173 +535,378 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 	cli.SetEnv("RUNNER_TEMP", temp)
 
 	if cfg.SetSafeDirectory {
-		fmt.Println("Adding Repository directory to the temporary git global config as a safe directory")
+		core.Info("Adding Repository directory to the temporary git global config as a safe directory")
 		if err := cli.AddConfigStr(true, "safe.directory", workspacePath); err != nil {
-			return err
+			return wrapError(ErrCategoryGit, "adding safe directory", err)
 		}
 	}
 
 	core.Debug("Repository Path = %s", repositoryPath)
 	cli.SetCwd(repositoryPath)
 
-	// Prepare existing directory, otherwise recreate
-	if err := prepareExistingDirectory(cli, repositoryPath, repositoryURL, cfg.Clean, cfg.Ref); err != nil {
-		return err
-	}
-
-	// Initialize the Repository
-	if _, err := os.Stat(filepath.Join(repositoryPath, ".git")); err != nil {
-		core.StartGroup("Initializing the Repository")
-		if err := cli.Init(repositoryPath); err != nil {
-			return err
+	if cfg.DryRun {
+		// nothing is executed, so there is nothing on disk to prepare
+		core.Info("[DRY RUN] Skipping preparation of the existing Repository")
+		if cfg.WorktreePath == "" {
+			if err := cli.Init(repositoryPath); err != nil {
+				return wrapError(ErrCategoryGit, "initializing the repository", err)
+			}
+			if err := cli.RemoteAdd("origin", repositoryURL); err != nil {
+				return wrapError(ErrCategoryGit, "initializing the repository", err)
+			}
 		}
-		if err := cli.RemoteAdd("origin", repositoryURL); err != nil {
-			return err
+	} else if cfg.WorktreePath != "" {
+		// Fetch into the shared main clone, the worktree path becomes a worktree of the main clone
+		mainClonePath = filepath.Join(workspacePath, mainCloneDir)
+		if worktreeReused, err = prepareWorktreeDirectory(cli, mainClonePath, repositoryPath, repositoryURL, cfg.Clean); err != nil {
+			return wrapError(ErrCategoryGit, "preparing the worktree", err)
+		}
+		defer func() {
+			// a worktree that could not be checked out would otherwise be reused by the next run
+			if retErr != nil && worktreeAdded {
+				cli.SetCwd(mainClonePath)
+				if err := cli.WorktreeRemove(repositoryPath); err != nil {
+					retErr = errors.Join(retErr, err)
+				}
+			}
+			// without persisted credentials nothing is left for the worktrees of earlier jobs, so the registrations
+			// of those whose directories have been removed are dropped from the main clone
+			if !cfg.PersistCredentials {
+				cli.SetCwd(mainClonePath)
+				if err := cli.WorktreePrune(); err != nil && retErr == nil {
+					retErr = wrapError(ErrCategoryGit, "pruning the worktrees", err)
+				}
+			}
+		}()
+	} else {
+		// Prepare existing directory, otherwise recreate
+		if stashRef, err = prepareExistingDirectory(cli, repositoryPath, repositoryURL, cfg.Clean, cfg.StashBeforeClean, cfg.Ref, cfg.IndexLockTimeout); err != nil {
+			return wrapError(ErrCategoryGit, "preparing the existing repository", err)
+		}
+
+		// Initialize the Repository
+		if _, err := os.Stat(filepath.Join(repositoryPath, ".git")); err != nil {
+			core.StartGroup("Initializing the Repository")
+			if err := cli.Init(repositoryPath); err != nil {
+				return wrapError(ErrCategoryGit, "initializing the repository", err)
+			}
+			if err := cli.RemoteAdd("origin", repositoryURL); err != nil {
+				return wrapError(ErrCategoryGit, "initializing the repository", err)
+			}
+			core.EndGroup("Repository initialized")
 		}
-		core.EndGroup("Repository initialized")
 	}
 
 	// Disable automatic garbage collection
 	core.StartGroup("Disabling automatic garbage collection")
 	if err := cli.SetConfigInt(false, "gc.auto", 0); err != nil {
-		fmt.Println("Unable to turn off git automatic garbage collection. The git fetch operation may trigger garbage collection and cause a delay.")
+		core.Info("Unable to turn off git automatic garbage collection. The git fetch operation may trigger garbage collection and cause a delay.")
 	}
 	core.EndGroup("Automatic garbage collection disabled")
 
+	if cfg.HTTPVersion != "" {
+		core.Info("Setting the HTTP version to %s", cfg.HTTPVersion)
+		if err := cli.SetHTTPVersion(cfg.HTTPVersion); err != nil {
+			return wrapError(ErrCategoryGit, "setting HTTP version", err)
+		}
+	}
+
 	// Setup auth
 	core.StartGroup("Setting up auth")
-	var sshKeyPath string
+	var sshKeys []auth.SSHKeyEntry
 	var sshKnownHostsPath string
+	var sshConfigPath string
+	var sshProxyJumpKeyPath string
 	var sshCommand string
-	if useSSH {
-		if sshKeyPath, err = auth.GenerateSSHKey(ctx, temp, uniqueID, cfg.SSHKey); err != nil {
-			return err
+	if cfg.DryRun {
+		core.Info("[DRY RUN] Skipping SSH key and credential helper setup")
+	} else if useSSH {
+		if len(cfg.SSHKeys) > 0 {
+			sshKeys, err = auth.GenerateSSHKeys(ctx, temp, uniqueID, cfg.SSHKeys)
+		} else {
+			var sshKeyPath string
+			sshKeyPath, err = auth.GenerateSSHKey(ctx, temp, uniqueID, cfg.SSHKey)
+			sshKeys = []auth.SSHKeyEntry{{Key: sshKeyPath}}
+		}
+		if err != nil {
+			return wrapError(ErrCategoryAuth, "setting up ssh keys", err)
 		}
 
-		if sshKnownHostsPath, err = auth.GenerateSSHKnownHosts(homePath, temp, uniqueID, cfg.SSHKnownHosts); err != nil {
-			return err
+		// registered before the remaining files are written so that a failure part way through removes them
+		defer func() {
+			// the files are only persisted along with a complete ssh command
+			if !cfg.PersistCredentials || sshCommand == "" {
+				for _, key := range sshKeys {
+					if err := os.Remove(key.Key); err != nil && retErr == nil {
+						retErr = wrapError(ErrCategoryFS, "removing the ssh key", err)
+					}
+				}
+				if sshKnownHostsPath != "" {
+					if err := os.Remove(sshKnownHostsPath); err != nil && retErr == nil {
+						retErr = wrapError(ErrCategoryFS, "removing the ssh known hosts", err)
+					}
+				}
+				if sshConfigPath != "" {
+					if err := os.Remove(sshConfigPath); err != nil && !os.IsNotExist(err) && retErr == nil {
+						retErr = wrapError(ErrCategoryFS, "removing the ssh config", err)
+					}
+				}
+				if sshProxyJumpKeyPath != "" {
+					if err := os.Remove(sshProxyJumpKeyPath); err != nil && retErr == nil {
+						retErr = wrapError(ErrCategoryFS, "removing the ssh proxy jump key", err)
+					}
+				}
+			} else {
+				if err := cli.SetConfigStr(false, "core.sshCommand", sshCommand); err != nil && retErr == nil {
+					retErr = wrapError(ErrCategoryAuth, "persisting the ssh command", err)
+				}
+			}
+		}()
+
+		if sshKnownHostsPath, err = auth.GenerateSSHKnownHosts(homePath, temp, uniqueID, cfg.SSHKnownHosts, cfg.SSHProxyKnownHosts); err != nil {
+			return wrapError(ErrCategoryAuth, "setting up ssh known hosts", err)
 		}
 
-		if sshCommand, err = auth.GenerateSSHCommand(sshKeyPath, cfg.SSHStrict, sshKnownHostsPath); err != nil {
-			return err
+		if cfg.SSHProxyJumpKey != "" {
+			if sshProxyJumpKeyPath, err = auth.GenerateSSHKey(ctx, temp, uniqueID+"_proxy", cfg.SSHProxyJumpKey); err != nil {
+				return wrapError(ErrCategoryAuth, "setting up ssh proxy jump key", err)
+			}
+		}
+
+		sshConfigPath = filepath.Join(temp, uniqueID+"_ssh_config")
+		if sshCommand, err = auth.GenerateSSHCommand(sshKeys, cfg.SSHStrict, sshKnownHostsPath, sshConfigPath, cfg.SSHProxyJump, sshProxyJumpKeyPath); err != nil {
+			return wrapError(ErrCategoryAuth, "setting up ssh command", err)
 		}
 
 		cli.SetEnv("GIT_SSH_COMMAND", sshCommand)
+	}
+
+	var helperCommand string
+	if !cfg.DryRun {
+		var cleaner func() error
+		cleaner, helperCommand, err = auth.ConfigureToken(
+			cli, "", false, cfg.serverURL(), auth.TokenAuth{
+				Provider: cfg.Provider,
+				ScmToken: cfg.Token,
+				ApiToken: cfg.CloudBeesApiToken,
+				ApiURL:   cfg.CloudBeesApiURL,
 
+				GitHubAppPrivateKey:     cfg.GitHubAppPrivateKey,
+				GitHubAppID:             cfg.GitHubAppID,
+				GitHubAppInstallationID: cfg.GitHubAppInstallationID,
+
+				RequiredScopes:  cfg.RequiredTokenScopes,
+				DisableFallback: cfg.DisableTokenFallback,
+			})
+		if err != nil {
+			return wrapError(ErrCategoryAuth, "configuring the credential helper", err)
+		}
 		defer func() {
 			if !cfg.PersistCredentials {
-				if err := os.Remove(sshKeyPath); err != nil && retErr == nil {
-					retErr = err
-				}
-				if err := os.Remove(sshKnownHostsPath); err != nil && retErr == nil {
-					retErr = err
-				}
-			} else {
-				if err := cli.SetConfigStr(false, "core.sshCommand", sshCommand); err != nil && retErr == nil {
-					retErr = err
+				if err := cleaner(); err != nil {
+					err = wrapError(ErrCategoryAuth, "removing the credential helper", err)
+					if retErr == nil {
+						retErr = err
+					} else {
+						retErr = errors.Join(retErr, err)
+					}
 				}
 			}
 		}()
 	}
 
-	cleaner, helperCommand, err := auth.ConfigureToken(
-		cli, "", false, cfg.serverURL(), auth.TokenAuth{
-			Provider: cfg.Provider,
-			ScmToken: cfg.Token,
-			ApiToken: cfg.CloudBeesApiToken,
-			ApiURL:   cfg.CloudBeesApiURL,
-		})
-	if err != nil {
-		return err
+	if cfg.HTTPProxy != "" {
+		if err := cfg.configureHTTPProxy(cli); err != nil {
+			return wrapError(ErrCategoryAuth, "configuring the HTTP proxy", err)
+		}
 	}
-	defer func() {
-		if !cfg.PersistCredentials {
-			if err := cleaner(); err != nil {
-				if retErr == nil {
-					retErr = err
-				} else {
-					retErr = errors.Join(retErr, err)
+
+	if (cfg.SSLCABundle != "" || cfg.SSLCAPath != "") && cfg.DryRun {
+		core.Info("[DRY RUN] Skipping custom CA certificate setup")
+	} else if cfg.SSLCABundle != "" || cfg.SSLCAPath != "" {
+		caCleaner, err := cfg.configureSSLCA(cli, temp, uniqueID)
+		if err != nil {
+			return wrapError(ErrCategoryFS, "configuring the custom CA certificates", err)
+		}
+		defer func() {
+			if !cfg.PersistCredentials {
+				if err := caCleaner(); err != nil {
+					err = wrapError(ErrCategoryFS, "removing the custom CA certificates", err)
+					if retErr == nil {
+						retErr = err
+					} else {
+						retErr = errors.Join(retErr, err)
+					}
 				}
 			}
-		}
-	}()
+		}()
+	}
 
 	core.EndGroup("Auth setup")
 
 	// Determine the default branch
-	if cfg.Ref == "" && cfg.Commit == "" {
+	if cfg.Ref == "" && cfg.Commit == "" && cfg.DryRun {
+		core.Info("[DRY RUN] Skipping determining the default branch, assuming HEAD")
+		cfg.Ref = "HEAD"
+	} else if cfg.Ref == "" && cfg.Commit == "" {
 		core.StartGroup("Determining the default branch")
 		cfg.Ref, err = cli.BranchGetDefault(repositoryURL)
 		if err != nil {
-			return err
+			return wrapError(ErrCategoryNetwork, "determining the default branch", err)
 		}
 		core.EndGroup("Default branch determined")
 	}
+	result.Ref = cfg.Ref
 
 	// LFS install
 	if cfg.Lfs {
-		if err := cli.LfsInstall(); err != nil {
-			return err
+		if err := cli.LfsInstall(cfg.LfsPointerOnly); err != nil {
+			return wrapError(ErrCategoryGit, "installing git lfs", err)
 		}
 	}
 
 	mergeLoc, err := cfg.doLocalMerge(cli, repositoryURL, helperCommand)
 	if err != nil {
-		return err
+		var mergeErr *MergeError
+		if errors.As(err, &mergeErr) && mergeErr.Kind == "conflict" {
+			if outErr := writeMergeConflictsOutput(mergeErr.ConflictingFiles); outErr != nil {
+				core.Info("Warning: could not write the merge-conflicts output: %v", outErr)
+			}
+		}
+		return wrapError(ErrCategoryGit, "merging locally", err)
+	}
+
+	// shallow and filtered fetches transfer an unknown fraction of the history, so only full fetches are checked
+	fullFetch := cfg.FetchDepth <= 0 && cfg.ShallowSince == "" && cfg.CloneFilter == "" && cfg.SparseCheckout == ""
+	if !cfg.SkipDiskSpaceCheck && !cfg.DryRun && fullFetch {
+		if err := checkDiskSpace(cli, repositoryPath); err != nil {
+			return wrapError(ErrCategoryFS, "checking disk space", err)
+		}
 	}
 
 	// Fetch the Repository
 	core.StartGroup("Fetching the Repository")
+	stopFetchTimer := result.phases.start("fetch")
 	var fetchOptions git.FetchOptions
-	if cfg.SparseCheckout != "" {
+	if cfg.CloneFilter != "" {
+		fetchOptions.Filter = cfg.CloneFilter
+		// preserve the filter for any later fetches from origin, which git lazily fetches missing objects from
+		// once it is marked as a promisor remote
+		if err := cli.SetConfigBool(false, "remote.origin.promisor", true); err != nil {
+			return wrapError(ErrCategoryGit, "setting the partial clone filter", err)
+		}
+		if err := cli.SetConfigStr(false, "remote.origin.partialclonefilter", cfg.CloneFilter); err != nil {
+			return wrapError(ErrCategoryGit, "setting the partial clone filter", err)
+		}
+	} else if cfg.SparseCheckout != "" {
 		fetchOptions.Filter = "blob:none"
 	}
 	if mergeLoc != "" {
 		fetchOptions.LocalRepository = mergeLoc
 	}
 
-	if cfg.FetchDepth <= 0 {
+	skipFetch, deepen := false, 0
+	if cfg.Commit != "" && mergeLoc == "" && cfg.ShallowSince == "" && !cfg.DryRun {
+		if skipFetch, deepen, err = resumeFetch(cli, getRefSpec(cfg.Ref, cfg.Commit, cfg.Provider), cfg.Commit, cfg.FetchDepth); err != nil {
+			return wrapError(ErrCategoryGit, "checking for a previous fetch", err)
+		}
+	}
+
+	if skipFetch {
+		core.Info("Commit %s has already been fetched", cfg.Commit)
+	} else if deepen > 0 {
+		core.Info("Commit %s has already been fetched, deepening its history by %d commits", cfg.Commit, deepen)
+		fetchOptions.Deepen = deepen
+		if err := cli.Fetch(getRefSpec(cfg.Ref, cfg.Commit, cfg.Provider), fetchOptions); err != nil {
+			return wrapError(ErrCategoryNetwork, "fetching the repository", err)
+		}
+	} else if cfg.ShallowSince != "" {
+		fetchOptions.ShallowSince = cfg.ShallowSince
+		if err := cli.Fetch(getRefSpec(cfg.Ref, cfg.Commit, cfg.Provider), fetchOptions); err != nil {
+			return wrapError(ErrCategoryNetwork, "fetching the repository", err)
+		}
+	} else if cfg.FetchDepth <= 0 {
 		if err := cli.Fetch(getRefSpecForAllHistory(cfg.Ref, cfg.Commit), fetchOptions); err != nil {
-			return err
+			return wrapError(ErrCategoryNetwork, "fetching the repository", err)
 		}
 
 		// When all history is fetched, the Ref we're interested in may have moved to a different
 		// commit (push or force push). If so, fetch again with a targeted refspec.
 		if refPresent, err := testRef(cli, cfg.Ref, cfg.Commit); err != nil {
-			return err
+			return wrapError(ErrCategoryGit, "testing the ref", err)
 		} else if !refPresent {
 			if err := cli.Fetch(getRefSpec(cfg.Ref, cfg.Commit, cfg.Provider), fetchOptions); err != nil {
-				return err
+				return wrapError(ErrCategoryNetwork, "fetching the repository", err)
 			}
 		}
 	} else {
 		fetchOptions.FetchDepth = cfg.FetchDepth
 		if err := cli.Fetch(getRefSpec(cfg.Ref, cfg.Commit, cfg.Provider), fetchOptions); err != nil {
-			return err
+			return wrapError(ErrCategoryNetwork, "fetching the repository", err)
 		}
 	}
+
+	if len(cfg.ExtraRefs) > 0 {
+		extraOptions := git.FetchOptions{Filter: fetchOptions.Filter, ShallowSince: cfg.ShallowSince}
+		if cfg.FetchDepth > 0 && cfg.ShallowSince == "" {
+			extraOptions.FetchDepth = cfg.FetchDepth
+		}
+		var refSpecs [][]string
+		for _, ref := range cfg.ExtraRefs {
+			refSpecs = append(refSpecs, getRefSpec(ref, "", cfg.Provider))
+		}
+		core.Info("Fetching %d extra refs", len(cfg.ExtraRefs))
+		if err := cli.FetchMultiple(refSpecs, extraOptions); err != nil {
+			return wrapError(ErrCategoryNetwork, "fetching the extra refs", err)
+		}
+	}
+	stopFetchTimer()
 	core.EndGroup("Repository fetched")
 
 	// Checkout info
 	core.StartGroup("Determining the checkout info")
 	checkoutInfo, err := getCheckoutInfo(cli, cfg.Ref, cfg.Commit)
+	if err != nil && cfg.DryRun && cfg.Ref != "" {
+		// nothing was fetched, so unqualified refs cannot be resolved
+		core.Info("[DRY RUN] Assuming '%s' is a branch", cfg.Ref)
+		checkoutInfo, err = &CheckoutInfo{ref: cfg.Ref, startPoint: "refs/remotes/origin/" + cfg.Ref}, nil
+	}
 	if err != nil {
-		return err
+		return wrapError(ErrCategoryGit, "determining the checkout info", err)
 	}
+	result.resolvedRef = checkoutInfo.qualifiedRef()
 	core.EndGroup("Checkout info determined")
 
+	// Worktree
+	if cfg.WorktreePath != "" && worktreeReused {
+		cli.SetCwd(repositoryPath)
+	} else if cfg.WorktreePath != "" {
+		core.StartGroup("Adding the worktree")
+		r := checkoutInfo.startPoint
+		if r == "" {
+			r = checkoutInfo.ref
+		}
+		if err := cli.WorktreeAdd(repositoryPath, r); err != nil {
+			return wrapError(ErrCategoryGit, "adding the worktree", err)
+		}
+		worktreeAdded = true
+		cli.SetCwd(repositoryPath)
+		core.EndGroup("Worktree added")
+	}
+
 	// LFS fetch
 	// Explicit lfs-fetch to avoid slow checkout (fetches one lfs object at a time).
 	// Explicit lfs fetch will fetch lfs objects in parallel.
 	// For sparse checkouts, let `checkout` fetch the needed objects lazily.
-	if cfg.Lfs && cfg.SparseCheckout == "" {
+	// Pointer only checkouts, and fetch only runs, do not need the objects at all.
+	if cfg.Lfs && cfg.SparseCheckout == "" && !cfg.LfsPointerOnly && !cfg.NoCheckout {
 		core.StartGroup("Fetching LFS objects")
 		r := checkoutInfo.startPoint
 		if r == "" {
 			r = checkoutInfo.ref
 		}
 		if err := cli.LfsFetch(r); err != nil {
-			return err
+			return wrapError(ErrCategoryNetwork, "fetching LFS objects", err)
 		}
 		core.EndGroup("LFS objects fetched")
 	}
@@ -467,50 +914,139 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 	// Sparse checkout
 	if cfg.SparseCheckout != "" {
 		core.StartGroup("Setting up sparse checkout")
-		if cfg.SparseCheckoutConeMode {
-			if err := cli.SparseCheckout(strings.Split(cfg.SparseCheckout, "\n")); err != nil {
-				return err
-			} else if err := cli.SparseCheckoutNonConeMode(strings.Split(cfg.SparseCheckout, "\n")); err != nil {
-				return err
+		patterns := sparsePatterns
+		if cfg.SparseCheckoutConeMode && cfg.SparseCheckoutConeDepth > 0 {
+			r := checkoutInfo.startPoint
+			if r == "" {
+				r = checkoutInfo.ref
 			}
+			if patterns, err = expandConePatterns(cli, r, patterns, cfg.SparseCheckoutConeDepth); err != nil {
+				return wrapError(ErrCategoryGit, "setting up sparse checkout", err)
+			}
+			core.Debug("sparse checkout cone patterns = %s", strings.Join(patterns, ", "))
+		}
+		if err := setupSparseCheckout(cli, patterns, cfg.SparseCheckoutConeMode); err != nil {
+			return wrapError(ErrCategoryGit, "setting up sparse checkout", err)
 		}
 		core.EndGroup("Sparse checkout setup")
 	}
 
+	// Ignore path case
+	if cfg.IgnorePathCase {
+		if err := configureIgnorePathCase(cli, repositoryPath); err != nil {
+			return wrapError(ErrCategoryFS, "configuring ignore path case", err)
+		}
+	}
+
 	// Checkout
-	core.StartGroup("Checking out the Ref")
-	if err := cli.Checkout(checkoutInfo.ref, checkoutInfo.startPoint); err != nil {
-		return err
+	stopCheckoutTimer := result.phases.start("working-tree")
+	if cfg.NoCheckout {
+		// HEAD still points at the fetched commit so that the outputs describe it
+		core.StartGroup("Setting HEAD without checking out files")
+		cli.SetEnvBool("GIT_LFS_SKIP_SMUDGE", true)
+		if err := cli.SetHead(checkoutInfo.ref, checkoutInfo.startPoint); err != nil {
+			return wrapError(ErrCategoryGit, "setting HEAD", err)
+		}
+		core.EndGroup("HEAD set")
+	} else {
+		core.StartGroup("Checking out the Ref")
+		if err := cli.Checkout(checkoutInfo.ref, checkoutInfo.startPoint); err != nil {
+			return wrapError(ErrCategoryGit, "checking out the ref", err)
+		}
+		core.EndGroup("Ref checked out")
+	}
+	stopCheckoutTimer()
+
+	if stashRef != "" {
+		core.StartGroup("Restoring the stashed changes")
+		if err := cli.StashPop(stashRef); err != nil {
+			core.Info("Warning: unable to restore the changes stashed before clean, they are kept in stash entry %s: %v", stashRef, err)
+		} else {
+			core.EndGroup("Stashed changes restored")
+		}
+	}
+
+	if cfg.RunFSCK {
+		core.StartGroup("Verifying the repository integrity")
+		// git fsck has no --quiet option, --no-progress keeps the output to the problems found
+		if output, err := cli.Fsck("--no-dangling", "--no-reflogs", "--no-progress"); err != nil {
+			_, _ = fmt.Fprint(os.Stderr, output)
+			result.FsckStatus = "failed"
+			return wrapError(ErrCategoryGit, "verifying the repository integrity", err)
+		}
+		result.FsckStatus = "ok"
+		if cfg.DryRun {
+			result.FsckStatus = "dry-run"
+		}
+		core.EndGroup("Repository integrity verified")
+	}
+
+	if cfg.CheckoutPathListOutput {
+		if err := cfg.writeCheckedOutFiles(cli); err != nil {
+			return wrapError(ErrCategoryFS, "writing outputs", err)
+		}
+	}
+
+	if cfg.WriteManifest {
+		if err := cfg.writeManifest(cli); err != nil {
+			return wrapError(ErrCategoryFS, "writing outputs", err)
+		}
 	}
-	core.EndGroup("Ref checked out")
 
 	// Submodules
 	cfg.Submodules = strings.ToLower(strings.TrimSpace(cfg.Submodules))
-	if cfg.Submodules == "true" || cfg.Submodules == "recursive" {
+	if cfg.NoCheckout && (cfg.Submodules == "true" || cfg.Submodules == "recursive") {
+		// there is no working tree to update the submodules in, so they are only registered at the commits recorded
+		// in the index, nested submodules are only known once the submodule itself is fetched
+		stopSubmodulesTimer := result.phases.start("submodules")
+		core.StartGroup("Registering submodules without fetching them")
+		if err := cli.SubmoduleInit(); err != nil {
+			return wrapError(ErrCategoryGit, "registering submodules", err)
+		}
+		if err := cli.SubmoduleStatus(); err != nil {
+			return wrapError(ErrCategoryGit, "listing submodules", err)
+		}
+		core.EndGroup("Submodules registered")
+		stopSubmodulesTimer()
+	} else if cfg.Submodules == "true" || cfg.Submodules == "recursive" {
+		stopSubmodulesTimer := result.phases.start("submodules")
+
 		// Temporarily override global config
 		core.StartGroup("Setting up auth for fetching submodules")
 
-		cleaner, _, err := auth.ConfigureToken(cli, "", true, cfg.serverURL(), auth.TokenAuth{
-			Provider: cfg.Provider,
-			ScmToken: cfg.Token,
-			ApiToken: cfg.CloudBeesApiToken,
-			ApiURL:   cfg.CloudBeesApiURL,
-		})
-		if err != nil {
-			return err
+		cleaner := func() error { return nil }
+		if cfg.DryRun {
+			core.Info("[DRY RUN] Skipping credential helper setup for submodules")
+		} else {
+			cleaner, _, err = auth.ConfigureToken(cli, "", true, cfg.serverURL(), auth.TokenAuth{
+				Provider: cfg.Provider,
+				ScmToken: cfg.Token,
+				ApiToken: cfg.CloudBeesApiToken,
+				ApiURL:   cfg.CloudBeesApiURL,
+
+				GitHubAppPrivateKey:     cfg.GitHubAppPrivateKey,
+				GitHubAppID:             cfg.GitHubAppID,
+				GitHubAppInstallationID: cfg.GitHubAppInstallationID,
+
+				RequiredScopes:  cfg.RequiredTokenScopes,
+				DisableFallback: cfg.DisableTokenFallback,
+			})
+			if err != nil {
+				return wrapError(ErrCategoryAuth, "configuring the credential helper for submodules", err)
+			}
 		}
 
 		var insteadOfKey string
 		if cfg.Provider != CustomProvider {
 			u, err := url.Parse(cfg.serverURL())
 			if err != nil {
-				return err
+				return wrapError(ErrCategoryConfig, "parsing the server URL", err)
 			}
 
 			const insteadOfTemplate = "url.%s/.insteadOf"
 			insteadOfKey = fmt.Sprintf(insteadOfTemplate, u.Scheme+"://"+u.Host)
 			if _, err := cli.UnsetConfig(true, insteadOfKey); err != nil {
-				return err
+				return wrapError(ErrCategoryGit, "configuring HTTPS URLs for submodules", err)
 			}
 			var insteadOfValues []string
 
@@ -530,7 +1066,7 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 			if !useSSH {
 				for _, v := range insteadOfValues {
 					if err := cli.AddConfigStr(true, insteadOfKey, v); err != nil {
-						return err
+						return wrapError(ErrCategoryGit, "configuring HTTPS URLs for submodules", err)
 					}
 				}
 			}
@@ -540,74 +1076,305 @@ func (cfg *Config) Run(ctx context.Context) (retErr error) {
 		// Checkout submodules
 		core.StartGroup("Fetching submodules")
 		recursive := cfg.Submodules == "recursive"
-		if err := cli.SubmoduleSync(recursive); err != nil {
-			return err
+		var paths []string
+		if len(cfg.SubmodulePathPatterns) > 0 {
+			submodules, err := cli.SubmoduleList()
+			if err != nil {
+				return wrapError(ErrCategoryGit, "listing submodules", err)
+			}
+			paths = matchSubmodulePaths(submodules, cfg.SubmodulePathPatterns)
+			core.Info("Submodules matching %s: %s", strings.Join(cfg.SubmodulePathPatterns, ", "), strings.Join(paths, ", "))
 		}
-		if err := cli.SubmoduleUpdate(cfg.FetchDepth, recursive); err != nil {
-			return err
+		if len(cfg.SubmodulePathPatterns) > 0 && len(paths) == 0 {
+			core.Info("No submodules match the submodule-paths patterns, skipping")
+		} else {
+			if err := cli.SubmoduleSync(recursive, paths...); err != nil {
+				return wrapError(ErrCategoryGit, "syncing submodules", err)
+			}
+			// after the sync, as that resets the URLs of initialized submodules to the .gitmodules values
+			if err := remapSubmoduleURLs(cli, cfg.SubmoduleURLMap); err != nil {
+				return wrapError(ErrCategoryGit, "remapping submodule URLs", err)
+			}
+			if err := cli.SubmoduleUpdate(git.SubmoduleUpdateOptions{
+				FetchDepth: cfg.FetchDepth,
+				Recursive:  recursive,
+				Jobs:       cfg.SubmoduleJobs,
+				Paths:      paths,
+			}); err != nil {
+				return wrapError(ErrCategoryNetwork, "fetching submodules", err)
+			}
+			// older git versions can leave the git directory inside the submodule rather than in .git/modules
+			if err := cli.SubmoduleAbsorbGitDirs(); err != nil {
+				return wrapError(ErrCategoryGit, "absorbing the submodule git directories", err)
+			}
 		}
 		if _, err := cli.SubmoduleForeach(recursive, cli.Executable(), "config", "--local", "gc.auto", "0"); err != nil {
-			return err
+			return wrapError(ErrCategoryGit, "disabling automatic gc in submodules", err)
 		}
 		core.EndGroup("Submodules fetched")
 
-		if cfg.PersistCredentials {
+		if cfg.PersistCredentials && !cfg.DryRun {
 			core.StartGroup("Persisting credentials for submodules")
 			if insteadOfKey != "" {
 				if _, err := cli.UnsetConfig(true, insteadOfKey); err != nil {
-					return err
+					return wrapError(ErrCategoryGit, "removing the HTTPS URLs for submodules", err)
 				}
 			}
-			if err := auth.ConfigureSubmoduleTokenAuth(cli, recursive, cfg.serverURL(), cfg.Token); err != nil {
-				return err
+			if err := auth.ConfigureSubmoduleTokenAuth(cli, recursive, cfg.serverURL(), cfg.Token, sshCommand); err != nil {
+				return wrapError(ErrCategoryAuth, "persisting credentials for submodules", err)
 			}
 			core.EndGroup("Credentials for submodules persisted")
 		} else {
 			if err := cleaner(); err != nil {
-				return err
+				return wrapError(ErrCategoryAuth, "removing the credential helper for submodules", err)
 			}
 		}
+		stopSubmodulesTimer()
 	}
 
 	// Get commit information
 	var commitInfo string
 	commitInfo, err = cli.Log1()
 	if err != nil {
-		return err
+		return wrapError(ErrCategoryGit, "reading the commit", err)
 	}
 
 	// Log commit sha
 	_, err = cli.Log1("--format='%H'")
 	if err != nil {
-		return err
+		return wrapError(ErrCategoryGit, "reading the commit", err)
 	}
 
 	if err := cfg.checkCommitInfo(commitInfo); err != nil {
-		return err
+		return wrapError(ErrCategoryGit, "checking the commit", err)
+	}
+
+	if result.Commit, err = cli.RevParse("HEAD"); err != nil {
+		return wrapError(ErrCategoryGit, "resolving the commit", err)
+	}
+	if result.ShortCommit, err = cli.RevParseShort("HEAD", 7); err != nil {
+		return wrapError(ErrCategoryGit, "resolving the commit", err)
+	}
+
+	if cfg.WriteCommitMetadata && !cfg.DryRun {
+		if result.CommitInfo, err = cli.Log1Structured(); err != nil {
+			return wrapError(ErrCategoryGit, "reading the commit metadata", err)
+		}
+	}
+
+	if cfg.WriteDescribe {
+		if result.Describe, err = cli.DescribeVersion("HEAD"); err != nil {
+			return wrapError(ErrCategoryGit, "describing the commit", err)
+		}
+	}
+
+	if cfg.MergeBaseRef != "" {
+		if result.MergeBase, err = cli.MergeBase("HEAD", cfg.MergeBaseRef); err != nil {
+			return wrapError(ErrCategoryGit, "finding the merge base", err)
+		}
+	} else if baseSha, found := getStringFromMap(eventContext, "baseSha"); found && baseSha != "" && !cfg.DryRun {
+		// best effort, the base commit is only present when enough history was fetched
+		if exists, err := cli.ShaExists(baseSha); err == nil && exists {
+			if result.MergeBase, err = cli.MergeBase("HEAD", baseSha); err != nil {
+				core.Info("Unable to find the merge base with %s: %v", baseSha, err)
+			}
+		} else {
+			core.Debug("base commit %s has not been fetched, skipping the merge base", baseSha)
+		}
+	}
+
+	if len(cfg.ExtraRefs) > 0 && !cfg.DryRun {
+		if result.ExtraRefCommits, err = resolveExtraRefs(cli, cfg.ExtraRefs); err != nil {
+			return wrapError(ErrCategoryGit, "resolving the extra refs", err)
+		}
+	}
+
+	if cfg.ArchiveOutput != "" {
+		core.StartGroup("Archiving the checked out commit")
+		archivePath := cfg.ArchiveOutput
+		if !filepath.IsAbs(archivePath) {
+			archivePath = filepath.Join(workspacePath, archivePath)
+		}
+		if _, err := cli.Archive(result.Commit, archiveFormat(archivePath), archivePath, nil); err != nil {
+			return wrapError(ErrCategoryGit, "archiving the checked out commit", err)
+		}
+		core.EndGroup("Checked out commit archived")
+	}
+
+	if cfg.OptimizeAfterCheckout {
+		core.StartGroup("Optimizing the repository")
+		if err := optimizeRepository(cli, cfg.AggressiveRepack); err != nil {
+			return wrapError(ErrCategoryGit, "optimizing the repository", err)
+		}
+		core.EndGroup("Repository optimized")
+	}
+
+	if cfg.PostCheckoutScript != "" && cfg.DryRun {
+		core.Info("[DRY RUN] Skipping the post-checkout script")
+	} else if cfg.PostCheckoutScript != "" {
+		core.StartGroup("Running the post-checkout script")
+		stdout := io.Writer(os.Stdout)
+		if core.Recording() {
+			// script output would corrupt structured output
+			stdout = os.Stderr
+		}
+		if err := runPostCheckoutScript(ctx, cfg.PostCheckoutScriptShell, cfg.PostCheckoutScript, repositoryPath, stdout, os.Stderr); err != nil {
+			// the script is supplied with the inputs, so its failure is a configuration problem rather than a git one
+			return wrapError(ErrCategoryConfig, "running the post-checkout script", err)
+		}
+		core.EndGroup("Post-checkout script completed")
+	}
+
+	if err := cfg.writeActionOutputs(result); err != nil {
+		return wrapError(ErrCategoryFS, "writing outputs", err)
 	}
 
 	// remove auth - already handled by defer functions
 
-	if os.Getenv("DEBUG_SHELL") != "" {
-		c := exec.CommandContext(ctx, "sh", "-i")
+	if debugShell := os.Getenv("DEBUG_SHELL"); debugShell != "" {
+		shell, shellArgs, err := debugShellCommand(debugShell, os.Getenv("DEBUG_SHELL_ARGS"))
+		if err != nil {
+			return wrapError(ErrCategoryConfig, "parsing the debug shell", err)
+		}
+		c := exec.CommandContext(ctx, shell, shellArgs...)
 		c.Dir = workspacePath
 		c.Env = os.Environ()
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
 		c.Stdin = os.Stdin
 		if err = c.Start(); err != nil {
-			return err
+			return wrapError(ErrCategoryConfig, "starting the debug shell", err)
 		}
 
 		if err = c.Wait(); err != nil {
+			return wrapError(ErrCategoryConfig, "running the debug shell", err)
+		}
+	}
 
-			return err
+	return nil
+}
+
+// submoduleURLRemapper is the subset of git.GitCLI needed to remap submodule URLs
+type submoduleURLRemapper interface {
+	GetSubmoduleURLs() (map[string]string, error)
+	SetConfigStr(global bool, key string, val string) error
+}
+
+// matchSubmodulePaths returns the paths of the submodules that match at least one of the filepath.Match patterns
+func matchSubmodulePaths(submodules []git.SubmoduleEntry, patterns []string) []string {
+	var paths []string
+	for _, s := range submodules {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, s.Path); matched {
+				paths = append(paths, s.Path)
+				break
+			}
 		}
 	}
+	return paths
+}
 
+// remapSubmoduleURLs points the submodules whose .gitmodules URL is a key of urlMap at the corresponding value
+func remapSubmoduleURLs(cli submoduleURLRemapper, urlMap map[string]string) error {
+	if len(urlMap) == 0 {
+		return nil
+	}
+	urls, err := cli.GetSubmoduleURLs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(urls))
+	for name := range urls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if newURL, found := urlMap[urls[name]]; found {
+			core.Info("Remapping submodule %s from %s to %s", name, git.StripCredentialsFromURL(urls[name]), git.StripCredentialsFromURL(newURL))
+			if err := cli.SetConfigStr(false, "submodule."+name+".url", newURL); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// debugShellCommand returns the shell and arguments to launch for the DEBUG_SHELL escape hatch. Any non-empty
+// DEBUG_SHELL value activates the debug shell, an absolute path value is used as the shell, otherwise sh is looked up
+// on the PATH. The DEBUG_SHELL_ARGS value is split on whitespace and passed before the interactive flag.
+func debugShellCommand(debugShell string, debugShellArgs string) (string, []string, error) {
+	shell := debugShell
+	if !filepath.IsAbs(shell) {
+		var err error
+		if shell, err = exec.LookPath("sh"); err != nil && !errors.Is(err, exec.ErrDot) {
+			return "", nil, fmt.Errorf("cannot find debug shell: %w", err)
+		} else if errors.Is(err, exec.ErrDot) {
+			if shell, err = filepath.Abs(shell); err != nil {
+				return "", nil, fmt.Errorf("cannot find debug shell: %w", err)
+			}
+		}
+	}
+
+	args := strings.Fields(debugShellArgs)
+	args = append(args, "-i")
+	return shell, args, nil
+}
+
+// runPostCheckoutScript runs script with shell -c in dir, with the full environment of the checkout
+func runPostCheckoutScript(ctx context.Context, shell string, script string, dir string, stdout io.Writer, stderr io.Writer) error {
+	if shell == "" {
+		shell = "sh"
+	}
+	c := exec.CommandContext(ctx, shell, "-c", script)
+	c.Dir = dir
+	c.Env = os.Environ()
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Run()
+}
+
+// configureIgnorePathCase configures git to treat paths case-insensitively when checking out onto a case-sensitive
+// filesystem
+func configureIgnorePathCase(cli *git.GitCLI, repositoryPath string) error {
+	if sensitive, err := isCaseSensitiveFilesystem(filepath.Join(repositoryPath, ".git")); err != nil {
+		return err
+	} else if !sensitive {
+		core.Debug("filesystem at '%s' is case-insensitive, ignore path case is a no-op", repositoryPath)
+		return nil
+	}
+
+	core.StartGroup("Configuring case-insensitive paths")
+	core.Info("Warning: ignoring path case may cause files to be missed in repositories containing paths that differ only in case")
+	for _, key := range []string{"core.ignoreCase", "core.protectHFS", "core.protectNTFS"} {
+		if err := cli.SetConfigBool(false, key, true); err != nil {
+			return err
+		}
+	}
+	core.EndGroup("Case-insensitive paths configured")
+	return nil
+}
+
+// isCaseSensitiveFilesystem probes whether the filesystem containing dir distinguishes file names by case
+func isCaseSensitiveFilesystem(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, "case-probe-")
+	if err != nil {
+		return false, err
+	}
+	name := f.Name()
+	defer func() { _ = os.Remove(name) }()
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	if _, err := os.Stat(upper); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
 func (cfg *Config) doLocalMerge(cli *git.GitCLI, repositoryURL string, credsHelperCmd string) (fetchLoc string, err error) {
 	commitRef := cfg.Commit
 	if cfg.Commit == "" {
@@ -616,6 +1383,14 @@ func (cfg *Config) doLocalMerge(cli *git.GitCLI, repositoryURL string, credsHelp
 
 	cmdOut, err := cli.Merge(repositoryURL, commitRef, cfg.FetchDepth, credsHelperCmd)
 	if err != nil {
+		// the merge binary may still describe the failure, for example a conflict
+		var failure struct {
+			Error            string   `json:"error"`
+			ConflictingFiles []string `json:"conflicting_files"`
+		}
+		if json.Unmarshal([]byte(cmdOut), &failure) == nil && failure.Error != "" {
+			return "", &MergeError{Kind: failure.Error, ConflictingFiles: failure.ConflictingFiles, Underlying: err}
+		}
 		return "", fmt.Errorf("failed to call the merge binary: %w", err)
 	}
 
@@ -632,7 +1407,7 @@ func (cfg *Config) doLocalMerge(cli *git.GitCLI, repositoryURL string, credsHelp
 		cfg.Commit = mergeCommit
 		cfg.Ref = ""
 
-		fmt.Printf("Pull request merged with commit: %s\n", mergeCommit)
+		core.Info("Pull request merged with commit: %s", mergeCommit)
 		if fetchLoc, ok := getStringFromMap(mergeData, "fetched_loc"); ok {
 			return fetchLoc, nil
 		} else {
@@ -661,13 +1436,8 @@ func (cfg *Config) checkCommitInfo(commitInfo string) error {
 		// cannot check without the raw event, assuming ok
 		return nil
 	}
-	repo, ok := getMapFromMap(raw, "repository")
-	if !ok {
-		// cannot check without the repo details from event, assuming ok
-		return nil
-	}
-	if repoPriv, ok := getBoolFromMap(repo, "private"); !ok || repoPriv {
-		// check is only valid for public PR synchronize
+	if repoPriv, ok := getNestedBool(raw, "repository.private"); !ok || repoPriv {
+		// check is only valid for public PR synchronize, or cannot check without the repo details from event
 		return nil
 	}
 	if action, ok := getStringFromMap(raw, "action"); !ok || action != "synchronize" {
@@ -695,9 +1465,7 @@ func (cfg *Config) checkCommitInfo(commitInfo string) error {
 	}
 
 	// Base SHA
-	pr, _ := getMapFromMap(raw, "pull_request")
-	bs, _ := getMapFromMap(pr, "base")
-	expectedBaseSha, ok := getStringFromMap(bs, "sha")
+	expectedBaseSha, ok := getNestedString(raw, "pull_request.base.sha")
 	if !ok || expectedBaseSha == "" {
 		core.Debug("Unable to determine base sha")
 		return nil
@@ -709,7 +1477,7 @@ func (cfg *Config) checkCommitInfo(commitInfo string) error {
 		return nil
 	}
 
-	rex := regexp.MustCompile(`Merge ([0-9a-f]{40}) into ([0-9a-f]{40})`)
+	rex := regexp.MustCompile(`Merge ([0-9a-f]{40}(?:[0-9a-f]{24})?) into ([0-9a-f]{40}(?:[0-9a-f]{24})?)`)
 	match := rex.FindStringSubmatch(commitInfo)
 	if match == nil {
 		core.Debug("Unexpected message format")
@@ -744,6 +1512,53 @@ func loadEventContext(path string) (map[string]interface{}, error) {
 	return event, nil
 }
 
+// validateEventContext checks that a loaded event context has the fields needed to determine what to check out. A
+// context without any of them is only logged, as the inputs may still supply them.
+func validateEventContext(ctx map[string]interface{}) error {
+	if len(ctx) == 0 {
+		return fmt.Errorf("the event is empty")
+	}
+
+	if provider, found := getStringFromMap(ctx, "provider"); found {
+		switch strings.TrimSpace(strings.ToLower(provider)) {
+		case GitHubProvider, GitLabProvider, BitbucketProvider, CustomProvider:
+		default:
+			return fmt.Errorf("unsupported provider: '%s', expected %s/%s/%s/%s", provider, GitHubProvider, GitLabProvider, BitbucketProvider, CustomProvider)
+		}
+	}
+
+	found := false
+	for _, key := range []string{"repositoryUrl", "ref", "sha"} {
+		if _, ok := getStringFromMap(ctx, key); ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		core.Info("Warning: the event has none of repositoryUrl, ref or sha, the default branch of the repository is checked out unless a ref is supplied")
+	}
+	return nil
+}
+
+// readPatternFile reads the patterns from the file at path, one pattern per line. Blank lines and lines starting with #
+// are ignored.
+func readPatternFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
 func (cfg *Config) isWorkflowRepository(eventContext map[string]interface{}) bool {
 	ctxProvider, haveP := getStringFromMap(eventContext, "provider")
 	ctxProvider = strings.ToLower(ctxProvider)
@@ -752,31 +1567,88 @@ func (cfg *Config) isWorkflowRepository(eventContext map[string]interface{}) boo
 	core.Debug("ctx.provider = %s", ctxProvider)
 	core.Debug("ctx.repository = %s", ctxRepository)
 	core.Debug("cfg.provider = %s", cfg.Provider)
-	core.Debug("cfg.repository = %s", cfg.Repository)
+	core.Debug("cfg.repository = %s", git.StripCredentialsFromURL(cfg.Repository))
+
+	if !haveP || cfg.Provider != ctxProvider {
+		return false
+	}
+
+	if cfg.Provider == CustomProvider && isAzureDevOpsURL(cfg.Repository) {
+		// Azure DevOps events carry the clone URL, which may differ in form from the configured repository
+		if ctxRepositoryURL, ok := getStringFromMap(eventContext, "repositoryUrl"); ok {
+			core.Debug("ctx.repositoryUrl = %s", git.StripCredentialsFromURL(ctxRepositoryURL))
+			ctxRepository, haveR = ctxRepositoryURL, true
+		}
+		return haveR && sameAzureDevOpsRepository(cfg.Repository, ctxRepository)
+	}
+
+	if haveR && normalizeURLForComparison(cfg.Repository) == normalizeURLForComparison(ctxRepository) {
+		return true
+	}
+
+	if cfg.Provider == CustomProvider && detectProvider(cfg.Repository) == GiteaProvider {
+		// Gitea and Forgejo events may carry the clone URL with or without .git and with the host in any case
+		if ctxRepositoryURL, ok := getStringFromMap(eventContext, "repositoryUrl"); ok {
+			core.Debug("ctx.repositoryUrl = %s", git.StripCredentialsFromURL(ctxRepositoryURL))
+			ctxRepository, haveR = ctxRepositoryURL, true
+		}
+		return haveR && normalizeGiteaURL(cfg.Repository) == normalizeGiteaURL(ctxRepository)
+	}
 
-	return haveP && cfg.Provider == ctxProvider && haveR && cfg.Repository == ctxRepository
+	return false
 }
 
-func getStringFromMap(m map[string]interface{}, key string) (string, bool) {
-	i, found := m[key]
-	if !found {
-		return "", false
+// getNestedValue returns the value at the dot-delimited keyPath, such as raw.repository.owner, traversing nested maps
+func getNestedValue(m map[string]interface{}, keyPath string) (interface{}, bool) {
+	keys := strings.Split(keyPath, ".")
+	for _, key := range keys[:len(keys)-1] {
+		var ok bool
+		if m, ok = getMapFromMap(m, key); !ok {
+			return nil, false
+		}
 	}
-	if s, ok := i.(string); ok {
-		return s, true
+	v, found := m[keys[len(keys)-1]]
+	return v, found
+}
+
+// getNestedString returns the string at the dot-delimited keyPath
+func getNestedString(m map[string]interface{}, keyPath string) (string, bool) {
+	if v, found := getNestedValue(m, keyPath); found {
+		s, ok := v.(string)
+		return s, ok
 	}
 	return "", false
 }
 
-func getBoolFromMap(m map[string]interface{}, key string) (bool, bool) {
+// getNestedBool returns the boolean at the dot-delimited keyPath
+func getNestedBool(m map[string]interface{}, keyPath string) (bool, bool) {
+	if v, found := getNestedValue(m, keyPath); found {
+		b, ok := v.(bool)
+		return b, ok
+	}
+	return false, false
+}
+
+// getNestedInt64 returns the whole number at the dot-delimited keyPath
+func getNestedInt64(m map[string]interface{}, keyPath string) (int64, bool) {
+	if v, found := getNestedValue(m, keyPath); found {
+		// encoding/json decodes all numbers as float64
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) <= 1<<53 {
+			return int64(f), true
+		}
+	}
+	return 0, false
+}
+
+func getStringFromMap(m map[string]interface{}, key string) (string, bool) {
 	i, found := m[key]
 	if !found {
-		return false, false
+		return "", false
 	}
-	if v, ok := i.(bool); ok {
-		return v, true
+	if s, ok := i.(string); ok {
+		return s, true
 	}
-	return false, false
+	return "", false
 }
 
 func getMapFromMap(m map[string]interface{}, key string) (map[string]interface{}, bool) {
@@ -795,7 +1667,44 @@ type CheckoutInfo struct {
 	startPoint string
 }
 
-func getCheckoutInfo(cli *git.GitCLI, ref string, commit string) (*CheckoutInfo, error) {
+// qualifiedRef returns the fully qualified branch or tag being checked out, or an empty string when checking out
+// a commit or a pull request, change or merge request ref
+func (c *CheckoutInfo) qualifiedRef() string {
+	if branch, found := strings.CutPrefix(c.startPoint, "refs/remotes/origin/"); found {
+		return "refs/heads/" + branch
+	}
+	if c.startPoint == "" && strings.HasPrefix(c.ref, "refs/") {
+		return c.ref
+	}
+	return ""
+}
+
+// refLookup is the subset of the GitCLI used to resolve unqualified refs
+type refLookup interface {
+	BranchExists(remote bool, pattern string) (bool, error)
+	TagExists(pattern string) (bool, error)
+}
+
+// resolveExtraRefs returns the fetched commit of each of the extra refs, keyed by the ref
+func resolveExtraRefs(cli *git.GitCLI, refs []string) (map[string]string, error) {
+	commits := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		info, err := getCheckoutInfo(cli, ref, "")
+		if err != nil {
+			return nil, err
+		}
+		rev := info.startPoint
+		if rev == "" {
+			rev = info.ref
+		}
+		if commits[ref], err = cli.RevParse(rev + "^{commit}"); err != nil {
+			return nil, err
+		}
+	}
+	return commits, nil
+}
+
+func getCheckoutInfo(cli refLookup, ref string, commit string) (*CheckoutInfo, error) {
 	if ref == "" && commit == "" {
 		return nil, fmt.Errorf("Ref and commit cannot both be empty")
 	}
@@ -811,6 +1720,12 @@ func getCheckoutInfo(cli *git.GitCLI, ref string, commit string) (*CheckoutInfo,
 	} else if strings.HasPrefix(lowerRef, "refs/pull/") {
 		result.ref = ref[len("refs/pull/"):]
 		result.startPoint = "refs/remotes/pull/" + result.ref
+	} else if strings.HasPrefix(lowerRef, "refs/changes/") {
+		result.ref = ref[len("refs/changes/"):]
+		result.startPoint = "refs/remotes/gerrit/" + result.ref
+	} else if strings.HasPrefix(lowerRef, "refs/merge-requests/") {
+		result.ref = ref[len("refs/merge-requests/"):]
+		result.startPoint = "refs/remotes/merge-requests/" + result.ref
 	} else if strings.HasPrefix(lowerRef, "refs/") {
 		result.ref = ref
 	} else {
@@ -837,6 +1752,57 @@ func getCheckoutInfo(cli *git.GitCLI, ref string, commit string) (*CheckoutInfo,
 	return &result, nil
 }
 
+// fetchResumer inspects and updates what a previous run has already fetched into the repository
+type fetchResumer interface {
+	HasObject(sha string) (bool, error)
+	ShallowDepth() (int, error)
+	HistoryLength(rev string) (int, error)
+	UpdateRef(ref string, sha string) error
+}
+
+// resumeFetch lets a run pick up where a previous run in the same repository left off. An interrupted fetch
+// discards the objects it downloaded, but when a previous run got past the fetch, for example because a later step
+// failed or the agent was killed, the commit is already present. When its local history is at least fetchDepth
+// commits deep (or complete) the fetch can be skipped, once the refs the refSpec would have updated point at the
+// commit. When the history is too shallow, only the missing commits need to be fetched. Returns whether to skip the
+// fetch and otherwise how many commits to deepen the history by, 0 meaning that a regular fetch is required.
+func resumeFetch(cli fetchResumer, refSpec []string, commit string, fetchDepth int) (bool, int, error) {
+	if exists, err := cli.HasObject(commit); err != nil || !exists {
+		return false, 0, err
+	}
+
+	shallow, err := cli.ShallowDepth()
+	if err != nil {
+		return false, 0, err
+	}
+	depth := 0
+	if shallow >= 0 {
+		// the shallow file only lists where the history is truncated, the depth of the commit has to be counted
+		if depth, err = cli.HistoryLength(commit); err != nil {
+			return false, 0, err
+		}
+	}
+	switch {
+	case shallow < 0:
+		// the history is complete
+	case fetchDepth <= 0:
+		// all the history was requested, so a regular fetch is needed to unshallow the repository
+		return false, 0, nil
+	case depth < fetchDepth:
+		return false, fetchDepth - depth, nil
+	}
+
+	for _, r := range refSpec {
+		src, dst, found := strings.Cut(strings.TrimPrefix(r, "+"), ":")
+		if found && src == commit {
+			if err := cli.UpdateRef(dst, commit); err != nil {
+				return false, 0, err
+			}
+		}
+	}
+	return true, 0, nil
+}
+
 func testRef(cli *git.GitCLI, ref string, commit string) (bool, error) {
 	if ref == "" && commit == "" {
 		return false, fmt.Errorf("Ref and commit cannot both be empty")
@@ -865,7 +1831,7 @@ func testRef(cli *git.GitCLI, ref string, commit string) (bool, error) {
 		return true, nil
 	}
 
-	if strings.HasPrefix(lowerRef, "refs/pull/") {
+	if strings.HasPrefix(lowerRef, "refs/pull/") || strings.HasPrefix(lowerRef, "refs/changes/") || strings.HasPrefix(lowerRef, "refs/merge-requests/") {
 		// assume matches because fetched using the commit
 		return true, nil
 	}
@@ -894,6 +1860,22 @@ func getRefSpecForAllHistory(ref string, commit string) []string {
 			r = append(r, fmt.Sprintf("+%s:refs/remotes/pull/%s", ref, branch))
 		}
 	}
+	if ref != "" && strings.HasPrefix(strings.ToLower(ref), "refs/changes/") {
+		change := ref[len("refs/changes/"):]
+		if commit != "" {
+			r = append(r, fmt.Sprintf("+%s:refs/remotes/gerrit/%s", commit, change))
+		} else {
+			r = append(r, fmt.Sprintf("+%s:refs/remotes/gerrit/%s", ref, change))
+		}
+	}
+	if ref != "" && strings.HasPrefix(strings.ToLower(ref), "refs/merge-requests/") {
+		mergeRequest := ref[len("refs/merge-requests/"):]
+		if commit != "" {
+			r = append(r, fmt.Sprintf("+%s:refs/remotes/merge-requests/%s", commit, mergeRequest))
+		} else {
+			r = append(r, fmt.Sprintf("+%s:refs/remotes/merge-requests/%s", ref, mergeRequest))
+		}
+	}
 	return r
 }
 
@@ -911,6 +1893,16 @@ func getRefSpec(ref string, commit string, provider string) []string {
 			return []string{fmt.Sprintf("+%s:refs/remotes/pull/%s", commit, branch)}
 		}
 
+		if strings.HasPrefix(lowerRef, "refs/changes/") {
+			change := ref[len("refs/changes/"):]
+			return []string{fmt.Sprintf("+%s:refs/remotes/gerrit/%s", commit, change)}
+		}
+
+		if strings.HasPrefix(lowerRef, "refs/merge-requests/") {
+			mergeRequest := ref[len("refs/merge-requests/"):]
+			return []string{fmt.Sprintf("+%s:refs/remotes/merge-requests/%s", commit, mergeRequest)}
+		}
+
 		if strings.HasPrefix(lowerRef, "refs/tags/") {
 			return []string{fmt.Sprintf("+%s:%s", commit, ref)}
 		}
@@ -939,61 +1931,80 @@ func getRefSpec(ref string, commit string, provider string) []string {
 		return []string{fmt.Sprintf("+%s:refs/remotes/pull/%s", ref, branch)}
 	}
 
+	if strings.HasPrefix(lowerRef, "refs/changes/") {
+		change := ref[len("refs/changes/"):]
+		return []string{fmt.Sprintf("+%s:refs/remotes/gerrit/%s", ref, change)}
+	}
+
+	if strings.HasPrefix(lowerRef, "refs/merge-requests/") {
+		mergeRequest := ref[len("refs/merge-requests/"):]
+		return []string{fmt.Sprintf("+%s:refs/remotes/merge-requests/%s", ref, mergeRequest)}
+	}
+
 	return []string{fmt.Sprintf("+%s:%s", ref, ref)}
 }
 
-func prepareExistingDirectory(cli *git.GitCLI, repositoryPath string, repositoryURL string, clean bool, ref string) (reterr error) {
+func prepareExistingDirectory(cli *git.GitCLI, repositoryPath string, repositoryURL string, clean bool, stash bool, ref string, indexLockTimeout time.Duration) (string, error) {
 	remove := false
+	stashRef := ""
 
 	if stat, err := os.Stat(filepath.Join(repositoryPath, ".git")); err != nil || !stat.IsDir() {
 		remove = true
 	}
 
 	if !remove {
-		origin, err := cli.GetConfig(false, "remote.origin.url")
-		if err != nil || repositoryURL != strings.TrimSpace(origin) {
+		origin, err := cli.GetRemoteURL("origin")
+		if err != nil {
+			remove = true
+		} else if repositoryURL != origin && !updateRemoteURL(cli, "origin", repositoryURL) {
 			remove = true
 		}
 	}
 
 	if !remove {
-		// Best effort delete any index.lock and shallow.lock left by a previously canceled run or crashed process
-		for _, n := range []string{"index.lock", "shallow.lock"} {
-			lockPath := filepath.Join(repositoryPath, ".git", n)
-			if _, err := os.Stat(lockPath); err != nil {
-				if err := os.Remove(lockPath); err != nil {
-					fmt.Printf("Unable to delete '%s': %v", lockPath, err)
-					remove = true
-					break
-				}
+		// Give any concurrent git process a chance to release the index.lock, then delete it as left by a
+		// previously canceled run or crashed process
+		if err := cli.WaitForIndexLock(indexLockTimeout); err != nil {
+			core.Info("Unable to delete the index.lock: %v", err)
+			remove = true
+		}
+	}
+
+	if !remove {
+		// Best effort delete any shallow.lock left by a previously canceled run or crashed process
+		lockPath := filepath.Join(repositoryPath, ".git", "shallow.lock")
+		if _, err := os.Stat(lockPath); err == nil {
+			if err := os.Remove(lockPath); err != nil {
+				core.Info("Unable to delete '%s': %v", lockPath, err)
+				remove = true
 			}
 		}
 	}
 
 	if !remove {
-		fmt.Println("Removing previously created refs, to avoid conflicts")
+		core.Info("Removing previously created refs, to avoid conflicts")
 
 		// checkout detached HEAD so that we can remove all branches safely
 		if detached, err := cli.IsDetached(); err != nil {
-			fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+			core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 			remove = true
 		} else if !detached {
 			if err := cli.CheckoutDetach(); err != nil {
-				fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+				core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 				remove = true
 			}
 		}
 	}
 
 	if !remove {
-		branches, err := cli.BranchList(false)
+		branches, err := cli.BranchList(false, "")
 		if err != nil {
-			fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+			core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 			remove = true
 		} else {
 			for _, b := range branches {
 				if err := cli.BranchDelete(false, b); err != nil {
-					fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+					core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 					remove = true
 					break
 				}
@@ -1013,9 +2024,10 @@ func prepareExistingDirectory(cli *git.GitCLI, repositoryPath string, repository
 		if strings.HasPrefix(ref, "refs/heads/") {
 			name1 := strings.ToLower(strings.TrimPrefix(ref, "refs/heads/"))
 			name1Slash := name1 + "/"
-			branches, err := cli.BranchList(true)
+			// the names are compared ignoring case, which for-each-ref patterns cannot do, so list every branch
+			branches, err := cli.BranchList(true, "")
 			if err != nil {
-				fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+				core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 				remove = true
 			} else {
 				for _, b := range branches {
@@ -1023,7 +2035,7 @@ func prepareExistingDirectory(cli *git.GitCLI, repositoryPath string, repository
 					name2Slash := name2 + "/"
 					if strings.HasPrefix(name1, name2Slash) || strings.HasPrefix(name2, name1Slash) {
 						if err := cli.BranchDelete(true, b); err != nil {
-							fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+							core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 							remove = true
 							break
 						}
@@ -1036,57 +2048,169 @@ func prepareExistingDirectory(cli *git.GitCLI, repositoryPath string, repository
 	if !remove {
 		// Check for submodules and delete any existing files if submodules are present
 		if err := cli.SubmoduleStatus(); err != nil {
-			fmt.Println("Bad Submodules found, removing existing files")
+			core.Info("Bad Submodules found, removing existing files")
 			remove = true
 		}
 	}
 
 	if !remove {
 		// Clean
+		if clean && stash {
+			var err error
+			if stashRef, err = cli.StashPush("checkout-stash-"+uuid.New().String(), true); err != nil {
+				// cleaning would lose the changes that were asked to be preserved
+				return "", fmt.Errorf("unable to stash the local changes before clean: %w", err)
+			} else if stashRef != "" {
+				core.Info("Stashed the local changes before clean as %s", stashRef)
+			}
+		}
 		if clean {
 			if err := cli.Clean(); err != nil {
-				fmt.Printf("The Clean command failed. This might be caused by: 1) Path too long, 2) permission issue, or 3) file in use. For further investigation, manually run 'git Clean -ffdx' on the directory '%s'.\n", repositoryPath)
-				fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+				core.Info("The Clean command failed. This might be caused by: 1) Path too long, 2) permission issue, or 3) file in use. For further investigation, manually run 'git Clean -ffdx' on the directory '%s'.", repositoryPath)
+				core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 				remove = true
 			} else if err := cli.Reset(); err != nil {
-				fmt.Println("Unable to prepare the existing Repository. The Repository will be recreated instead.")
+				core.Info("Unable to prepare the existing Repository. The Repository will be recreated instead.")
 				remove = true
 			}
 		}
 	}
 
 	if remove {
-		// Delete the contents of the directory. Don't delete the directory itself
-		// since it might be the current working directory.
+		if stashRef != "" {
+			core.Info("Warning: the changes stashed before clean are discarded as the Repository is recreated")
+		}
+		return "", removeDirectoryContents(repositoryPath)
+	}
+	return stashRef, nil
+}
 
-		d, err := os.Open(repositoryPath)
-		if err != nil {
-			return err
+// remoteURLUpdater is the subset of git.GitCLI used to point an existing repository at a new remote URL
+type remoteURLUpdater interface {
+	Fsck(options ...string) (string, error)
+	RemoteSetURL(name string, url string) error
+}
+
+// updateRemoteURL points the remote of an existing repository at url, for example when the repository moved from HTTPS
+// to SSH, so that the objects already fetched are reused. Returns false if the repository should be recreated instead.
+func updateRemoteURL(cli remoteURLUpdater, name string, url string) bool {
+	if _, err := cli.Fsck("--connectivity-only", "--no-progress"); err != nil {
+		core.Info("The existing Repository is not intact, it will be recreated instead of updating the remote URL")
+		return false
+	}
+	if err := cli.RemoteSetURL(name, url); err != nil {
+		core.Info("Unable to update the remote URL. The Repository will be recreated instead.")
+		return false
+	}
+	core.Info("Updated the URL of remote '%s' to %s", name, git.StripCredentialsFromURL(url))
+	return true
+}
+
+// removeDirectoryContents deletes the contents of the directory. Don't delete the directory itself
+// since it might be the current working directory.
+func removeDirectoryContents(path string) (reterr error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer (func() {
+		err := d.Close()
+		if err != nil && reterr == nil {
+			reterr = err
 		}
-		defer (func() {
-			err := d.Close()
-			if err != nil && reterr == nil {
-				reterr = err
-			}
-		})()
-		names, err := d.Readdirnames(-1)
+	})()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	core.Info("Deleting the contents of '%s'", path)
+
+	// the walk is only worth the time when the result is logged
+	var usage int64 = -1
+	if core.IsDebug() {
+		if usage, err = diskUsage(path); err != nil {
+			core.Debug("Unable to determine the disk usage of '%s': %v", path, err)
+			usage = -1
+		}
+	}
+
+	for _, name := range names {
+		err = os.RemoveAll(filepath.Join(path, name))
 		if err != nil {
 			return err
 		}
+	}
+
+	if usage >= 0 {
+		core.Debug("Freed %d bytes by deleting %s", usage, path)
+		if available, err := availableSpace(path); err == nil {
+			core.Debug("%d bytes of disk space available at %s", available, path)
+		}
+	}
+	return nil
+}
 
-		if len(names) == 0 {
-			return nil
+// mainCloneDir is the directory under the workspace of the bare clone shared by worktree checkouts
+const mainCloneDir = ".git-main-clone"
+
+// prepareWorktreeDirectory prepares the shared bare main clone, creating it if necessary. A worktree of the main
+// clone already at the Repository Path is reused, cleaned when clean is set, otherwise the Repository Path is
+// emptied ready for it to be added as a worktree. On return the cli working directory is the main clone.
+func prepareWorktreeDirectory(cli *git.GitCLI, mainClonePath string, repositoryPath string, repositoryURL string, clean bool) (reused bool, err error) {
+	if err := os.MkdirAll(mainClonePath, os.ModePerm); err != nil {
+		return false, fmt.Errorf("could not create directory '%s': %v", mainClonePath, err)
+	}
+	cli.SetCwd(mainClonePath)
+
+	if _, err := os.Stat(filepath.Join(mainClonePath, "HEAD")); err != nil {
+		core.StartGroup("Initializing the main clone")
+		if err := removeDirectoryContents(mainClonePath); err != nil {
+			return false, err
+		}
+		if err := cli.InitBare(mainClonePath); err != nil {
+			return false, err
 		}
+		if err := cli.RemoteAdd("origin", repositoryURL); err != nil {
+			return false, err
+		}
+		core.EndGroup("Main clone initialized")
+		return false, removeDirectoryContents(repositoryPath)
+	}
 
-		fmt.Printf("Deleting the contents of '%s'\n", repositoryPath)
+	core.Info("Reusing the main clone at '%s'", mainClonePath)
+	if origin, err := cli.GetConfig(false, "remote.origin.url"); err != nil || repositoryURL != strings.TrimSpace(origin) {
+		if err := cli.SetConfigStr(false, "remote.origin.url", repositoryURL); err != nil {
+			return false, err
+		}
+	}
 
-		for _, name := range names {
-			err = os.RemoveAll(filepath.Join(repositoryPath, name))
-			if err != nil {
-				return err
+	worktrees, err := cli.WorktreeList()
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(repositoryPath, ".git")); err == nil && slices.Contains(worktrees, repositoryPath) {
+		core.Info("Reusing the worktree at '%s'", repositoryPath)
+		if clean {
+			cli.SetCwd(repositoryPath)
+			defer cli.SetCwd(mainClonePath)
+			if err := cli.Clean(); err != nil {
+				return false, err
+			}
+			if err := cli.Reset(); err != nil {
+				return false, err
 			}
 		}
-		return nil
+		return true, nil
 	}
-	return nil
+
+	if err := removeDirectoryContents(repositoryPath); err != nil {
+		return false, err
+	}
+	// remove the registration of any worktree whose directory is gone, including one emptied above
+	return false, cli.WorktreePrune()
 }
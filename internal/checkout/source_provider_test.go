@@ -1,10 +1,23 @@
 package checkout
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/cloudbees-io/checkout/internal/core"
+	"github.com/cloudbees-io/checkout/internal/git"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func Test_findEventContext(t *testing.T) {
@@ -21,3 +34,1440 @@ func Test_findEventContext(t *testing.T) {
 	ref, _ := getStringFromMap(eventContext, "ref")
 	require.Equal(t, "refs/heads/main", ref)
 }
+
+func Test_findEventContext_invalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		wantErr     string
+		wantWarning bool
+	}{
+		{name: "not json", event: `{"provider": "github",`, wantErr: "unexpected end of JSON input"},
+		{name: "array", event: `["github"]`, wantErr: "cannot unmarshal array"},
+		{name: "null", event: `null`, wantErr: "the event is empty"},
+		{name: "empty object", event: `{}`, wantErr: "the event is empty"},
+		{name: "unknown provider", event: `{"provider": "svn", "ref": "refs/heads/main"}`, wantErr: "unsupported provider: 'svn'"},
+		{name: "provider case insensitive", event: `{"provider": "GitLab", "sha": "0123456789abcdef0123456789abcdef01234567"}`},
+		{name: "no provider", event: `{"repositoryUrl": "https://github.com/org/repo"}`},
+		{name: "no checkout fields", event: `{"provider": "github", "repository": "org/repo"}`, wantWarning: true},
+		{name: "non-string checkout fields", event: `{"provider": "github", "ref": 1}`, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventPath := filepath.Join(t.TempDir(), "event.json")
+			require.NoError(t, os.WriteFile(eventPath, []byte(tt.event), 0644))
+			t.Setenv("CLOUDBEES_EVENT_PATH", eventPath)
+
+			core.StartRecording()
+			eventContext, err := findEventContext()
+			logs := core.StopRecording()
+
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, eventContext)
+
+			warned := false
+			for _, l := range logs {
+				warned = warned || strings.HasPrefix(l.Message, "Warning: the event has none of")
+			}
+			require.Equal(t, tt.wantWarning, warned)
+		})
+	}
+}
+
+func Test_getNested(t *testing.T) {
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"ref": "refs/heads/main",
+		"raw": {
+			"repository": {
+				"private": false,
+				"owner": {"id": 21031067, "login": "org", "site": {"admin": true}}
+			},
+			"pull_request": {"base": {"sha": "0123456789abcdef0123456789abcdef01234567"}},
+			"number": 1.5,
+			"list": ["a"]
+		}
+	}`), &m))
+
+	s, ok := getNestedString(m, "ref")
+	require.True(t, ok)
+	require.Equal(t, "refs/heads/main", s)
+	s, ok = getNestedString(m, "raw.pull_request.base.sha")
+	require.True(t, ok)
+	require.Equal(t, "0123456789abcdef0123456789abcdef01234567", s)
+	s, ok = getNestedString(m, "raw.repository.owner.login")
+	require.True(t, ok)
+	require.Equal(t, "org", s)
+
+	b, ok := getNestedBool(m, "raw.repository.owner.site.admin")
+	require.True(t, ok)
+	require.True(t, b)
+	b, ok = getNestedBool(m, "raw.repository.private")
+	require.True(t, ok)
+	require.False(t, b)
+
+	i, ok := getNestedInt64(m, "raw.repository.owner.id")
+	require.True(t, ok)
+	require.Equal(t, int64(21031067), i)
+
+	// wrong leaf types
+	_, ok = getNestedString(m, "raw.repository.owner.id")
+	require.False(t, ok)
+	_, ok = getNestedBool(m, "ref")
+	require.False(t, ok)
+	_, ok = getNestedInt64(m, "raw.number")
+	require.False(t, ok)
+	_, ok = getNestedInt64(m, "ref")
+	require.False(t, ok)
+
+	// missing keys and intermediate keys that are not maps
+	_, ok = getNestedString(m, "raw.repository.missing.login")
+	require.False(t, ok)
+	_, ok = getNestedString(m, "ref.name")
+	require.False(t, ok)
+	_, ok = getNestedString(m, "raw.list.0")
+	require.False(t, ok)
+	_, ok = getNestedString(m, "raw.repository.owner.login.first")
+	require.False(t, ok)
+	_, ok = getNestedString(nil, "raw.ref")
+	require.False(t, ok)
+}
+
+type fakeRefLookup struct {
+	branches map[string]bool
+	tags     map[string]bool
+}
+
+func (f *fakeRefLookup) BranchExists(remote bool, pattern string) (bool, error) {
+	return remote && f.branches[pattern], nil
+}
+
+func (f *fakeRefLookup) TagExists(pattern string) (bool, error) {
+	return f.tags[pattern], nil
+}
+
+func TestGetCheckoutInfo(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const sha256Commit = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cli := &fakeRefLookup{
+		branches: map[string]bool{"origin/feature": true},
+		tags:     map[string]bool{"v2.0.0": true},
+	}
+	tests := []struct {
+		name    string
+		ref     string
+		commit  string
+		want    *CheckoutInfo
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			wantErr: true,
+		},
+		{
+			name:   "commit-only",
+			commit: commit,
+			want:   &CheckoutInfo{ref: commit},
+		},
+		{
+			name:   "sha256-commit-only",
+			commit: sha256Commit,
+			want:   &CheckoutInfo{ref: sha256Commit},
+		},
+		{
+			name:   "sha256-branch-with-commit",
+			ref:    "refs/heads/main",
+			commit: sha256Commit,
+			want:   &CheckoutInfo{ref: "main", startPoint: "refs/remotes/origin/main"},
+		},
+		{
+			name: "branch",
+			ref:  "refs/heads/main",
+			want: &CheckoutInfo{ref: "main", startPoint: "refs/remotes/origin/main"},
+		},
+		{
+			name:   "branch-with-commit",
+			ref:    "refs/heads/main",
+			commit: commit,
+			want:   &CheckoutInfo{ref: "main", startPoint: "refs/remotes/origin/main"},
+		},
+		{
+			name: "pull",
+			ref:  "refs/pull/123/head",
+			want: &CheckoutInfo{ref: "123/head", startPoint: "refs/remotes/pull/123/head"},
+		},
+		{
+			name:   "pull-with-commit",
+			ref:    "refs/pull/123/head",
+			commit: commit,
+			want:   &CheckoutInfo{ref: "123/head", startPoint: "refs/remotes/pull/123/head"},
+		},
+		{
+			name: "gerrit-change",
+			ref:  "refs/changes/34/1234/2",
+			want: &CheckoutInfo{ref: "34/1234/2", startPoint: "refs/remotes/gerrit/34/1234/2"},
+		},
+		{
+			name:   "gerrit-change-with-commit",
+			ref:    "refs/changes/34/1234/2",
+			commit: commit,
+			want:   &CheckoutInfo{ref: "34/1234/2", startPoint: "refs/remotes/gerrit/34/1234/2"},
+		},
+		{
+			name: "gitlab-merge-request",
+			ref:  "refs/merge-requests/42/head",
+			want: &CheckoutInfo{ref: "42/head", startPoint: "refs/remotes/merge-requests/42/head"},
+		},
+		{
+			name:   "gitlab-merge-request-merge-with-commit",
+			ref:    "refs/merge-requests/42/merge",
+			commit: commit,
+			want:   &CheckoutInfo{ref: "42/merge", startPoint: "refs/remotes/merge-requests/42/merge"},
+		},
+		{
+			name: "tag",
+			ref:  "refs/tags/v1.0.0",
+			want: &CheckoutInfo{ref: "refs/tags/v1.0.0"},
+		},
+		{
+			name: "unqualified-branch",
+			ref:  "feature",
+			want: &CheckoutInfo{ref: "feature", startPoint: "refs/remotes/origin/feature"},
+		},
+		{
+			name: "unqualified-tag",
+			ref:  "v2.0.0",
+			want: &CheckoutInfo{ref: "refs/tags/v2.0.0"},
+		},
+		{
+			name:    "unqualified-missing",
+			ref:     "missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCheckoutInfo(cli, tt.ref, tt.commit)
+
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Nil(t, got)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckoutInfo_qualifiedRef(t *testing.T) {
+	require.Equal(t, "refs/heads/main", (&CheckoutInfo{ref: "main", startPoint: "refs/remotes/origin/main"}).qualifiedRef())
+	require.Equal(t, "refs/tags/v1.0.0", (&CheckoutInfo{ref: "refs/tags/v1.0.0"}).qualifiedRef())
+	require.Equal(t, "", (&CheckoutInfo{ref: "123/head", startPoint: "refs/remotes/pull/123/head"}).qualifiedRef())
+	require.Equal(t, "", (&CheckoutInfo{ref: "0123456789abcdef0123456789abcdef01234567"}).qualifiedRef())
+}
+
+func Test_debugShellCommand(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		shell     string
+		args      string
+		wantShell string
+		wantArgs  []string
+	}{
+		{
+			name:      "flag",
+			shell:     "1",
+			wantShell: sh,
+			wantArgs:  []string{"-i"},
+		},
+		{
+			name:      "absolute-path",
+			shell:     "/bin/bash",
+			wantShell: "/bin/bash",
+			wantArgs:  []string{"-i"},
+		},
+		{
+			name:      "args",
+			shell:     "true",
+			args:      " -x  -e ",
+			wantShell: sh,
+			wantArgs:  []string{"-x", "-e", "-i"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shell, args, err := debugShellCommand(tt.shell, tt.args)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantShell, shell)
+			require.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func Test_getRefSpec(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const sha256Commit = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name     string
+		ref      string
+		commit   string
+		provider string
+		want     []string
+	}{
+		{
+			name: "branch",
+			ref:  "refs/heads/main",
+			want: []string{"+refs/heads/main:refs/remotes/origin/main"},
+		},
+		{
+			name:   "branch-with-commit",
+			ref:    "refs/heads/main",
+			commit: commit,
+			want:   []string{"+" + commit + ":refs/remotes/origin/main"},
+		},
+		{
+			name:   "branch-with-sha256-commit",
+			ref:    "refs/heads/main",
+			commit: sha256Commit,
+			want:   []string{"+" + sha256Commit + ":refs/remotes/origin/main"},
+		},
+		{
+			name:   "sha256-commit-only",
+			commit: sha256Commit,
+			want:   []string{sha256Commit},
+		},
+		{
+			name: "pull",
+			ref:  "refs/pull/123/head",
+			want: []string{"+refs/pull/123/head:refs/remotes/pull/123/head"},
+		},
+		{
+			name: "gerrit-change",
+			ref:  "refs/changes/34/1234/2",
+			want: []string{"+refs/changes/34/1234/2:refs/remotes/gerrit/34/1234/2"},
+		},
+		{
+			name:   "gerrit-change-with-commit",
+			ref:    "refs/changes/34/1234/2",
+			commit: commit,
+			want:   []string{"+" + commit + ":refs/remotes/gerrit/34/1234/2"},
+		},
+		{
+			name: "gitlab-merge-request",
+			ref:  "refs/merge-requests/42/head",
+			want: []string{"+refs/merge-requests/42/head:refs/remotes/merge-requests/42/head"},
+		},
+		{
+			name: "gitlab-merge-request-merge",
+			ref:  "refs/merge-requests/42/merge",
+			want: []string{"+refs/merge-requests/42/merge:refs/remotes/merge-requests/42/merge"},
+		},
+		{
+			name:   "gitlab-merge-request-with-commit",
+			ref:    "refs/merge-requests/42/head",
+			commit: commit,
+			want:   []string{"+" + commit + ":refs/remotes/merge-requests/42/head"},
+		},
+		{
+			name: "unqualified",
+			ref:  "main",
+			want: []string{"+refs/heads/main*:refs/remotes/origin/main*", "+refs/tags/main*:refs/tags/main*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, getRefSpec(tt.ref, tt.commit, tt.provider))
+		})
+	}
+}
+
+func Test_getRefSpecForAllHistory(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	base := []string{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+	tests := []struct {
+		name   string
+		ref    string
+		commit string
+		want   []string
+	}{
+		{
+			name: "branch",
+			ref:  "refs/heads/main",
+			want: base,
+		},
+		{
+			name: "pull",
+			ref:  "refs/pull/123/head",
+			want: append(base[:2:2], "+refs/pull/123/head:refs/remotes/pull/123/head"),
+		},
+		{
+			name: "gerrit-change",
+			ref:  "refs/changes/34/1234/2",
+			want: append(base[:2:2], "+refs/changes/34/1234/2:refs/remotes/gerrit/34/1234/2"),
+		},
+		{
+			name:   "gerrit-change-with-commit",
+			ref:    "refs/changes/34/1234/2",
+			commit: commit,
+			want:   append(base[:2:2], "+"+commit+":refs/remotes/gerrit/34/1234/2"),
+		},
+		{
+			name: "gitlab-merge-request",
+			ref:  "refs/merge-requests/42/head",
+			want: append(base[:2:2], "+refs/merge-requests/42/head:refs/remotes/merge-requests/42/head"),
+		},
+		{
+			name:   "gitlab-merge-request-with-commit",
+			ref:    "refs/merge-requests/42/merge",
+			commit: commit,
+			want:   append(base[:2:2], "+"+commit+":refs/remotes/merge-requests/42/merge"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, getRefSpecForAllHistory(tt.ref, tt.commit))
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	valid := func() Config {
+		return Config{Provider: GitHubProvider, Repository: "org/repo", Token: "t", Submodules: "false"}
+	}
+	tests := []struct {
+		name         string
+		workspace    string
+		cfg          func() Config
+		eventContext map[string]interface{}
+		want         func(t *testing.T, cfg Config)
+		wantErr      string
+	}{
+		{
+			name:      "missing workspace",
+			workspace: "-",
+			cfg:       valid,
+			wantErr:   "environment variable CLOUDBEES_WORKSPACE is not defined",
+		},
+		{
+			name:      "workspace does not exist",
+			workspace: filepath.Join("does", "not", "exist"),
+			cfg:       valid,
+			wantErr:   "does not exist",
+		},
+		{
+			name: "missing provider",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Provider = ""
+				return cfg
+			},
+			wantErr: "input required and not supplied: provider",
+		},
+		{
+			name: "provider from event context",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Provider = ""
+				return cfg
+			},
+			eventContext: map[string]interface{}{"provider": "GitLab"},
+			want: func(t *testing.T, cfg Config) {
+				require.Equal(t, GitLabProvider, cfg.Provider)
+				require.Equal(t, "https://gitlab.com", cfg.GitlabServerURL)
+			},
+		},
+		{
+			name: "invalid repository",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Repository = "repo"
+				return cfg
+			},
+			wantErr: "invalid repository 'repo', expected format {owner}/{repo}",
+		},
+		{
+			name: "lfs pointer only without lfs",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.LfsPointerOnly = true
+				return cfg
+			},
+			wantErr: "lfs is required with lfs-pointer-only",
+		},
+		{
+			name: "invalid submodule path pattern",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.SubmodulePathPatterns = []string{"libs/[a-"}
+				return cfg
+			},
+			wantErr: "invalid submodule-paths pattern: 'libs/[a-'",
+		},
+		{
+			name: "allowed repository",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.AllowedRepositories = []string{"gitlab.com/*/*", "github.com/org/*"}
+				return cfg
+			},
+		},
+		{
+			name: "repository not allowed",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.AllowedRepositories = []string{"github.com/other/*"}
+				return cfg
+			},
+			wantErr: "repository 'github.com/org/repo' does not match any of the allowed-repositories patterns",
+		},
+		{
+			name: "missing allowed repositories file",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.AllowedRepositoriesFile = "allowed.txt"
+				return cfg
+			},
+			wantErr: "could not read allowed-repositories-file",
+		},
+		{
+			name: "no checkout with sparse checkout",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.NoCheckout = true
+				cfg.SparseCheckout = "src"
+				return cfg
+			},
+			wantErr: "no-checkout cannot be used with worktree or sparse-checkout",
+		},
+		{
+			name: "aggressive repack without optimize",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.AggressiveRepack = true
+				return cfg
+			},
+			wantErr: "optimize is required with aggressive-repack",
+		},
+		{
+			name: "stash before clean without clean",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.StashBeforeClean = true
+				return cfg
+			},
+			wantErr: "clean is required with stash-before-clean",
+		},
+		{
+			name: "proxy known hosts without proxy jump",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.SSHProxyKnownHosts = "bastion.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+				return cfg
+			},
+			wantErr: "ssh-proxy-jump is required with ssh-proxy-known-hosts",
+		},
+		{
+			name: "http version",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.HTTPVersion = "HTTP/1.1"
+				return cfg
+			},
+		},
+		{
+			name: "invalid http version",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.HTTPVersion = "HTTP/3"
+				return cfg
+			},
+			wantErr: "invalid http-version 'HTTP/3'",
+		},
+		{
+			name: "invalid clone filter",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.CloneFilter = "blob:some"
+				return cfg
+			},
+			wantErr: "unsupported clone-filter: 'blob:some'",
+		},
+		{
+			name: "ssh key with git protocol",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Provider = CustomProvider
+				cfg.Repository = "git://git.example.com/org/repo.git"
+				cfg.Token = ""
+				cfg.SSHKey = "key"
+				return cfg
+			},
+			wantErr: "ssh-key cannot be used with the unauthenticated git:// repository",
+		},
+		{
+			name: "path outside workspace",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Path = "../elsewhere"
+				return cfg
+			},
+			wantErr: "is not under",
+		},
+		{
+			name: "worktree",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.WorktreePath = "repo"
+				return cfg
+			},
+		},
+		{
+			name: "worktree with path",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Path = "repo"
+				cfg.WorktreePath = "worktree"
+				return cfg
+			},
+			wantErr: "path cannot be used with worktree",
+		},
+		{
+			name: "worktree is the workspace",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.WorktreePath = "."
+				return cfg
+			},
+			wantErr: "is not a directory under",
+		},
+		{
+			name: "worktree inside the main clone",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.WorktreePath = ".git-main-clone/repo"
+				return cfg
+			},
+			wantErr: "cannot be inside the main clone",
+		},
+		{
+			name: "unsupported submodules",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Submodules = "sometimes"
+				return cfg
+			},
+			wantErr: "unsupported submodules: 'sometimes', expected true/false/recursive",
+		},
+		{
+			name: "missing token",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Token = ""
+				return cfg
+			},
+			wantErr: "input required and not supplied: token",
+		},
+		{
+			name: "github app on another provider",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Provider = GitLabProvider
+				cfg.GitHubAppPrivateKey = "key"
+				return cfg
+			},
+			wantErr: "github-app-private-key is only supported for the github provider",
+		},
+		{
+			name: "github app without ids",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.GitHubAppPrivateKey = "key"
+				return cfg
+			},
+			wantErr: "github-app-id and github-app-installation-id are required with github-app-private-key",
+		},
+		{
+			name: "sha ref",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Ref = sha
+				return cfg
+			},
+			want: func(t *testing.T, cfg Config) {
+				require.Empty(t, cfg.Ref)
+				require.Equal(t, sha, cfg.Commit)
+				require.Equal(t, ".", cfg.Path)
+				require.Equal(t, "https://github.com", cfg.GithubServerURL)
+			},
+		},
+		{
+			name: "sha256 ref",
+			cfg: func() Config {
+				cfg := valid()
+				cfg.Ref = sha + "0123456789abcdef01234567"
+				return cfg
+			},
+			want: func(t *testing.T, cfg Config) {
+				require.Empty(t, cfg.Ref)
+				require.Equal(t, sha+"0123456789abcdef01234567", cfg.Commit)
+			},
+		},
+		{
+			name: "ref from workflow repository event",
+			cfg:  valid,
+			eventContext: map[string]interface{}{
+				"provider":   "github",
+				"repository": "org/repo",
+				"ref":        "main",
+				"sha":        sha,
+			},
+			want: func(t *testing.T, cfg Config) {
+				require.Equal(t, "refs/heads/main", cfg.Ref)
+				require.Equal(t, sha, cfg.Commit)
+			},
+		},
+		{
+			name: "ref not taken from another repository event",
+			cfg:  valid,
+			eventContext: map[string]interface{}{
+				"provider":   "github",
+				"repository": "org/other",
+				"ref":        "refs/heads/main",
+				"sha":        sha,
+			},
+			want: func(t *testing.T, cfg Config) {
+				require.Empty(t, cfg.Ref)
+				require.Empty(t, cfg.Commit)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_SERVER_URL", "")
+			t.Setenv("GITLAB_SERVER_URL", "")
+			switch tt.workspace {
+			case "":
+				t.Setenv("CLOUDBEES_WORKSPACE", t.TempDir())
+			case "-":
+				t.Setenv("CLOUDBEES_WORKSPACE", "")
+				require.NoError(t, os.Unsetenv("CLOUDBEES_WORKSPACE"))
+			default:
+				t.Setenv("CLOUDBEES_WORKSPACE", filepath.Join(t.TempDir(), tt.workspace))
+			}
+
+			eventContext := tt.eventContext
+			if eventContext == nil {
+				eventContext = map[string]interface{}{}
+			}
+
+			cfg := tt.cfg()
+			err := cfg.Validate(eventContext)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want != nil {
+				tt.want(t, cfg)
+			}
+		})
+	}
+}
+
+func Test_validateCloneFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		wantErr bool
+	}{
+		{filter: "blob:none"},
+		{filter: "blob:limit=1024"},
+		{filter: "blob:limit=1m"},
+		{filter: "blob:limit=2G"},
+		{filter: "tree:0"},
+		{filter: "tree:3"},
+		{filter: "sparse:oid=main:.gitfilterspec"},
+		{filter: "sparse:oid=0123456789abcdef0123456789abcdef01234567"},
+		{filter: "", wantErr: true},
+		{filter: "blob:limit=", wantErr: true},
+		{filter: "blob:limit=1t", wantErr: true},
+		{filter: "tree:", wantErr: true},
+		{filter: "tree:-1", wantErr: true},
+		{filter: "sparse:oid=", wantErr: true},
+		{filter: "sparse:path=.gitfilterspec", wantErr: true},
+		{filter: "combine:blob:none+tree:0", wantErr: true},
+		{filter: " blob:none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := validateCloneFilter(tt.filter)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_validateShallowSince(t *testing.T) {
+	tests := []struct {
+		date    string
+		wantErr bool
+	}{
+		{date: "2024-01-31"},
+		{date: "2024-01-31T12:30:00"},
+		{date: "2024-01-31T12:30:00Z"},
+		{date: "2024-01-31T12:30:00+02:00"},
+		{date: "", wantErr: true},
+		{date: "2024-13-01", wantErr: true},
+		{date: "31/01/2024", wantErr: true},
+		{date: "2 weeks ago", wantErr: true},
+		{date: "2024-01-31 12:30:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			err := validateShallowSince(tt.date)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "invalid shallow-since")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_shaRegex(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{s: "0123456789abcdef0123456789abcdef01234567", want: true},
+		{s: "0123456789ABCDEF0123456789ABCDEF01234567", want: true},
+		{s: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", want: true},
+		{s: "0123456789abcdef"},
+		{s: "0123456789abcdef0123456789abcdef012345678"},
+		{s: "0123456789abcdef0123456789abcdef0123456789abcdef"},
+		{s: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0"},
+		{s: "g123456789abcdef0123456789abcdef01234567"},
+		{s: "refs/heads/main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			require.Equal(t, tt.want, shaRegex.MatchString(tt.s))
+		})
+	}
+}
+
+func Test_remapSubmoduleURLs(t *testing.T) {
+	dir := t.TempDir()
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetCwd(dir)
+	cli.SetQuiet(true)
+	cli.SetEnv("GIT_CONFIG_GLOBAL", os.DevNull)
+	cli.SetEnv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, cli.Init(dir))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitmodules"), []byte(`[submodule "lib"]
+	path = lib
+	url = https://github.com/org/lib.git
+[submodule "tools"]
+	path = tools
+	url = https://github.com/org/tools.git
+`), 0644))
+
+	require.NoError(t, remapSubmoduleURLs(cli, map[string]string{
+		"https://github.com/org/lib.git":   "https://mirror.example.com/org/lib.git",
+		"https://github.com/org/other.git": "https://mirror.example.com/org/other.git",
+	}))
+
+	got, err := cli.GetConfig(false, "submodule.lib.url")
+	require.NoError(t, err)
+	require.Equal(t, "https://mirror.example.com/org/lib.git", got)
+	_, err = cli.GetConfig(false, "submodule.tools.url")
+	require.Error(t, err, "unmapped submodules are left to git submodule init")
+}
+
+type fakeFetchResumer struct {
+	exists  bool
+	depth   int // the local history length, 0 when the history is complete
+	updated map[string]string
+}
+
+func (f *fakeFetchResumer) HasObject(sha string) (bool, error) {
+	return f.exists, nil
+}
+
+func (f *fakeFetchResumer) ShallowDepth() (int, error) {
+	if f.depth == 0 {
+		return -1, nil
+	}
+	return 1, nil
+}
+
+func (f *fakeFetchResumer) HistoryLength(rev string) (int, error) {
+	return f.depth, nil
+}
+
+func (f *fakeFetchResumer) UpdateRef(ref string, sha string) error {
+	f.updated[ref] = sha
+	return nil
+}
+
+func Test_resumeFetch(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	refSpec := getRefSpec("refs/heads/main", commit, GitHubProvider)
+	tests := []struct {
+		name        string
+		exists      bool
+		depth       int
+		fetchDepth  int
+		wantSkip    bool
+		wantDeepen  int
+		wantUpdated map[string]string
+	}{
+		{name: "not fetched", fetchDepth: 1, wantUpdated: map[string]string{}},
+		{name: "deep enough", exists: true, depth: 5, fetchDepth: 1, wantSkip: true, wantUpdated: map[string]string{"refs/remotes/origin/main": commit}},
+		{name: "complete history", exists: true, fetchDepth: 0, wantSkip: true, wantUpdated: map[string]string{"refs/remotes/origin/main": commit}},
+		{name: "too shallow", exists: true, depth: 1, fetchDepth: 10, wantDeepen: 9, wantUpdated: map[string]string{}},
+		{name: "all history requested", exists: true, depth: 1, fetchDepth: 0, wantUpdated: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := &fakeFetchResumer{exists: tt.exists, depth: tt.depth, updated: map[string]string{}}
+			skip, deepen, err := resumeFetch(cli, refSpec, commit, tt.fetchDepth)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSkip, skip)
+			require.Equal(t, tt.wantDeepen, deepen)
+			require.Equal(t, tt.wantUpdated, cli.updated)
+		})
+	}
+}
+
+func Test_matchSubmodulePaths(t *testing.T) {
+	submodules := []git.SubmoduleEntry{
+		{Name: "lib", Path: "lib", URL: "https://github.com/org/lib.git"},
+		{Name: "tools", Path: "vendor/tools", URL: "https://github.com/org/tools.git"},
+		{Name: "docs", Path: "third_party/docs", URL: "https://github.com/org/docs.git"},
+	}
+
+	require.Equal(t, []string{"vendor/tools"}, matchSubmodulePaths(submodules, []string{"vendor/*"}))
+	require.Equal(t, []string{"lib", "third_party/docs"}, matchSubmodulePaths(submodules, []string{"third_party/*", "lib"}))
+	require.Empty(t, matchSubmodulePaths(submodules, []string{"missing/*"}))
+}
+
+func Test_runPostCheckoutScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	dir := t.TempDir()
+	t.Setenv("POST_CHECKOUT_TEST", "from-env")
+
+	var stdout, stderr strings.Builder
+	require.NoError(t, runPostCheckoutScript(context.Background(), "", "echo hello && echo $POST_CHECKOUT_TEST && pwd && echo oops >&2", dir, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "hello", lines[0])
+	require.Equal(t, "from-env", lines[1])
+	wd, err := filepath.EvalSymlinks(strings.TrimSpace(lines[2]))
+	require.NoError(t, err)
+	wantDir, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	require.Equal(t, wantDir, wd)
+	require.Equal(t, "oops\n", stderr.String())
+
+	err = runPostCheckoutScript(context.Background(), "sh", "exit 3", dir, &stdout, &stderr)
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitCode())
+}
+
+type fakeRemoteURLUpdater struct {
+	fsckErr   error
+	setURLErr error
+	urls      map[string]string
+}
+
+func (f *fakeRemoteURLUpdater) Fsck(options ...string) (string, error) {
+	return "", f.fsckErr
+}
+
+func (f *fakeRemoteURLUpdater) RemoteSetURL(name string, url string) error {
+	if f.setURLErr != nil {
+		return f.setURLErr
+	}
+	f.urls[name] = url
+	return nil
+}
+
+func Test_updateRemoteURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		cli      *fakeRemoteURLUpdater
+		want     bool
+		wantURLs map[string]string
+	}{
+		{
+			name:     "intact repository",
+			cli:      &fakeRemoteURLUpdater{urls: map[string]string{}},
+			want:     true,
+			wantURLs: map[string]string{"origin": "git@github.com:org/repo.git"},
+		},
+		{
+			name:     "broken repository",
+			cli:      &fakeRemoteURLUpdater{fsckErr: errors.New("missing blob"), urls: map[string]string{}},
+			wantURLs: map[string]string{},
+		},
+		{
+			name:     "set-url fails",
+			cli:      &fakeRemoteURLUpdater{setURLErr: errors.New("locked"), urls: map[string]string{}},
+			wantURLs: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, updateRemoteURL(tt.cli, "origin", "git@github.com:org/repo.git"))
+			require.Equal(t, tt.wantURLs, tt.cli.urls)
+		})
+	}
+}
+
+func Test_prepareExistingDirectory_remoteURLChanged(t *testing.T) {
+	dir := t.TempDir()
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetCwd(dir)
+	cli.SetQuiet(true)
+	cli.SetEnv("GIT_CONFIG_GLOBAL", os.DevNull)
+	cli.SetEnv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, cli.Init(dir))
+	require.NoError(t, cli.RemoteAdd("origin", "https://github.com/org/repo.git"))
+	commit := exec.Command("git", "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--quiet", "--allow-empty", "--message", "initial")
+	commit.Dir = dir
+	commit.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1")
+	require.NoError(t, commit.Run())
+
+	_, err = prepareExistingDirectory(cli, dir, "git@github.com:org/repo.git", false, false, "main", 0)
+	require.NoError(t, err)
+
+	require.DirExists(t, filepath.Join(dir, ".git"), "the repository is kept")
+	url, err := cli.GetRemoteURL("origin")
+	require.NoError(t, err)
+	require.Equal(t, "git@github.com:org/repo.git", url)
+}
+
+func Test_prepareExistingDirectory_conflictingRemoteBranch(t *testing.T) {
+	dir := t.TempDir()
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetCwd(dir)
+	cli.SetQuiet(true)
+	cli.SetEnv("GIT_CONFIG_GLOBAL", os.DevNull)
+	cli.SetEnv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, cli.Init(dir))
+	require.NoError(t, cli.RemoteAdd("origin", "https://github.com/org/repo.git"))
+	commit := exec.Command("git", "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--quiet", "--allow-empty", "--message", "initial")
+	commit.Dir = dir
+	commit.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1")
+	require.NoError(t, commit.Run())
+	for _, ref := range []string{"refs/remotes/origin/Feature", "refs/remotes/origin/other"} {
+		require.NoError(t, cli.UpdateRef(ref, "HEAD"))
+	}
+
+	// a previously fetched origin/Feature conflicts with fetching feature/x on a case-insensitive file system
+	_, err = prepareExistingDirectory(cli, dir, "https://github.com/org/repo.git", false, false, "feature/x", 0)
+	require.NoError(t, err)
+
+	branches, err := cli.BranchList(true, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"origin/other"}, branches)
+}
+
+func TestConfig_Validate_allowedRepositoriesFile(t *testing.T) {
+	workspace := t.TempDir()
+	t.Setenv("CLOUDBEES_WORKSPACE", workspace)
+	t.Setenv("GITHUB_SERVER_URL", "")
+	require.NoError(t, os.WriteFile(filepath.Join(workspace, "allowed.txt"), []byte("# approved hosts\n\ngitlab.example.com/*/*\ngithub.com/org/*\n"), 0644))
+
+	cfg := Config{Provider: GitHubProvider, Repository: "org/repo", Token: "t", Submodules: "false", AllowedRepositoriesFile: "allowed.txt"}
+	require.NoError(t, cfg.Validate(map[string]interface{}{}))
+	require.Empty(t, cfg.AllowedRepositories, "the file patterns are not added to the config")
+
+	// validating again does not accumulate patterns
+	cfg.AllowedRepositories = []string{"example.com/*/*"}
+	require.NoError(t, cfg.Validate(map[string]interface{}{}))
+	require.Equal(t, []string{"example.com/*/*"}, cfg.AllowedRepositories)
+
+	cfg = Config{Provider: GitHubProvider, Repository: "other/repo", Token: "t", Submodules: "false", AllowedRepositoriesFile: "allowed.txt"}
+	require.ErrorContains(t, cfg.Validate(map[string]interface{}{}), "does not match any of the allowed-repositories patterns")
+}
+
+// runFixture is the environment for a full Run against a local origin repository
+type runFixture struct {
+	remote    string
+	workspace string
+	outputs   string
+	bin       string
+}
+
+// newRunFixture creates an origin repository with a single commit on main and points the checkout
+// environment at temporary directories, with no pull request to merge
+func newRunFixture(t *testing.T) *runFixture {
+	f := &runFixture{
+		remote:    t.TempDir(),
+		workspace: t.TempDir(),
+		outputs:   t.TempDir(),
+		bin:       t.TempDir(),
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(f.remote, "README.md"), []byte("readme"), 0644))
+	f.git(t, "init", "--quiet", "--initial-branch=main")
+	f.git(t, "add", "README.md")
+	f.git(t, "commit", "--quiet", "--message", "initial")
+
+	t.Setenv("CLOUDBEES_EVENT_PATH", filepath.Join("testdata", "event.json"))
+	t.Setenv("CLOUDBEES_WORKSPACE", f.workspace)
+	t.Setenv("CLOUDBEES_OUTPUTS", f.outputs)
+	t.Setenv("RUNNER_TEMP", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("PATH", f.bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	f.mergeBinary(t, "exit 0")
+	return f
+}
+
+// git runs git in the origin repository and returns its trimmed output
+func (f *runFixture) git(t *testing.T, args ...string) string {
+	c := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	c.Dir = f.remote
+	c.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1")
+	out, err := c.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// mergeBinary replaces the pull request merge binary with a shell script
+func (f *runFixture) mergeBinary(t *testing.T, script string) {
+	require.NoError(t, os.WriteFile(filepath.Join(f.bin, "cloudbees-git-pr-merge-backfill"), []byte("#!/bin/sh\n"+script+"\n"), 0o755))
+}
+
+// config returns a minimal configuration checking out main from the origin repository
+func (f *runFixture) config() Config {
+	return Config{
+		Provider:   CustomProvider,
+		Repository: f.remote,
+		Ref:        "main",
+		Token:      "token",
+		FetchDepth: 1,
+		Submodules: "false",
+	}
+}
+
+// output returns the content of an action output
+func (f *runFixture) output(t *testing.T, name string) string {
+	content, err := os.ReadFile(filepath.Join(f.outputs, name))
+	require.NoError(t, err, name)
+	return string(content)
+}
+
+func TestConfig_Run_noCheckout(t *testing.T) {
+	f := newRunFixture(t)
+
+	cfg := f.config()
+	cfg.NoCheckout = true
+	cfg.CheckoutPathListOutput = true
+	result, err := cfg.RunWithResult(context.Background())
+	require.NoError(t, err)
+	require.Len(t, result.Commit, 40)
+	require.Equal(t, "", f.output(t, "checked-out-files"))
+
+	for _, name := range []string{"checkout-duration-ms", "fetch-duration-ms", "working-tree-duration-ms", "submodules-duration-ms"} {
+		_, err = strconv.ParseInt(f.output(t, name), 10, 64)
+		require.NoError(t, err, name)
+	}
+
+	require.Equal(t, result.Commit, f.output(t, "commit"))
+
+	entries, err := os.ReadDir(f.workspace)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{".git"}, names, "no working tree files are checked out")
+}
+
+func TestConfig_Run_noCheckoutSubmodules(t *testing.T) {
+	f := newRunFixture(t)
+	f.git(t, "-c", "protocol.file.allow=always", "submodule", "add", "--quiet", f.remote, "lib")
+	f.git(t, "commit", "--quiet", "--message", "add submodule")
+	pinned := f.git(t, "rev-parse", "HEAD:lib")
+
+	cfg := f.config()
+	cfg.NoCheckout = true
+	cfg.Submodules = "true"
+	require.NoError(t, cfg.Run(context.Background()))
+
+	// the submodule is registered at the commit recorded in the tree, without being fetched
+	c := exec.Command("git", "config", "--get", "submodule.lib.url")
+	c.Dir = f.workspace
+	out, err := c.Output()
+	require.NoError(t, err)
+	require.Equal(t, f.remote, strings.TrimSpace(string(out)))
+
+	c = exec.Command("git", "ls-files", "--stage", "lib")
+	c.Dir = f.workspace
+	out, err = c.Output()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "160000 "+pinned)
+
+	require.NoDirExists(t, filepath.Join(f.workspace, "lib"))
+	require.NoDirExists(t, filepath.Join(f.workspace, ".git", "modules"))
+}
+
+func TestConfig_Run_cloneFilter(t *testing.T) {
+	f := newRunFixture(t)
+	f.git(t, "config", "uploadpack.allowFilter", "true")
+
+	cfg := f.config()
+	cfg.CloneFilter = "blob:none"
+	require.NoError(t, cfg.Run(context.Background()))
+
+	for key, want := range map[string]string{
+		"remote.origin.promisor":           "true",
+		"remote.origin.partialclonefilter": "blob:none",
+	} {
+		c := exec.Command("git", "config", "--get", key)
+		c.Dir = f.workspace
+		out, err := c.Output()
+		require.NoError(t, err, key)
+		require.Equal(t, want, strings.TrimSpace(string(out)), key)
+	}
+	c := exec.Command("git", "config", "--get", "core.partialCloneFilter")
+	c.Dir = f.workspace
+	require.Error(t, c.Run(), "git only reads the filter from the remote")
+	require.FileExists(t, filepath.Join(f.workspace, "README.md"), "missing blobs are fetched from the promisor remote")
+}
+
+func TestConfig_Run_postCheckoutScriptFailure(t *testing.T) {
+	f := newRunFixture(t)
+
+	cfg := f.config()
+	cfg.PostCheckoutScript = "exit 3"
+	cfg.PostCheckoutScriptShell = "sh"
+	err := cfg.Run(context.Background())
+	require.ErrorContains(t, err, "running the post-checkout script")
+	var checkoutErr *CheckoutError
+	require.ErrorAs(t, err, &checkoutErr)
+	require.Equal(t, ErrCategoryConfig, checkoutErr.Category)
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitCode())
+}
+
+func TestConfig_Run_defaultBranch(t *testing.T) {
+	f := newRunFixture(t)
+
+	cfg := f.config()
+	cfg.Ref = ""
+	result, err := cfg.RunWithResult(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "refs/heads/main", result.Ref)
+
+	require.Equal(t, "refs/heads/main", f.output(t, "ref"))
+	require.Equal(t, "main", f.output(t, "branch"))
+	require.Equal(t, "", f.output(t, "tag"))
+	require.FileExists(t, filepath.Join(f.outputs, "checkout-duration-ms"), "timings are written by default")
+	require.FileExists(t, filepath.Join(f.outputs, "repository-url"), "the normalised URL is written by default")
+}
+
+func TestConfig_Run_skipTiming(t *testing.T) {
+	f := newRunFixture(t)
+
+	cfg := f.config()
+	cfg.SkipTiming = true
+	require.NoError(t, cfg.Run(context.Background()))
+	require.NoFileExists(t, filepath.Join(f.outputs, "checkout-duration-ms"))
+	require.NoFileExists(t, filepath.Join(f.outputs, "fetch-duration-ms"))
+}
+
+func TestConfig_Run_unqualifiedRef(t *testing.T) {
+	f := newRunFixture(t)
+	f.git(t, "tag", "v1.0.0")
+
+	cfg := f.config()
+	require.NoError(t, cfg.Run(context.Background()))
+	require.Equal(t, "main", f.output(t, "ref"))
+	require.Equal(t, "main", f.output(t, "branch"))
+	require.Equal(t, "", f.output(t, "tag"))
+
+	f = newRunFixture(t)
+	f.git(t, "tag", "v1.0.0")
+	cfg = f.config()
+	cfg.Ref = "v1.0.0"
+	require.NoError(t, cfg.Run(context.Background()))
+	require.Equal(t, "", f.output(t, "branch"))
+	require.Equal(t, "v1.0.0", f.output(t, "tag"))
+}
+
+func TestConfig_Run_sshSetupFailure(t *testing.T) {
+	newRunFixture(t)
+	temp := t.TempDir()
+	t.Setenv("RUNNER_TEMP", temp)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+
+	cfg := Config{
+		Provider:           CustomProvider,
+		Repository:         "git@git.example.com:org/repo.git",
+		Ref:                "main",
+		SSHKey:             string(pem.EncodeToMemory(block)),
+		SSHKnownHosts:      "not a known hosts entry",
+		SSHProxyJump:       "bastion.example.com",
+		Submodules:         "false",
+		PersistCredentials: true,
+	}
+	require.ErrorContains(t, cfg.Run(context.Background()), "setting up ssh known hosts")
+
+	entries, err := os.ReadDir(temp)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NotContains(t, e.Name(), "-", "the ssh files written before the failure are removed: %s", e.Name())
+	}
+}
+
+func TestConfig_Run_worktree(t *testing.T) {
+	f := newRunFixture(t)
+	worktree := filepath.Join(f.workspace, "repo")
+
+	cfg := f.config()
+	cfg.WorktreePath = "repo"
+	cfg.Clean = true
+	result, err := cfg.RunWithResult(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, f.git(t, "rev-parse", "main"), result.Commit)
+	require.FileExists(t, filepath.Join(worktree, "README.md"))
+	require.DirExists(t, filepath.Join(f.workspace, ".git-main-clone"))
+
+	// the worktree is reused, fetching the new commit and cleaning the local changes
+	require.NoError(t, os.WriteFile(filepath.Join(worktree, "untracked.txt"), []byte("untracked"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(worktree, "README.md"), []byte("modified"), 0644))
+	gitDir, err := os.ReadFile(filepath.Join(worktree, ".git"))
+	require.NoError(t, err)
+	f.git(t, "commit", "--quiet", "--allow-empty", "--message", "second")
+
+	cfg = f.config()
+	cfg.WorktreePath = "repo"
+	cfg.Clean = true
+	result, err = cfg.RunWithResult(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, f.git(t, "rev-parse", "main"), result.Commit)
+	reused, err := os.ReadFile(filepath.Join(worktree, ".git"))
+	require.NoError(t, err)
+	require.Equal(t, string(gitDir), string(reused), "the worktree is not recreated")
+	require.NoFileExists(t, filepath.Join(worktree, "untracked.txt"))
+	content, err := os.ReadFile(filepath.Join(worktree, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "readme", string(content))
+}
+
+func TestConfig_Run_worktreePrune(t *testing.T) {
+	f := newRunFixture(t)
+	mainClone := filepath.Join(f.workspace, ".git-main-clone")
+	worktrees := func() string {
+		c := exec.Command("git", "worktree", "list", "--porcelain")
+		c.Dir = mainClone
+		out, err := c.Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	run := func(path string, persistCredentials bool) {
+		cfg := f.config()
+		cfg.WorktreePath = path
+		cfg.PersistCredentials = persistCredentials
+		require.NoError(t, cfg.Run(context.Background()))
+	}
+
+	// another job's worktree whose directory was removed after the job, the repo worktree is then reused, which
+	// does not prune while preparing it
+	run("repo", false)
+	run("other", false)
+	require.NoError(t, os.RemoveAll(filepath.Join(f.workspace, "other")))
+	run("repo", false)
+	require.NotContains(t, worktrees(), filepath.Join(f.workspace, "other"), "the removed worktree is pruned on exit")
+	require.Contains(t, worktrees(), filepath.Join(f.workspace, "repo"))
+
+	// the registrations are kept along with persisted credentials
+	run("other", true)
+	require.NoError(t, os.RemoveAll(filepath.Join(f.workspace, "other")))
+	run("repo", true)
+	require.Contains(t, worktrees(), filepath.Join(f.workspace, "other"))
+}
+
+func TestConfig_Run_extraRefs(t *testing.T) {
+	f := newRunFixture(t)
+	f.git(t, "branch", "release")
+	f.git(t, "commit", "--quiet", "--allow-empty", "--message", "second")
+	f.git(t, "branch", "develop")
+	release := f.git(t, "rev-parse", "release")
+	develop := f.git(t, "rev-parse", "develop")
+
+	cfg := f.config()
+	cfg.ExtraRefs = []string{"refs/heads/release", "develop"}
+	result, err := cfg.RunWithResult(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"refs/heads/release": release,
+		"develop":            develop,
+	}, result.ExtraRefCommits)
+
+	require.Equal(t, "refs/heads/release="+release+"\ndevelop="+develop+"\n", f.output(t, "extra-ref-commits"))
+}
+
+func TestConfig_Run_mergeConflict(t *testing.T) {
+	f := newRunFixture(t)
+	f.mergeBinary(t, "echo '{\"error\": \"conflict\", \"conflicting_files\": [\"go.mod\", \"README.md\"]}'\nexit 1")
+
+	cfg := f.config()
+	cfg.Repository = filepath.Join(t.TempDir(), "repo.git")
+	err := cfg.Run(context.Background())
+	var mergeErr *MergeError
+	require.True(t, errors.As(err, &mergeErr), "unexpected error: %v", err)
+	require.Equal(t, "conflict", mergeErr.Kind)
+	require.Equal(t, []string{"go.mod", "README.md"}, mergeErr.ConflictingFiles)
+
+	require.Equal(t, "go.mod\nREADME.md\n", f.output(t, "merge-conflicts"))
+}
+
+func TestConfig_doLocalMerge_failure(t *testing.T) {
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cli, err := git.NewGitCLI(context.Background())
+	require.NoError(t, err)
+	cli.SetQuiet(true)
+
+	// no description of the failure
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "cloudbees-git-pr-merge-backfill"), []byte("#!/bin/sh\necho 'fatal'\nexit 2\n"), 0o755))
+	cfg := Config{Ref: "main"}
+	_, err = cfg.doLocalMerge(cli, "https://github.com/org/repo.git", "")
+	require.ErrorContains(t, err, "failed to call the merge binary")
+	var mergeErr *MergeError
+	require.False(t, errors.As(err, &mergeErr))
+
+	// a failure other than a conflict
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "cloudbees-git-pr-merge-backfill"), []byte("#!/bin/sh\necho '{\"error\": \"auth\"}'\nexit 1\n"), 0o755))
+	_, err = cfg.doLocalMerge(cli, "https://github.com/org/repo.git", "")
+	require.True(t, errors.As(err, &mergeErr))
+	require.Equal(t, "auth", mergeErr.Kind)
+	require.Empty(t, mergeErr.ConflictingFiles)
+}
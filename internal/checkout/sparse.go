@@ -0,0 +1,82 @@
+package checkout
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// treeLister is the subset of the GitCLI used to expand sparse checkout directories
+type treeLister interface {
+	ListTree(ref string, path string, depth int) ([]string, error)
+}
+
+// sparseCheckouter is the subset of the GitCLI used to set up a sparse checkout
+type sparseCheckouter interface {
+	SparseCheckout(dirs []string) error
+	SparseCheckoutNonConeMode(patterns []string) error
+}
+
+// setupSparseCheckout configures the sparse checkout using either cone mode or non-cone mode, never both
+func setupSparseCheckout(cli sparseCheckouter, patterns []string, coneMode bool) error {
+	if coneMode {
+		return cli.SparseCheckout(patterns)
+	}
+	return cli.SparseCheckoutNonConeMode(patterns)
+}
+
+// expandConePatterns expands each of the supplied directories into the directories found up to depth levels
+// beneath it in the tree of ref. Each directory contributes the directories at exactly depth levels together with
+// any shallower directories that have no subdirectories, which is the full set of cone-mode patterns for the tree.
+func expandConePatterns(cli treeLister, ref string, dirs []string, depth int) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, dir := range dirs {
+		dir = strings.Trim(strings.TrimSpace(dir), "/")
+		if dir == "" {
+			continue
+		}
+
+		subdirs, err := cli.ListTree(ref, dir, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(subdirs) == 0 {
+			seen[dir] = struct{}{}
+			continue
+		}
+
+		parents := make(map[string]struct{}, len(subdirs))
+		for _, d := range subdirs {
+			if i := strings.LastIndex(d, "/"); i >= 0 {
+				parents[d[:i]] = struct{}{}
+			}
+		}
+
+		for _, d := range subdirs {
+			if _, isParent := parents[d]; !isParent {
+				seen[d] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(seen))
+	for d := range seen {
+		result = append(result, d)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// loadSparsePatterns reads the sparse checkout patterns from the file at path, one pattern per line. Blank lines and
+// lines starting with # are ignored.
+func loadSparsePatterns(path string) ([]string, error) {
+	patterns, err := readPatternFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no sparse checkout patterns found in '%s'", path)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,127 @@
+package checkout
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTreeLister struct {
+	dirs []string
+}
+
+func (f *fakeTreeLister) ListTree(ref string, path string, depth int) ([]string, error) {
+	var result []string
+	for _, d := range f.dirs {
+		if !strings.HasPrefix(d, path+"/") {
+			continue
+		}
+		if strings.Count(strings.TrimPrefix(d, path+"/"), "/") < depth {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func Test_expandConePatterns(t *testing.T) {
+	cli := &fakeTreeLister{dirs: []string{
+		"docs",
+		"src",
+		"src/api",
+		"src/api/v1",
+		"src/api/v1/internal",
+		"src/api/v2",
+		"src/cli",
+		"src/web",
+		"src/web/assets",
+	}}
+	tests := []struct {
+		name  string
+		dirs  []string
+		depth int
+		want  []string
+	}{
+		{
+			name:  "leaf",
+			dirs:  []string{"docs"},
+			depth: 2,
+			want:  []string{"docs"},
+		},
+		{
+			name:  "one-level",
+			dirs:  []string{"src"},
+			depth: 1,
+			want:  []string{"src/api", "src/cli", "src/web"},
+		},
+		{
+			name:  "two-levels",
+			dirs:  []string{"src"},
+			depth: 2,
+			want:  []string{"src/api/v1", "src/api/v2", "src/cli", "src/web/assets"},
+		},
+		{
+			name:  "multiple-with-blanks-and-slashes",
+			dirs:  []string{"/docs/", "", "  ", "src/web"},
+			depth: 3,
+			want:  []string{"docs", "src/web/assets"},
+		},
+		{
+			name:  "duplicates",
+			dirs:  []string{"src/api", "src/api/v2"},
+			depth: 1,
+			want:  []string{"src/api/v1", "src/api/v2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandConePatterns(cli, "HEAD", tt.dirs, tt.depth)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+type recordingSparseCheckouter struct {
+	calls []string
+}
+
+func (r *recordingSparseCheckouter) SparseCheckout(dirs []string) error {
+	r.calls = append(r.calls, "cone:"+strings.Join(dirs, ","))
+	return nil
+}
+
+func (r *recordingSparseCheckouter) SparseCheckoutNonConeMode(patterns []string) error {
+	r.calls = append(r.calls, "non-cone:"+strings.Join(patterns, ","))
+	return nil
+}
+
+func Test_setupSparseCheckout(t *testing.T) {
+	cone := &recordingSparseCheckouter{}
+	require.NoError(t, setupSparseCheckout(cone, []string{"src", "docs"}, true))
+	require.Equal(t, []string{"cone:src,docs"}, cone.calls)
+
+	nonCone := &recordingSparseCheckouter{}
+	require.NoError(t, setupSparseCheckout(nonCone, []string{"/*", "!/docs/"}, false))
+	require.Equal(t, []string{"non-cone:/*,!/docs/"}, nonCone.calls)
+}
+
+func Test_loadSparsePatterns(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, ".sparse-paths")
+	require.NoError(t, os.WriteFile(path, []byte("# services\nsrc/api\n\n  src/web  \r\n# shared code\nlibs/common\n\n"), 0644))
+	patterns, err := loadSparsePatterns(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"src/api", "src/web", "libs/common"}, patterns)
+
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(empty, []byte("# nothing\n\n"), 0644))
+	_, err = loadSparsePatterns(empty)
+	require.ErrorContains(t, err, "no sparse checkout patterns found")
+
+	_, err = loadSparsePatterns(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
@@ -3,6 +3,10 @@ package checkout
 import (
 	"fmt"
 	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cloudbees-io/checkout/internal/git"
 )
 
 func (cfg *Config) serverURL() string {
@@ -30,7 +34,7 @@ func (cfg *Config) fetchURL(ssh bool) (string, error) {
 	case GitLabProvider:
 		return cfg.gitlabCloneUrl(ssh)
 	case CustomProvider:
-		return cfg.Repository, nil
+		return normalizeRepositoryURL(cfg.Repository)
 	default:
 		return "", fmt.Errorf("unknown/unsupported SCM Provider: %s", p)
 	}
@@ -72,3 +76,196 @@ func (cfg *Config) gitlabCloneUrl(ssh bool) (string, error) {
 	}
 	return "git@" + clone.Hostname() + ":" + clone.Path, nil
 }
+
+const (
+	azureDevOpsHost    = "dev.azure.com"
+	azureDevOpsSSHHost = "ssh.dev.azure.com"
+)
+
+// normalizeRepositoryURL returns the canonical form of a custom provider repository URL
+func normalizeRepositoryURL(s string) (string, error) {
+	if isAzureDevOpsURL(s) {
+		return normalizeAzureDevOpsURL(s)
+	}
+	if isGitProtocolURL(s) {
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return "", fmt.Errorf("invalid repository URL '%s', expects full clone URL", s)
+		}
+		return s, nil
+	}
+	return s, nil
+}
+
+// isGitProtocolURL returns true for URLs using the unauthenticated git:// protocol
+func isGitProtocolURL(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "git://")
+}
+
+// isAzureDevOpsURL returns true for Azure DevOps HTTPS and SSH clone URLs
+func isAzureDevOpsURL(s string) bool {
+	if strings.HasPrefix(strings.ToLower(s), "git@"+azureDevOpsSSHHost+":") {
+		return true
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == azureDevOpsHost || host == azureDevOpsSSHHost
+}
+
+// normalizeAzureDevOpsURL converts the SCP style SSH form git@ssh.dev.azure.com:v3/org/project/repo to
+// ssh://git@ssh.dev.azure.com/v3/org/project/repo and removes the org@ user from the HTTPS form
+// https://org@dev.azure.com/org/project/_git/repo as the token is supplied separately
+func normalizeAzureDevOpsURL(s string) (string, error) {
+	org, project, repo, ssh, err := parseAzureDevOpsURL(s)
+	if err != nil {
+		return "", err
+	}
+	if ssh {
+		return "ssh://git@" + azureDevOpsSSHHost + "/v3/" + org + "/" + project + "/" + repo, nil
+	}
+	return "https://" + azureDevOpsHost + "/" + org + "/" + project + "/_git/" + repo, nil
+}
+
+// parseAzureDevOpsURL splits an Azure DevOps clone URL into its organization, project and repository
+func parseAzureDevOpsURL(s string) (org string, project string, repo string, ssh bool, err error) {
+	var segments []string
+	if strings.HasPrefix(strings.ToLower(s), "git@"+azureDevOpsSSHHost+":") {
+		ssh = true
+		segments = strings.Split(s[len("git@"+azureDevOpsSSHHost+":"):], "/")
+	} else {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", "", false, err
+		}
+		ssh = u.Scheme == "ssh"
+		segments = strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	}
+
+	if ssh {
+		// v3/{org}/{project}/{repo}
+		if len(segments) != 4 || segments[0] != "v3" {
+			return "", "", "", false, fmt.Errorf("invalid Azure DevOps SSH URL '%s', expected format git@%s:v3/{org}/{project}/{repo}", s, azureDevOpsSSHHost)
+		}
+		segments = segments[1:]
+	} else {
+		// {org}/{project}/_git/{repo}
+		if len(segments) != 4 || segments[2] != "_git" {
+			return "", "", "", false, fmt.Errorf("invalid Azure DevOps URL '%s', expected format https://%s/{org}/{project}/_git/{repo}", s, azureDevOpsHost)
+		}
+		segments = []string{segments[0], segments[1], segments[3]}
+	}
+
+	for _, segment := range segments {
+		if segment == "" {
+			return "", "", "", false, fmt.Errorf("invalid Azure DevOps URL '%s', organization, project and repository are required", s)
+		}
+	}
+
+	return segments[0], segments[1], segments[2], ssh, nil
+}
+
+// sameAzureDevOpsRepository returns true when both URLs refer to the same Azure DevOps repository,
+// irrespective of whether they use the SSH or HTTPS form
+func sameAzureDevOpsRepository(a string, b string) bool {
+	aOrg, aProject, aRepo, _, err := parseAzureDevOpsURL(a)
+	if err != nil {
+		return false
+	}
+	bOrg, bProject, bRepo, _, err := parseAzureDevOpsURL(b)
+	if err != nil {
+		return false
+	}
+	// organization, project and repository names are case-insensitive in Azure DevOps
+	return strings.EqualFold(aOrg, bOrg) && strings.EqualFold(aProject, bProject) && strings.EqualFold(aRepo, bRepo)
+}
+
+// detectProvider returns the provider hosting repoURL, inferred from the host name. Self-hosted instances
+// are only recognised when their host name includes the product name, otherwise CustomProvider is returned.
+func detectProvider(repoURL string) string {
+	var host string
+	if u, err := url.Parse(repoURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if at, colon := strings.Index(repoURL, "@"), strings.Index(repoURL, ":"); at >= 0 && colon > at {
+		// SCP style git@host:owner/repo
+		host = repoURL[at+1 : colon]
+	}
+	host = strings.ToLower(host)
+
+	switch {
+	case host == "":
+		return CustomProvider
+	case host == "github.com" || strings.HasSuffix(host, ".ghe.com"):
+		return GitHubProvider
+	case host == "gitlab.com" || strings.Contains(host, "gitlab"):
+		return GitLabProvider
+	case host == "bitbucket.org" || strings.Contains(host, "bitbucket"):
+		return BitbucketProvider
+	case host == "codeberg.org" || strings.Contains(host, "gitea") || strings.Contains(host, "forgejo"):
+		return GiteaProvider
+	default:
+		return CustomProvider
+	}
+}
+
+// normalizeGiteaURL lowercases the host and removes any trailing .git so that the forms of a Gitea or Forgejo
+// repository URL used by clone URLs and the Gitea API compare equal
+func normalizeGiteaURL(s string) string {
+	return normalizeURLForComparison(strings.TrimSuffix(strings.TrimSuffix(s, "/"), ".git"))
+}
+
+// normalizeURLForComparison lowercases the scheme and host of a repository URL, leaving the case sensitive path as
+// is. Values that are not URLs, such as {owner}/{repo}, are returned unchanged.
+func normalizeURLForComparison(s string) string {
+	if git.IsSSHURL(s) && !strings.Contains(s, "://") {
+		// user@host:path
+		at := strings.Index(s, "@")
+		colon := strings.Index(s, ":")
+		return s[:at+1] + strings.ToLower(s[at+1:colon]) + s[colon:]
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// repositoryHostPath returns the lower-cased host and the path, without any .git suffix, of a clone URL. For example
+// both https://github.com/org/repo.git and git@github.com:org/repo.git become github.com/org/repo.
+func repositoryHostPath(cloneURL string) (string, error) {
+	var host, p string
+	if u, err := url.Parse(cloneURL); err == nil && u.Scheme != "" && u.Host != "" {
+		host, p = u.Hostname(), u.Path
+	} else if at, colon := strings.Index(cloneURL, "@"), strings.Index(cloneURL, ":"); at > 0 && colon > at {
+		// SCP style user@host:path
+		host, p = cloneURL[at+1:colon], cloneURL[colon+1:]
+	} else {
+		return "", fmt.Errorf("cannot determine the host of repository URL '%s'", cloneURL)
+	}
+	return strings.ToLower(host) + "/" + strings.TrimSuffix(strings.Trim(p, "/"), ".git"), nil
+}
+
+// checkAllowedRepository returns an error unless the host and path of the clone URL match at least one of the
+// path.Match patterns, ignoring case, all URLs are allowed when there are no patterns
+func checkAllowedRepository(cloneURL string, patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	hostPath, err := repositoryHostPath(cloneURL)
+	if err != nil {
+		return err
+	}
+	lowerHostPath := strings.ToLower(hostPath)
+	for _, pattern := range patterns {
+		if matched, err := path.Match(strings.ToLower(pattern), lowerHostPath); err != nil {
+			return fmt.Errorf("invalid allowed-repositories pattern: '%s': %w", pattern, err)
+		} else if matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("repository '%s' does not match any of the allowed-repositories patterns", hostPath)
+}
@@ -0,0 +1,316 @@
+package checkout
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isAzureDevOpsURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "git@ssh.dev.azure.com:v3/org/project/repo", want: true},
+		{url: "ssh://git@ssh.dev.azure.com/v3/org/project/repo", want: true},
+		{url: "https://org@dev.azure.com/org/project/_git/repo", want: true},
+		{url: "https://dev.azure.com/org/project/_git/repo", want: true},
+		{url: "https://DEV.AZURE.COM/org/project/_git/repo", want: true},
+		{url: "git@github.com:org/repo.git", want: false},
+		{url: "https://github.com/org/repo.git", want: false},
+		{url: "https://dev.azure.com.example.com/org/project/_git/repo", want: false},
+		{url: "org/repo", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			require.Equal(t, tt.want, isAzureDevOpsURL(tt.url))
+		})
+	}
+}
+
+func Test_normalizeRepositoryURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "azure scp ssh",
+			url:  "git@ssh.dev.azure.com:v3/org/project/repo",
+			want: "ssh://git@ssh.dev.azure.com/v3/org/project/repo",
+		},
+		{
+			name: "azure ssh",
+			url:  "ssh://git@ssh.dev.azure.com/v3/org/project/repo",
+			want: "ssh://git@ssh.dev.azure.com/v3/org/project/repo",
+		},
+		{
+			name: "azure https with user",
+			url:  "https://org@dev.azure.com/org/project/_git/repo",
+			want: "https://dev.azure.com/org/project/_git/repo",
+		},
+		{
+			name: "azure https",
+			url:  "https://dev.azure.com/org/my%20project/_git/repo",
+			want: "https://dev.azure.com/org/my%20project/_git/repo",
+		},
+		{
+			name:    "azure ssh missing v3",
+			url:     "git@ssh.dev.azure.com:org/project/repo",
+			wantErr: true,
+		},
+		{
+			name:    "azure https missing _git",
+			url:     "https://dev.azure.com/org/project/repo",
+			wantErr: true,
+		},
+		{
+			name:    "azure https empty project",
+			url:     "https://dev.azure.com/org//_git/repo",
+			wantErr: true,
+		},
+		{
+			name: "other scp ssh",
+			url:  "git@github.com:org/repo.git",
+			want: "git@github.com:org/repo.git",
+		},
+		{
+			name: "other https",
+			url:  "https://user@git.example.com/org/repo.git",
+			want: "https://user@git.example.com/org/repo.git",
+		},
+		{
+			name: "git protocol",
+			url:  "git://git.example.com/org/repo.git",
+			want: "git://git.example.com/org/repo.git",
+		},
+		{
+			name: "git protocol with port",
+			url:  "git://git.example.com:9418/org/repo.git",
+			want: "git://git.example.com:9418/org/repo.git",
+		},
+		{
+			name:    "git protocol without host",
+			url:     "git:///org/repo.git",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeRepositoryURL(tt.url)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_detectProvider(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://github.com/owner/repo.git", want: GitHubProvider},
+		{url: "git@github.com:owner/repo.git", want: GitHubProvider},
+		{url: "https://gitlab.com/group/sub/repo", want: GitLabProvider},
+		{url: "https://gitlab.example.com/group/repo.git", want: GitLabProvider},
+		{url: "https://bitbucket.org/owner/repo.git", want: BitbucketProvider},
+		{url: "https://gitea.example.com/owner/repo", want: GiteaProvider},
+		{url: "https://Gitea.Example.com/owner/repo.git", want: GiteaProvider},
+		{url: "git@forgejo.example.com:owner/repo.git", want: GiteaProvider},
+		{url: "https://codeberg.org/owner/repo", want: GiteaProvider},
+		{url: "https://git.example.com/owner/repo.git", want: CustomProvider},
+		{url: "owner/repo", want: CustomProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			require.Equal(t, tt.want, detectProvider(tt.url))
+		})
+	}
+}
+
+func Test_normalizeGiteaURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://gitea.example.com/owner/repo", want: "https://gitea.example.com/owner/repo"},
+		{url: "https://gitea.example.com/owner/repo.git", want: "https://gitea.example.com/owner/repo"},
+		{url: "https://GITEA.example.com/owner/repo.git/", want: "https://gitea.example.com/owner/repo"},
+		{url: "https://gitea.example.com/Owner/Repo", want: "https://gitea.example.com/Owner/Repo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			require.Equal(t, tt.want, normalizeGiteaURL(tt.url))
+		})
+	}
+}
+
+func Test_normalizeURLForComparison(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://GITHUB.COM/org/repo.git", want: "https://github.com/org/repo.git"},
+		{url: "HTTPS://GitHub.com/org/repo.git", want: "https://github.com/org/repo.git"},
+		{url: "https://github.com/Org/Repo.git", want: "https://github.com/Org/Repo.git"},
+		{url: "git@GitHub.com:Org/Repo.git", want: "git@github.com:Org/Repo.git"},
+		{url: "Org/Repo", want: "Org/Repo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			require.Equal(t, tt.want, normalizeURLForComparison(tt.url))
+		})
+	}
+}
+
+func TestConfig_isWorkflowRepository(t *testing.T) {
+	tests := []struct {
+		name         string
+		provider     string
+		repository   string
+		eventContext map[string]interface{}
+		want         bool
+	}{
+		{
+			name:         "github match",
+			provider:     GitHubProvider,
+			repository:   "org/repo",
+			eventContext: map[string]interface{}{"provider": "GitHub", "repository": "org/repo"},
+			want:         true,
+		},
+		{
+			name:         "github different repository",
+			provider:     GitHubProvider,
+			repository:   "org/repo",
+			eventContext: map[string]interface{}{"provider": "github", "repository": "org/other"},
+			want:         false,
+		},
+		{
+			name:         "custom uppercase host",
+			provider:     CustomProvider,
+			repository:   "https://git.example.com/Org/Repo.git",
+			eventContext: map[string]interface{}{"provider": "custom", "repository": "HTTPS://GIT.EXAMPLE.COM/Org/Repo.git"},
+			want:         true,
+		},
+		{
+			name:         "custom path case differs",
+			provider:     CustomProvider,
+			repository:   "https://git.example.com/org/repo.git",
+			eventContext: map[string]interface{}{"provider": "custom", "repository": "https://git.example.com/Org/Repo.git"},
+			want:         false,
+		},
+		{
+			name:         "different provider",
+			provider:     GitLabProvider,
+			repository:   "org/repo",
+			eventContext: map[string]interface{}{"provider": "github", "repository": "org/repo"},
+			want:         false,
+		},
+		{
+			name:       "azure ssh against https repositoryUrl",
+			provider:   CustomProvider,
+			repository: "git@ssh.dev.azure.com:v3/org/project/repo",
+			eventContext: map[string]interface{}{
+				"provider":      "custom",
+				"repository":    "project/repo",
+				"repositoryUrl": "https://org@dev.azure.com/org/project/_git/repo",
+			},
+			want: true,
+		},
+		{
+			name:       "azure case-insensitive",
+			provider:   CustomProvider,
+			repository: "https://dev.azure.com/Org/Project/_git/Repo",
+			eventContext: map[string]interface{}{
+				"provider":   "custom",
+				"repository": "https://org@dev.azure.com/org/project/_git/repo",
+			},
+			want: true,
+		},
+		{
+			name:       "azure different repository",
+			provider:   CustomProvider,
+			repository: "https://dev.azure.com/org/project/_git/repo",
+			eventContext: map[string]interface{}{
+				"provider":      "custom",
+				"repositoryUrl": "https://dev.azure.com/org/project/_git/other",
+			},
+			want: false,
+		},
+		{
+			name:       "gitea with .git against repositoryUrl without",
+			provider:   CustomProvider,
+			repository: "https://gitea.example.com/owner/repo.git",
+			eventContext: map[string]interface{}{
+				"provider":      "custom",
+				"repository":    "owner/repo",
+				"repositoryUrl": "https://Gitea.Example.com/owner/repo",
+			},
+			want: true,
+		},
+		{
+			name:       "gitea without .git against repository with",
+			provider:   CustomProvider,
+			repository: "https://gitea.example.com/owner/repo",
+			eventContext: map[string]interface{}{
+				"provider":   "custom",
+				"repository": "https://gitea.example.com/owner/repo.git",
+			},
+			want: true,
+		},
+		{
+			name:       "gitea different repository",
+			provider:   CustomProvider,
+			repository: "https://gitea.example.com/owner/repo.git",
+			eventContext: map[string]interface{}{
+				"provider":      "custom",
+				"repositoryUrl": "https://gitea.example.com/owner/other",
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Provider: tt.provider, Repository: tt.repository}
+			require.Equal(t, tt.want, cfg.isWorkflowRepository(tt.eventContext))
+		})
+	}
+}
+
+func Test_checkAllowedRepository(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		patterns []string
+		wantErr  string
+	}{
+		{name: "no patterns", url: "https://example.com/any/repo.git"},
+		{name: "https", url: "https://github.com/org/repo.git", patterns: []string{"github.com/org/*"}},
+		{name: "scp style ssh", url: "git@github.com:org/repo.git", patterns: []string{"github.com/org/*"}},
+		{name: "ssh url with port", url: "ssh://git@git.example.com:2222/team/repo.git", patterns: []string{"git.example.com/team/repo"}},
+		{name: "subdomain wildcard", url: "https://scm.corp.example.com/team/repo", patterns: []string{"*.example.com/*/*"}},
+		{name: "case insensitive host", url: "https://GitHub.com/org/repo.git", patterns: []string{"github.com/org/repo"}},
+		{name: "case insensitive path", url: "https://github.com/Org/Repo.git", patterns: []string{"github.com/org/repo"}},
+		{name: "case insensitive pattern", url: "https://github.com/org/repo.git", patterns: []string{"GitHub.com/Org/*"}},
+		{name: "any pattern matches", url: "https://gitlab.com/group/repo.git", patterns: []string{"github.com/*/*", "gitlab.com/group/*"}},
+		{name: "wildcard does not cross path segments", url: "https://gitlab.com/group/sub/repo.git", patterns: []string{"gitlab.com/group/*"}, wantErr: "repository 'gitlab.com/group/sub/repo' does not match"},
+		{name: "other host", url: "https://evil.example.org/org/repo.git", patterns: []string{"github.com/*/*"}, wantErr: "repository 'evil.example.org/org/repo' does not match"},
+		{name: "invalid pattern", url: "https://github.com/org/repo.git", patterns: []string{"github.com/[org"}, wantErr: "invalid allowed-repositories pattern"},
+		{name: "relative path", url: "org/repo", patterns: []string{"*"}, wantErr: "cannot determine the host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAllowedRepository(tt.url, tt.patterns)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -3,19 +3,78 @@ package core
 import (
 	"fmt"
 	"os"
+	"sync"
+	"time"
 )
 
+// LogEntry is a log message captured while recording is enabled
+type LogEntry struct {
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var (
+	recordLock sync.Mutex
+	recording  bool
+	recorded   []LogEntry
+)
+
+// StartRecording suppresses console output, capturing log messages until StopRecording is called
+func StartRecording() {
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	recording = true
+	recorded = nil
+}
+
+// StopRecording restores console output and returns the log messages captured since StartRecording
+func StopRecording() []LogEntry {
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	recording = false
+	entries := recorded
+	recorded = nil
+	return entries
+}
+
+// Recording returns true while log messages are being captured rather than written to the console
+func Recording() bool {
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	return recording
+}
+
+func logMessage(level string, prefix string, message string) {
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	if recording {
+		recorded = append(recorded, LogEntry{Level: level, Message: message, Timestamp: time.Now()})
+		return
+	}
+	fmt.Println(prefix + message)
+}
+
 func StartGroup(message string) {
-	fmt.Println("🔄 " + message)
+	logMessage("group", "🔄 ", message)
 }
 
 func EndGroup(message string) {
-	fmt.Println("✅ " + message)
+	logMessage("info", "✅ ", message)
+}
+
+func Info(msg string, args ...any) {
+	logMessage("info", "", fmt.Sprintf(msg, args...))
+}
+
+// IsDebug returns true when debug logging is enabled, to skip work that only produces debug messages
+func IsDebug() bool {
+	return os.Getenv("RUNNER_DEBUG") == "1"
 }
 
 func Debug(msg string, args ...any) {
-	if os.Getenv("RUNNER_DEBUG") == "1" {
-		fmt.Println("##[debug]" + fmt.Sprintf(msg, args...))
+	if IsDebug() {
+		logMessage("debug", "##[debug]", fmt.Sprintf(msg, args...))
 	}
 }
 
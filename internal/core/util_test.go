@@ -0,0 +1,35 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecording(t *testing.T) {
+	t.Setenv("RUNNER_DEBUG", "1")
+
+	require.False(t, Recording())
+	StartRecording()
+	require.True(t, Recording())
+
+	StartGroup("Fetching")
+	Info("fetched %d refs", 3)
+	Debug("exit %d", 0)
+	EndGroup("Fetched")
+
+	entries := StopRecording()
+	require.False(t, Recording())
+	require.Len(t, entries, 4)
+
+	var levels, messages []string
+	for _, e := range entries {
+		require.False(t, e.Timestamp.IsZero())
+		levels = append(levels, e.Level)
+		messages = append(messages, e.Message)
+	}
+	require.Equal(t, []string{"group", "info", "debug", "info"}, levels)
+	require.Equal(t, []string{"Fetching", "fetched 3 refs", "exit 0", "Fetched"}, messages)
+
+	require.Empty(t, StopRecording())
+}
@@ -3,26 +3,101 @@ package git
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudbees-io/checkout/internal/core"
 )
 
 // GitCLI maintains a context for interacting with the Git command line executable.
 type GitCLI struct {
-	ctx   context.Context
-	exe   string
-	env   map[string]string
-	cwd   string
-	quiet bool
-	log   bool
+	ctx     context.Context
+	exe     string
+	env     map[string]string
+	cwd     string
+	quiet   bool
+	log     bool
+	dryRun  bool
+	masks   []string
+	audit   *auditLog
+	config  *configInjector
+	version GitVersion
+	cancel  context.CancelFunc
+
+	// the cache is shared with copies made by WithTimeout, so it is held by reference
+	cacheMu            *sync.RWMutex
+	defaultBranchCache map[string]string
+}
+
+// defaultMaxConfigEntries is the default limit on the number of config entries injected via environment variables
+const defaultMaxConfigEntries = 200
+
+// configInjector tracks the config entries passed to git commands through the GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n>
+// and GIT_CONFIG_VALUE_<n> environment variables.
+type configInjector struct {
+	// MaxConfigEntries is the maximum number of entries, including any inherited from the environment, that can be
+	// injected into a command
+	MaxConfigEntries int
+	keys             []string
+	values           []string
+}
+
+func newConfigInjector() *configInjector {
+	return &configInjector{MaxConfigEntries: defaultMaxConfigEntries}
+}
+
+// add queues a config entry for injection into subsequent commands
+func (ci *configInjector) add(key string, value string) error {
+	if len(ci.keys) >= ci.MaxConfigEntries {
+		return fmt.Errorf("cannot inject git config '%s': would exceed the maximum of %d config entries", key, ci.MaxConfigEntries)
+	}
+	ci.keys = append(ci.keys, key)
+	ci.values = append(ci.values, value)
+	return nil
+}
+
+// apply returns a copy of env with the queued config entries numbered after any entries already present in env
+func (ci *configInjector) apply(env map[string]string) (map[string]string, error) {
+	if ci == nil || len(ci.keys) == 0 {
+		return env, nil
+	}
+
+	inherited := 0
+	if c, found := env["GIT_CONFIG_COUNT"]; found && c != "" {
+		var err error
+		if inherited, err = strconv.Atoi(c); err != nil || inherited < 0 {
+			return nil, fmt.Errorf("invalid GIT_CONFIG_COUNT '%s' in environment", c)
+		}
+	}
+
+	total := inherited + len(ci.keys)
+	if total > ci.MaxConfigEntries {
+		return nil, fmt.Errorf("too many git config entries: %d exceeds the maximum of %d", total, ci.MaxConfigEntries)
+	}
+
+	r := make(map[string]string, len(env)+2*len(ci.keys)+1)
+	for k, v := range env {
+		r[k] = v
+	}
+	for i := range ci.keys {
+		r[fmt.Sprintf("GIT_CONFIG_KEY_%d", inherited+i)] = ci.keys[i]
+		r[fmt.Sprintf("GIT_CONFIG_VALUE_%d", inherited+i)] = ci.values[i]
+	}
+	r["GIT_CONFIG_COUNT"] = strconv.Itoa(total)
+	return r, nil
 }
 
 // NewGitCLI creates a new GitCLI instance
@@ -36,12 +111,31 @@ func NewGitCLI(ctx context.Context) (*GitCLI, error) {
 		}
 	}
 
+	output, err := exec.CommandContext(ctx, exe, "version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine git version: %w", err)
+	}
+	version, err := parseGitVersion(string(output))
+	if err != nil {
+		return nil, err
+	}
+	minimum, _ := parseGitVersion("git version " + minimumGitVersion)
+	if !version.AtLeast(minimum) {
+		return nil, fmt.Errorf("git version %s is not supported, minimum required version is %s", version, minimumGitVersion)
+	}
+	core.Debug("git version = %s", version)
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, err
 	}
 	env := os.Environ()
-	return &GitCLI{ctx: ctx, exe: exe, env: envEntriesToMap(env), cwd: cwd, quiet: false, log: true}, nil
+	return &GitCLI{ctx: ctx, exe: exe, env: envEntriesToMap(env), cwd: cwd, quiet: false, log: true, config: newConfigInjector(), version: version, cacheMu: &sync.RWMutex{}, defaultBranchCache: map[string]string{}}, nil
+}
+
+// Version returns the version of the Git command line executable
+func (g *GitCLI) Version() GitVersion {
+	return g.version
 }
 
 // SetEnv sets the environment variable for the GitCLI
@@ -49,6 +143,41 @@ func (g *GitCLI) SetEnv(key string, val string) {
 	g.env[key] = val
 }
 
+// SetEnvBool sets an environment variable for all subsequent git commands to 1 or 0
+func (g *GitCLI) SetEnvBool(key string, val bool) {
+	if val {
+		g.SetEnv(key, "1")
+	} else {
+		g.SetEnv(key, "0")
+	}
+}
+
+// InjectConfig injects a config entry into all subsequent git commands via environment variables, without
+// modifying any config file
+func (g *GitCLI) InjectConfig(key string, val string) error {
+	if g.config == nil {
+		g.config = newConfigInjector()
+	}
+	return g.config.add(key, val)
+}
+
+// SetMaxConfigEntries sets the maximum number of config entries that can be injected into a git command
+func (g *GitCLI) SetMaxConfigEntries(max int) {
+	if g.config == nil {
+		g.config = newConfigInjector()
+	}
+	g.config.MaxConfigEntries = max
+}
+
+// environ returns the environment entries for a git command
+func (g *GitCLI) environ() ([]string, error) {
+	env, err := g.config.apply(g.env)
+	if err != nil {
+		return nil, err
+	}
+	return envMapToEntries(env), nil
+}
+
 // SetCwd sets the current working directory used by the GitCLI
 func (g *GitCLI) SetCwd(cwd string) {
 	g.cwd = cwd
@@ -59,6 +188,183 @@ func (g *GitCLI) Cwd() string {
 	return g.cwd
 }
 
+// WithTimeout returns a copy of the GitCLI where every command must complete within the supplied duration. The
+// receiver is not modified, so the timeout only applies to commands run through the returned copy, e.g.
+// cli.WithTimeout(5*time.Minute).Fetch(...). The copy holds a timer until the deadline passes, so callers should
+// Close it once they are done with it.
+func (g *GitCLI) WithTimeout(d time.Duration) *GitCLI {
+	c := *g
+	c.ctx, c.cancel = context.WithTimeout(g.ctx, d)
+	return &c
+}
+
+// Close releases the timer held by a copy returned from WithTimeout, cancelling any command still running through
+// it. It is a no-op for a GitCLI that was not created by WithTimeout.
+func (g *GitCLI) Close() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+}
+
+// WaitForIndexLock waits up to the timeout, polling every 100ms, for the .git/index.lock of the repository to be
+// released by another git process, and then removes the lock if it is still present, assuming it was left behind
+// by a process that was killed
+func (g *GitCLI) WaitForIndexLock(timeout time.Duration) error {
+	lockPath := filepath.Join(g.cwd, ".git", "index.lock")
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(lockPath); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-g.ctx.Done():
+			return g.ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	core.Info("Removing '%s' which has been held for longer than %s", lockPath, timeout)
+	if err := os.Remove(lockPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// contextErr wraps the error from a command with the context error if the command was terminated because the
+// context was cancelled or its deadline exceeded
+func (g *GitCLI) contextErr(err error) error {
+	if err != nil && g.ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", g.ctx.Err(), err)
+	}
+	return err
+}
+
+// SetQuiet controls whether the output of git commands is suppressed. When quiet, the commands are only logged as
+// debug messages.
+func (g *GitCLI) SetQuiet(quiet bool) {
+	g.quiet = quiet
+}
+
+// SetDryRun controls whether git commands are executed. When dry run is enabled, the commands are logged and
+// report success with empty output.
+func (g *GitCLI) SetDryRun(dryRun bool) {
+	g.dryRun = dryRun
+}
+
+// AddMask registers a secret that is replaced with *** when git commands are logged
+func (g *GitCLI) AddMask(secret string) {
+	if secret != "" {
+		g.masks = append(g.masks, secret)
+	}
+}
+
+// sensitiveArgs are the options whose values are replaced with *** when git commands are logged
+var sensitiveArgs = []string{"--cloudbees-api-token", "--token", "--password"}
+
+// masked returns the command line of c with the registered secrets and the values of sensitive options replaced
+func (g *GitCLI) masked(c *exec.Cmd) string {
+	args := slices.Clone(c.Args)
+	for i := 1; i < len(args); i++ {
+		for _, name := range sensitiveArgs {
+			if args[i] == name && i+1 < len(args) {
+				args[i+1] = "***"
+			} else if strings.HasPrefix(args[i], name+"=") {
+				args[i] = name + "=***"
+			}
+		}
+		// authorization headers passed with -c http.<url>.extraheader=<header>
+		if key, _, found := strings.Cut(args[i], "="); found && strings.HasSuffix(strings.ToLower(key), ".extraheader") {
+			args[i] = key + "=***"
+		}
+		if strings.Contains(args[i], "://") {
+			args[i] = StripCredentialsFromURL(args[i])
+		}
+	}
+	s := strings.Join(append([]string{c.Path}, args[1:]...), " ")
+	for _, secret := range g.masks {
+		s = strings.ReplaceAll(s, secret, "***")
+	}
+	return s
+}
+
+// IsSSHURL returns true for ssh:// URLs and the SCP style user@host:path form
+func IsSSHURL(s string) bool {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return strings.ToLower(u.Scheme) == "ssh"
+	}
+	at := strings.Index(s, "@")
+	colon := strings.Index(s, ":")
+	return at > 0 && colon > at
+}
+
+// StripCredentialsFromURL removes the user information from HTTP(S) URLs, and the password from any other URL, so that
+// the URL can be logged. Anything else, including scp-like SSH URLs, is returned unchanged.
+func StripCredentialsFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		// tokens are commonly passed as the user name
+		u.User = nil
+	default:
+		if _, hasPassword := u.User.Password(); !hasPassword {
+			return rawURL
+		}
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+// auditLog is where a JSON line is written for each git command that is run
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// auditEntry is a line of the audit log
+type auditEntry struct {
+	Timestamp string `json:"ts"`
+	Command   string `json:"cmd"`
+	Cwd       string `json:"cwd"`
+}
+
+// SetAuditLog appends a JSON line to the file at path for each git command that is run, with secrets masked. The
+// file is kept open for the lifetime of the process.
+func (g *GitCLI) SetAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	g.audit = &auditLog{w: f}
+	return nil
+}
+
+func (g *GitCLI) auditCommand(c *exec.Cmd) {
+	if g.audit == nil {
+		return
+	}
+	line, err := json.Marshal(auditEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Command:   g.masked(c),
+		Cwd:       c.Dir,
+	})
+	if err != nil {
+		return
+	}
+	g.audit.mu.Lock()
+	defer g.audit.mu.Unlock()
+	if _, err := g.audit.w.Write(append(line, '\n')); err != nil {
+		core.Debug("could not write to the audit log: %v", err)
+	}
+}
+
 func (g *GitCLI) Executable() string {
 	return g.exe
 }
@@ -84,14 +390,37 @@ func (g *GitCLI) GlobalConfigPath() (string, error) {
 	return "", fmt.Errorf("unable to locate config file '%s'", filepath.Join("$HOME", ".gitconfig"))
 }
 
+// skipDryRun logs the command and returns true if it should not be executed
+func (g *GitCLI) skipDryRun(c *exec.Cmd) bool {
+	if g.dryRun {
+		core.Info("[DRY RUN] %s", g.masked(c))
+	}
+	return g.dryRun
+}
+
+func (g *GitCLI) logCommand(c *exec.Cmd) {
+	if g.quiet {
+		core.Debug("%s", g.masked(c))
+	} else if g.log {
+		core.Info("%s", g.masked(c))
+	}
+}
+
 func (g *GitCLI) runMerge(mergeBin string, args ...string) (string, error) { // this function is implemented similar to the 'run' function below
 	c := exec.CommandContext(g.ctx, mergeBin, args...)
 	c.Dir = g.cwd
-	c.Env = envMapToEntries(g.env)
+	env, err := g.environ()
+	if err != nil {
+		return "", err
+	}
+	c.Env = env
 
-	if g.log {
-		fmt.Println(c.String())
+	if g.skipDryRun(c) {
+		return "", nil
 	}
+	g.auditCommand(c)
+
+	g.logCommand(c)
 
 	if !g.quiet {
 		c.Stderr = os.Stderr
@@ -99,7 +428,7 @@ func (g *GitCLI) runMerge(mergeBin string, args ...string) (string, error) { //
 
 	var stdout = bytes.Buffer{}
 	c.Stdout = &stdout
-	err := c.Run()
+	err = g.contextErr(c.Run())
 	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) {
 		core.Debug("merge command exited with status %d", e.ExitCode())
 		return stdout.String(), err
@@ -115,18 +444,25 @@ func (g *GitCLI) runMerge(mergeBin string, args ...string) (string, error) { //
 func (g *GitCLI) run(args ...string) error {
 	c := exec.CommandContext(g.ctx, g.exe, args...)
 	c.Dir = g.cwd
-	c.Env = envMapToEntries(g.env)
+	env, err := g.environ()
+	if err != nil {
+		return err
+	}
+	c.Env = env
 
-	if g.log {
-		fmt.Println(c.String())
+	if g.skipDryRun(c) {
+		return nil
 	}
+	g.auditCommand(c)
+
+	g.logCommand(c)
 
 	if !g.quiet {
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
 	}
 
-	err := c.Run()
+	err = g.contextErr(c.Run())
 	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) {
 		core.Debug("%d", e.ExitCode())
 		return err
@@ -142,10 +478,16 @@ func (g *GitCLI) run(args ...string) error {
 func (g *GitCLI) runOutput(args ...string) (string, error) {
 	c := exec.CommandContext(g.ctx, g.exe, args...)
 	c.Dir = g.cwd
-	c.Env = envMapToEntries(g.env)
-	if g.log {
-		fmt.Println(c.String())
+	env, err := g.environ()
+	if err != nil {
+		return "", err
 	}
+	c.Env = env
+	if g.skipDryRun(c) {
+		return "", nil
+	}
+	g.auditCommand(c)
+	g.logCommand(c)
 	var stdoutBuf strings.Builder
 	if !g.quiet {
 		c.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
@@ -153,7 +495,7 @@ func (g *GitCLI) runOutput(args ...string) (string, error) {
 	} else {
 		c.Stdout = &stdoutBuf
 	}
-	err := c.Run()
+	err = g.contextErr(c.Run())
 
 	return stdoutBuf.String(), err
 }
@@ -161,47 +503,125 @@ func (g *GitCLI) runOutput(args ...string) (string, error) {
 func (g *GitCLI) silentRunOutput(args ...string) (string, error) {
 	c := exec.CommandContext(g.ctx, g.exe, args...)
 	c.Dir = g.cwd
-	c.Env = envMapToEntries(g.env)
+	env, err := g.environ()
+	if err != nil {
+		return "", err
+	}
+	c.Env = env
+	if g.skipDryRun(c) {
+		return "", nil
+	}
+	g.auditCommand(c)
 	var stdoutBuf strings.Builder
 	c.Stdout = &stdoutBuf
-	err := c.Run()
+	err = g.contextErr(c.Run())
 
 	return stdoutBuf.String(), err
 }
 
-func (g *GitCLI) BranchList(remote bool) ([]string, error) {
-	var target string
-	if remote {
-		target = "--remotes=origin"
-	} else {
-		target = "--branches"
+func (g *GitCLI) silentRunInput(stdin io.Reader, args ...string) (string, error) {
+	c := exec.CommandContext(g.ctx, g.exe, args...)
+	c.Dir = g.cwd
+	env, err := g.environ()
+	if err != nil {
+		return "", err
+	}
+	c.Env = env
+	if g.skipDryRun(c) {
+		return "", nil
+	}
+	g.auditCommand(c)
+	c.Stdin = stdin
+	var stdoutBuf strings.Builder
+	c.Stdout = &stdoutBuf
+	err = g.contextErr(c.Run())
+
+	return stdoutBuf.String(), err
+}
+
+// RefInfo describes a ref as reported by git for-each-ref
+type RefInfo struct {
+	Name        string
+	ObjectType  string
+	ObjectName  string
+	CreatorDate time.Time
+}
+
+// refInfoFormat is the default for-each-ref format, producing the RefInfo fields separated by NUL characters
+const refInfoFormat = "%(refname)%00%(objecttype)%00%(objectname)%00%(creatordate:unix)"
+
+// ForEachRef returns the refs matching pattern, either a prefix such as refs/heads/ or a glob. The format defaults
+// to refInfoFormat when empty, a custom format must produce the RefInfo fields in the same order, for example using
+// %(*objectname) to peel annotated tags.
+func (g *GitCLI) ForEachRef(pattern string, format string) ([]RefInfo, error) {
+	if format == "" {
+		format = refInfoFormat
 	}
 
-	output, err := g.silentRunOutput("rev-parse", "--symbolic-full-name", target)
+	args := []string{"for-each-ref", "--format=" + format}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+
+	output, err := g.silentRunOutput(args...)
 	if err != nil {
 		return nil, err
 	}
 
-	var result []string
-	for _, branch := range strings.Split(output, "\n") {
-		branch = strings.TrimSpace(branch)
-
-		if branch == "" {
+	var result []RefInfo
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
 			continue
 		}
-
-		if strings.HasPrefix(branch, "refs/heads/") {
-			branch = strings.TrimPrefix(branch, "refs/heads/")
-		} else if strings.HasPrefix(branch, "refs/remotes/") {
-			branch = strings.TrimPrefix(branch, "refs/remotes/")
+		fields := strings.Split(line, "\x00")
+		info := RefInfo{Name: fields[0]}
+		if len(fields) > 1 {
+			info.ObjectType = fields[1]
+		}
+		if len(fields) > 2 {
+			info.ObjectName = fields[2]
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			seconds, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected creator date for %s: %w", info.Name, err)
+			}
+			info.CreatorDate = time.Unix(seconds, 0)
 		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// BranchList returns the local branches, or the remote branches of origin, whose names match the pattern. The
+// pattern is either a glob or a name that also matches the branches below it, for example feature matches
+// feature/x, and an empty pattern matches every branch.
+func (g *GitCLI) BranchList(remote bool, pattern string) ([]string, error) {
+	prefix := "refs/heads/"
+	if remote {
+		prefix = "refs/remotes/origin/"
+	}
+
+	refs, err := g.ForEachRef(prefix+pattern, "%(refname)")
+	if err != nil {
+		return nil, err
+	}
 
-		result = append(result, branch)
+	var result []string
+	for _, ref := range refs {
+		// remote branches keep the name of the remote, for example origin/main
+		result = append(result, strings.TrimPrefix(strings.TrimPrefix(ref.Name, "refs/heads/"), "refs/remotes/"))
 	}
 
 	return result, nil
 }
 
+// BranchCount returns the number of local branches, or of remote branches of origin
+func (g *GitCLI) BranchCount(remote bool) (int, error) {
+	branches, err := g.BranchList(remote, "")
+	return len(branches), err
+}
+
 func (g *GitCLI) BranchDelete(remote bool, branch string) error {
 	args := []string{"branch", "--delete", "--force"}
 
@@ -232,27 +652,177 @@ func (g *GitCLI) BranchExists(remote bool, pattern string) (bool, error) {
 }
 
 func (g *GitCLI) TagExists(pattern string) (bool, error) {
-	output, err := g.runOutput("tag", "--list", pattern)
+	refs, err := g.ForEachRef("refs/tags/"+pattern, "%(refname)")
 	if err != nil {
 		return false, err
 	}
 
-	return strings.TrimSpace(output) != "", nil
+	// without wildcards for-each-ref also matches the tags nested under the pattern, for example v1/beta for v1
+	if !strings.ContainsAny(pattern, "*?[") {
+		return slices.ContainsFunc(refs, func(r RefInfo) bool { return r.Name == "refs/tags/"+pattern }), nil
+	}
+	return len(refs) > 0, nil
+}
+
+// DescribeOptions controls how git describe names a commit
+type DescribeOptions struct {
+	// Tags also considers lightweight tags, not only annotated tags
+	Tags bool
+	// Long always includes the number of commits since the tag and the abbreviated object name
+	Long bool
+	// Always falls back to the abbreviated object name when no tag is reachable
+	Always bool
+	// Abbrev is the minimum length of the abbreviated object name, git decides when 0
+	Abbrev int
+	// Match only considers the tags matching the glob
+	Match string
+	// Exclude ignores the tags matching the glob
+	Exclude string
+}
+
+// Describe names ref, or HEAD when empty, after the most recent tag reachable from it
+func (g *GitCLI) Describe(ref string, opts DescribeOptions) (string, error) {
+	args := []string{"describe"}
+	if opts.Tags {
+		args = append(args, "--tags")
+	}
+	if opts.Long {
+		args = append(args, "--long")
+	}
+	if opts.Always {
+		args = append(args, "--always")
+	}
+	if opts.Abbrev > 0 {
+		args = append(args, fmt.Sprintf("--abbrev=%d", opts.Abbrev))
+	}
+	if opts.Match != "" {
+		args = append(args, "--match="+opts.Match)
+	}
+	if opts.Exclude != "" {
+		args = append(args, "--exclude="+opts.Exclude)
+	}
+	if ref != "" {
+		args = append(args, ref)
+	}
+	output, err := g.runOutput(args...)
+	return strings.TrimSpace(output), err
+}
+
+// DescribeVersion names ref after the most recent tag, suitable for use as a version string. Commits without a
+// reachable tag, which is common with shallow fetches, are named by their abbreviated object name instead.
+func (g *GitCLI) DescribeVersion(ref string) (string, error) {
+	return g.Describe(ref, DescribeOptions{Tags: true, Always: true, Abbrev: 7})
 }
 
+// BranchGetDefault returns the default branch of the remote repository. The result is cached for the lifetime of
+// the GitCLI.
 func (g *GitCLI) BranchGetDefault(repositoryUrl string) (string, error) {
-	output, err := g.runOutput("ls-remote", "--quiet", "--exit-code", "--symref", repositoryUrl, "HEAD")
+	if g.cacheMu != nil {
+		g.cacheMu.RLock()
+		branch, found := g.defaultBranchCache[repositoryUrl]
+		g.cacheMu.RUnlock()
+		if found {
+			return branch, nil
+		}
+	}
+
+	symrefs, err := g.LsRemoteSymref(repositoryUrl, "HEAD")
 	if err != nil {
 		return "", err
 	}
 
+	branch, found := symrefs["HEAD"]
+	if !found {
+		return "", fmt.Errorf("unexpected output when retrieving default branch")
+	}
+	if g.cacheMu != nil {
+		g.cacheMu.Lock()
+		g.defaultBranchCache[repositoryUrl] = branch
+		g.cacheMu.Unlock()
+	}
+	return branch, nil
+}
+
+// LsRemote returns the refs advertised by the remote repository matching the optional patterns, mapped to the
+// object names they point at. Peeled tags are included with their ^{} suffix.
+func (g *GitCLI) LsRemote(url string, patterns ...string) (map[string]string, error) {
+	args := append([]string{"ls-remote", "--quiet", url}, patterns...)
+	output, err := g.silentRunOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, _, err := parseLsRemote(output)
+	return refs, err
+}
+
+// LsRemoteSymref returns the symbolic refs advertised by the remote repository matching the optional patterns,
+// mapped to the refs they point at, for example HEAD to refs/heads/main
+func (g *GitCLI) LsRemoteSymref(url string, patterns ...string) (map[string]string, error) {
+	args := append([]string{"ls-remote", "--quiet", "--symref", url}, patterns...)
+	output, err := g.silentRunOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, symrefs, err := parseLsRemote(output)
+	return symrefs, err
+}
+
+// parseLsRemote parses the output of git ls-remote into the refs and the symbolic refs
+func parseLsRemote(output string) (map[string]string, map[string]string, error) {
+	refs := make(map[string]string)
+	symrefs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		target, name, found := strings.Cut(line, "\t")
+		if !found {
+			return nil, nil, fmt.Errorf("unexpected ls-remote output: %q", line)
+		}
+		name = strings.TrimSpace(name)
+		if ref, isSymref := strings.CutPrefix(target, "ref:"); isSymref {
+			// ref: refs/heads/main<TAB>HEAD
+			symrefs[name] = strings.TrimSpace(ref)
+		} else {
+			refs[name] = strings.TrimSpace(target)
+		}
+	}
+	return refs, symrefs, nil
+}
+
+// ClearCache discards the cached results of remote lookups
+func (g *GitCLI) ClearCache() {
+	if g.cacheMu == nil {
+		return
+	}
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	clear(g.defaultBranchCache)
+}
+
+// CountObjects returns the statistics reported by git count-objects -v, sizes are in KiB
+func (g *GitCLI) CountObjects() (map[string]int64, error) {
+	output, err := g.silentRunOutput("count-objects", "-v")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int64)
 	for _, line := range strings.Split(output, "\n") {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "ref:") && strings.HasSuffix(line, "HEAD") {
-			return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "ref:"), "HEAD")), nil
+		key, val, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected count-objects output: %q", line)
 		}
+		result[strings.TrimSpace(key)] = n
 	}
-	return "", fmt.Errorf("unexpected output when retrieving default branch")
+	return result, nil
 }
 
 func configScope(global bool) string {
@@ -310,6 +880,34 @@ func (g *GitCLI) UnsetConfig(global bool, key string) (bool, error) {
 	return err == nil, err
 }
 
+// ValidHTTPVersion returns true if version is a value git accepts for http.version
+func ValidHTTPVersion(version string) bool {
+	return version == "HTTP/1.1" || version == "HTTP/2"
+}
+
+// SetHTTPVersion sets http.version in the local config, forcing the HTTP protocol version used by git
+func (g *GitCLI) SetHTTPVersion(version string) error {
+	if !ValidHTTPVersion(version) {
+		return fmt.Errorf("invalid HTTP version '%s', expected HTTP/1.1 or HTTP/2", version)
+	}
+	return g.SetConfigStr(false, "http.version", version)
+}
+
+// UnsetHTTPVersion removes http.version from the local config
+func (g *GitCLI) UnsetHTTPVersion() error {
+	_, err := g.UnsetConfig(false, "http.version")
+	return err
+}
+
+// SetHTTPPostBuffer sets http.postBuffer in the local config, the maximum size in bytes of the buffer used when
+// sending data to the remote
+func (g *GitCLI) SetHTTPPostBuffer(sizeBytes int) error {
+	if sizeBytes <= 0 {
+		return fmt.Errorf("invalid HTTP post buffer size %d, expected a positive number of bytes", sizeBytes)
+	}
+	return g.SetConfigInt(false, "http.postBuffer", int64(sizeBytes))
+}
+
 // IsDetached returns true if the current working directory is part of a git workspace that is in a detached head state
 func (g *GitCLI) IsDetached() (bool, error) {
 	// Note `branch --show-current` would be simpler but rev-parse is part of the git API whereas branch is user facing
@@ -317,7 +915,7 @@ func (g *GitCLI) IsDetached() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return !strings.HasPrefix(strings.TrimSpace(output), "ref/heads/"), nil
+	return !strings.HasPrefix(strings.TrimSpace(output), "refs/heads/"), nil
 }
 
 // CheckoutDetach detaches the current working directory if it is part of a git workspace.
@@ -329,6 +927,13 @@ func (g *GitCLI) SubmoduleStatus() error {
 	return g.run("submodule", "status")
 }
 
+// ObjectFormat returns the hash algorithm of the repository, sha1 or sha256
+func (g *GitCLI) ObjectFormat() (string, error) {
+	output, err := g.silentRunOutput("rev-parse", "--show-object-format")
+	return strings.TrimSpace(output), err
+}
+
+// ShaExists checks if the object exists, sha can be an object name of any length or hash algorithm
 func (g *GitCLI) ShaExists(sha string) (bool, error) {
 	err := g.run("rev-parse", "--verify", "--quiet", sha+"^{object}")
 	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) {
@@ -337,25 +942,241 @@ func (g *GitCLI) ShaExists(sha string) (bool, error) {
 	return err == nil, err
 }
 
+// HasObject checks whether the object named by sha is present in the local object store, without logging the
+// command as ShaExists does, so that probing for the result of an earlier fetch does not clutter the log
+func (g *GitCLI) HasObject(sha string) (bool, error) {
+	_, err := g.silentRunOutput("rev-parse", "--verify", "--quiet", sha+"^{object}")
+	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ShasExist checks which of the supplied object names exist in the repository using a single git cat-file process
+func (g *GitCLI) ShasExist(shas []string) (map[string]bool, error) {
+	result := make(map[string]bool, len(shas))
+	if len(shas) == 0 {
+		return result, nil
+	}
+
+	var input strings.Builder
+	for _, sha := range shas {
+		input.WriteString(sha)
+		input.WriteString("\n")
+	}
+
+	output, err := g.silentRunInput(strings.NewReader(input.String()), "cat-file", "--batch-check")
+	if err != nil {
+		return nil, err
+	}
+	if g.dryRun {
+		return result, nil
+	}
+
+	// one line of output per line of input, in order, missing objects are reported as "<sha> missing"
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) != len(shas) {
+		return nil, fmt.Errorf("unexpected cat-file output: expected %d lines, got %d", len(shas), len(lines))
+	}
+	for i, sha := range shas {
+		fields := strings.Fields(lines[i])
+		result[sha] = len(fields) == 3
+	}
+	return result, nil
+}
+
 func (g *GitCLI) RevParse(ref string) (string, error) {
 	output, err := g.runOutput("rev-parse", ref)
 	return strings.TrimSpace(output), err
 }
 
-func (g *GitCLI) LfsFetch(ref string) error {
-	return g.run("lfs", "fetch", "origin", ref)
-}
+// archiveFormats are the formats supported by Archive
+var archiveFormats = []string{"tar", "tar.gz", "zip"}
 
-func (g *GitCLI) LfsInstall() error {
-	return g.run("lfs", "install", "--local")
-}
+// Archive creates an archive of the tree at ref, limited to paths when supplied, in the given format (tar, tar.gz or
+// zip). The archive is written to outputPath, or returned when outputPath is empty.
+func (g *GitCLI) Archive(ref string, format string, outputPath string, paths []string) ([]byte, error) {
+	if !slices.Contains(archiveFormats, format) {
+		return nil, fmt.Errorf("unsupported archive format: '%s', expected %s", format, strings.Join(archiveFormats, "/"))
+	}
+
+	args := []string{"archive", "--format=" + format}
+	if outputPath != "" {
+		args = append(args, "--output="+outputPath)
+	}
+	args = append(args, ref)
+	if len(paths) > 0 {
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
+	if outputPath != "" {
+		return nil, g.run(args...)
+	}
+	output, err := g.silentRunOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// NotesList returns the object names of the notes attached to ref
+func (g *GitCLI) NotesList(ref string) (string, error) {
+	output, err := g.runOutput("notes", "list", ref)
+	return strings.TrimSpace(output), err
+}
+
+// NotesShow returns the notes attached to ref
+func (g *GitCLI) NotesShow(ref string) (string, error) {
+	return g.runOutput("notes", "show", ref)
+}
+
+// RevParseShort returns the object name of ref abbreviated to at least length characters
+func (g *GitCLI) RevParseShort(ref string, length int) (string, error) {
+	output, err := g.runOutput("rev-parse", fmt.Sprintf("--short=%d", length), ref)
+	return strings.TrimSpace(output), err
+}
+
+// RevParseTree returns the object name of the tree of ref
+func (g *GitCLI) RevParseTree(ref string) (string, error) {
+	output, err := g.runOutput("rev-parse", ref+"^{tree}")
+	return strings.TrimSpace(output), err
+}
+
+// HistoryLength returns the number of commits in the first-parent history of rev that are available locally, which
+// is the depth the history was fetched to in a shallow repository
+func (g *GitCLI) HistoryLength(rev string) (int, error) {
+	output, err := g.silentRunOutput("rev-list", "--count", "--first-parent", rev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(output))
+}
+
+// ShallowDepth returns -1 when the repository has complete history, otherwise the number of commits at which the
+// history is truncated, as listed in the shallow file. It does not walk the history, see HistoryLength for that.
+func (g *GitCLI) ShallowDepth() (int, error) {
+	output, err := g.runOutput("rev-parse", "--git-path", "shallow")
+	if err != nil {
+		return -1, err
+	}
+	shallowPath := strings.TrimSpace(output)
+	if !filepath.IsAbs(shallowPath) {
+		shallowPath = filepath.Join(g.cwd, shallowPath)
+	}
+
+	bs, err := os.ReadFile(shallowPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+
+	count := 0
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	if count == 0 {
+		// git removes the file once the history is complete, an empty file is not shallow either
+		return -1, nil
+	}
+	return count, nil
+}
+
+// Fsck verifies the connectivity and validity of the objects in the repository, returning what git fsck reported
+func (g *GitCLI) Fsck(options ...string) (string, error) {
+	c := exec.CommandContext(g.ctx, g.exe, append([]string{"fsck"}, options...)...)
+	c.Dir = g.cwd
+	env, err := g.environ()
+	if err != nil {
+		return "", err
+	}
+	c.Env = env
+	if g.skipDryRun(c) {
+		return "", nil
+	}
+	g.auditCommand(c)
+	g.logCommand(c)
+	// problems are reported on both stdout and stderr
+	output, err := c.CombinedOutput()
+	return string(output), g.contextErr(err)
+}
+
+// UpdateRef points ref at the object name sha
+func (g *GitCLI) UpdateRef(ref string, sha string) error {
+	return g.run("update-ref", ref, sha)
+}
+
+func (g *GitCLI) LfsFetch(ref string) error {
+	return g.run("lfs", "fetch", "origin", ref)
+}
+
+// LfsInstall installs the git lfs hooks and filters in the local config. When skipSmudge is set, checkouts leave the
+// lfs pointers in the working tree instead of downloading the file content.
+func (g *GitCLI) LfsInstall(skipSmudge bool) error {
+	args := []string{"lfs", "install", "--local"}
+	if skipSmudge {
+		args = append(args, "--skip-smudge")
+	}
+	return g.run(args...)
+}
+
+// LfsCheckout replaces the lfs pointers matching the include patterns with the file content, downloading the objects
+// not matching the exclude patterns first. It is intended for on-demand use after a checkout with LfsInstall(true).
+// When no include patterns are supplied, all pointers are replaced. Pointers whose objects are excluded are left in
+// place unless the objects were already fetched.
+func (g *GitCLI) LfsCheckout(include []string, exclude []string) error {
+	// git lfs checkout only uses objects that are already present, and has no exclude option
+	fetchArgs := []string{"lfs", "fetch"}
+	if len(include) > 0 {
+		fetchArgs = append(fetchArgs, "--include="+strings.Join(include, ","))
+	}
+	if len(exclude) > 0 {
+		fetchArgs = append(fetchArgs, "--exclude="+strings.Join(exclude, ","))
+	}
+	if err := g.run(fetchArgs...); err != nil {
+		return err
+	}
+
+	return g.run(append([]string{"lfs", "checkout"}, include...)...)
+}
 
 func (g *GitCLI) SparseCheckout(dirs []string) error {
 	args := []string{"sparse-checkout", "set"}
 	args = append(args, dirs...)
-	return g.run(dirs...)
+	return g.run(args...)
 }
 
+// ListTree returns the directories beneath path in the tree of ref, up to depth levels deep
+func (g *GitCLI) ListTree(ref string, path string, depth int) ([]string, error) {
+	path = strings.Trim(path, "/")
+	treeish := ref
+	if path != "" {
+		treeish = ref + ":" + path
+	}
+
+	output, err := g.silentRunOutput("ls-tree", "-r", "-d", "-z", "--name-only", treeish)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, d := range strings.Split(output, "\x00") {
+		if d == "" || (depth > 0 && strings.Count(d, "/") >= depth) {
+			continue
+		}
+		if path != "" {
+			d = path + "/" + d
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// SparseCheckoutNonConeMode enables non-cone mode sparse checkout and appends any of the supplied patterns that are
+// not already present in the sparse-checkout file
 func (g *GitCLI) SparseCheckoutNonConeMode(patterns []string) (err error) {
 	if err = g.SetConfigBool(false, "core.sparseCheckout", true); err != nil {
 		return err
@@ -365,7 +1186,37 @@ func (g *GitCLI) SparseCheckoutNonConeMode(patterns []string) (err error) {
 		return err
 	}
 
-	f, err := os.OpenFile(strings.TrimSpace(output), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	sparseCheckoutPath := strings.TrimSpace(output)
+	if !filepath.IsAbs(sparseCheckoutPath) {
+		sparseCheckoutPath = filepath.Join(g.cwd, sparseCheckoutPath)
+	}
+
+	existing := make(map[string]struct{})
+	if content, err := os.ReadFile(sparseCheckoutPath); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			existing[line] = struct{}{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var missing []string
+	for _, p := range patterns {
+		if _, found := existing[p]; !found {
+			existing[p] = struct{}{}
+			missing = append(missing, p)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sparseCheckoutPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(sparseCheckoutPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
@@ -377,12 +1228,28 @@ func (g *GitCLI) SparseCheckoutNonConeMode(patterns []string) (err error) {
 		}
 	}()
 
-	if _, err = f.WriteString("\n" + strings.Join(patterns, "\n") + "\n"); err != nil {
+	if _, err = f.WriteString("\n" + strings.Join(missing, "\n") + "\n"); err != nil {
 		return err
 	}
 	return nil
 }
 
+// SparseCheckoutList returns the effective sparse checkout patterns
+func (g *GitCLI) SparseCheckoutList() ([]string, error) {
+	output, err := g.silentRunOutput("sparse-checkout", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result, nil
+}
+
 func (g *GitCLI) Checkout(ref string, startPoint string) error {
 	args := []string{"checkout", "--progress", "--force"}
 	if startPoint != "" {
@@ -393,27 +1260,250 @@ func (g *GitCLI) Checkout(ref string, startPoint string) error {
 	return g.run(args...)
 }
 
-func (g *GitCLI) SubmoduleSync(recursive bool) error {
+// SetHead points HEAD the same way as Checkout and resets the index to the commit, without touching the working
+// tree. Files left by a previous checkout of the repository therefore remain in place, and show as changes.
+func (g *GitCLI) SetHead(ref string, startPoint string) error {
+	if startPoint != "" {
+		// update-ref rather than branch --force, which refuses to update the current branch
+		if err := g.run("update-ref", "refs/heads/"+ref, startPoint+"^{commit}"); err != nil {
+			return err
+		}
+		if err := g.run("symbolic-ref", "HEAD", "refs/heads/"+ref); err != nil {
+			return err
+		}
+	} else if err := g.run("update-ref", "--no-deref", "HEAD", ref+"^{commit}"); err != nil {
+		return err
+	}
+	// an index left by a previous checkout would otherwise describe a different commit
+	return g.run("read-tree", "HEAD")
+}
+
+// ListFiles returns the paths of the files in the index matching the optional pathspec
+func (g *GitCLI) ListFiles(pathspec ...string) ([]string, error) {
+	args := []string{"ls-files", "-z"}
+	if len(pathspec) > 0 {
+		args = append(args, "--")
+		args = append(args, pathspec...)
+	}
+
+	output, err := g.silentRunOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, f := range strings.Split(output, "\x00") {
+		if f != "" {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+// ManifestEntry is a file in the index as reported by git ls-files
+type ManifestEntry struct {
+	Mode  string `json:"mode,omitempty"`
+	SHA   string `json:"sha,omitempty"`
+	Stage int    `json:"stage"`
+	Path  string `json:"path"`
+}
+
+// LsFiles returns the files in the index, including their mode, object name and stage when staged is true
+func (g *GitCLI) LsFiles(staged bool) ([]ManifestEntry, error) {
+	args := []string{"ls-files", "-z"}
+	if staged {
+		args = append(args, "--stage")
+	}
+
+	output, err := g.silentRunOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ManifestEntry
+	for _, line := range strings.Split(output, "\x00") {
+		if line == "" {
+			continue
+		}
+		if !staged {
+			result = append(result, ManifestEntry{Path: line})
+			continue
+		}
+		// <mode> SP <object> SP <stage> TAB <file>
+		info, path, found := strings.Cut(line, "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected ls-files output: %q", line)
+		}
+		stage, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected ls-files stage in %q: %w", line, err)
+		}
+		result = append(result, ManifestEntry{Mode: fields[0], SHA: fields[1], Stage: stage, Path: path})
+	}
+	return result, nil
+}
+
+// GetSubmoduleURLs returns the URLs of the submodules declared in .gitmodules, keyed by submodule name
+func (g *GitCLI) GetSubmoduleURLs() (map[string]string, error) {
+	submodules, err := g.SubmoduleList()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(submodules))
+	for _, s := range submodules {
+		if s.URL != "" {
+			result[s.Name] = s.URL
+		}
+	}
+	return result, nil
+}
+
+// SubmoduleEntry is a submodule declared in .gitmodules, optional fields that are not declared are left as zero values
+type SubmoduleEntry struct {
+	Name    string
+	Path    string
+	URL     string
+	Branch  string
+	Update  string
+	Shallow bool
+}
+
+// SubmoduleList returns the submodules declared in the .gitmodules file of the working tree, in declaration order
+func (g *GitCLI) SubmoduleList() ([]SubmoduleEntry, error) {
+	output, err := g.silentRunOutput("config", "--file", ".gitmodules", "--null", "--get-regexp", `^submodule\.`)
+	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) && e.ExitCode() == 1 {
+		// no submodules
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []SubmoduleEntry
+	index := make(map[string]int)
+	// each entry is the key and value separated by a newline, terminated by a NUL. A key declared without a value,
+	// which git treats as true, has no newline.
+	for _, entry := range strings.Split(output, "\x00") {
+		key, value, hasValue := strings.Cut(entry, "\n")
+		// the submodule name can contain dots, the variable name cannot
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			continue
+		}
+		name, variable := strings.TrimPrefix(key[:i], "submodule."), key[i+1:]
+		if _, exists := index[name]; !exists {
+			index[name] = len(result)
+			result = append(result, SubmoduleEntry{Name: name})
+		}
+		s := &result[index[name]]
+		switch variable {
+		case "path":
+			s.Path = value
+		case "url":
+			s.URL = value
+		case "branch":
+			s.Branch = value
+		case "update":
+			s.Update = value
+		case "shallow":
+			s.Shallow = !hasValue || parseConfigBool(value)
+		}
+	}
+	return result, nil
+}
+
+// SubmoduleCount returns the number of submodules declared in the .gitmodules file of the working tree
+func (g *GitCLI) SubmoduleCount() (int, error) {
+	submodules, err := g.SubmoduleList()
+	return len(submodules), err
+}
+
+// parseConfigBool interprets a git config value as a boolean the way git does, unrecognised values are false
+func parseConfigBool(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "on", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// SubmoduleAbsorbGitDirs moves the git directories of the submodules, including nested ones, into
+// .git/modules/<name> of their superproject, replacing them with a .git file
+func (g *GitCLI) SubmoduleAbsorbGitDirs() error {
+	return g.run("submodule", "absorbgitdirs")
+}
+
+// SubmoduleDeinit unregisters the submodule at path and removes its working tree, force also discards any local
+// changes to it
+func (g *GitCLI) SubmoduleDeinit(path string, force bool) error {
+	args := []string{"submodule", "deinit"}
+	if force {
+		args = append(args, "--force")
+	}
+	args = append(args, "--", path)
+	return g.run(args...)
+}
+
+// SubmoduleInit registers the submodules recorded in the index, limited to those under paths when supplied, without
+// fetching them
+func (g *GitCLI) SubmoduleInit(paths ...string) error {
+	args := []string{"submodule", "init"}
+
+	if len(paths) > 0 {
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
+	return g.run(args...)
+}
+
+// SubmoduleSync synchronizes the URLs of the submodules, limited to those under paths when supplied
+func (g *GitCLI) SubmoduleSync(recursive bool, paths ...string) error {
 	args := []string{"submodule", "sync"}
 
 	if recursive {
 		args = append(args, "--recursive")
 	}
 
+	if len(paths) > 0 {
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
 	return g.run(args...)
 }
 
-func (g *GitCLI) SubmoduleUpdate(fetchDepth int, recursive bool) error {
+// SubmoduleUpdateOptions controls how submodules are updated
+type SubmoduleUpdateOptions struct {
+	FetchDepth int
+	Recursive  bool
+	// Jobs is the number of submodules fetched in parallel, values above the number of logical CPUs are clamped
+	Jobs int
+	// Paths limits the update to the submodules under the supplied paths
+	Paths []string
+}
+
+func (g *GitCLI) SubmoduleUpdate(options SubmoduleUpdateOptions) error {
 	args := []string{"-c", "protocol.version=2", "submodule", "update", "--init", "--force"}
 
-	if fetchDepth > 0 {
-		args = append(args, fmt.Sprintf("--depth=%d", fetchDepth))
+	if options.FetchDepth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", options.FetchDepth))
 	}
 
-	if recursive {
+	if options.Recursive {
 		args = append(args, "--recursive")
 	}
 
+	if jobs := min(options.Jobs, runtime.NumCPU()); jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", jobs))
+	}
+
+	if len(options.Paths) > 0 {
+		args = append(args, "--")
+		args = append(args, options.Paths...)
+	}
+
 	return g.run(args...)
 }
 
@@ -433,6 +1523,89 @@ func (g *GitCLI) Clean() error {
 	return g.run("clean", "-ffdx")
 }
 
+// MergeBase returns the best common ancestor of the commits a and b
+func (g *GitCLI) MergeBase(a string, b string) (string, error) {
+	output, err := g.silentRunOutput("merge-base", a, b)
+	return strings.TrimSpace(output), err
+}
+
+// Repack packs the loose objects into a single pack, removing redundant packs. An aggressive repack also recomputes
+// all the deltas, which is much slower but produces a smaller pack.
+func (g *GitCLI) Repack(aggressive bool) error {
+	args := []string{"repack", "-d"}
+	if aggressive {
+		args = append(args, "-a", "-f", "--depth=50", "--window=250")
+	}
+	return g.run(args...)
+}
+
+// PackRefs packs the tag refs, and the branch refs too when all is set, into the packed-refs file
+func (g *GitCLI) PackRefs(all bool) error {
+	args := []string{"pack-refs"}
+	if all {
+		args = append(args, "--all")
+	}
+	return g.run(args...)
+}
+
+// CommitGraph writes the commit-graph file, for the commits reachable from all refs when reachable is set and
+// otherwise for the commits in the packs
+func (g *GitCLI) CommitGraph(reachable bool) error {
+	args := []string{"commit-graph", "write"}
+	if reachable {
+		args = append(args, "--reachable")
+	}
+	return g.run(args...)
+}
+
+// StashPush stashes the local changes, including untracked files when includeUntracked is set, and returns the object
+// name of the stash entry. An empty name is returned when there were no local changes to stash.
+func (g *GitCLI) StashPush(message string, includeUntracked bool) (string, error) {
+	before, err := g.stashHead()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"stash", "push"}
+	if includeUntracked {
+		args = append(args, "--include-untracked")
+	}
+	args = append(args, "--message", message)
+	if err := g.run(args...); err != nil {
+		return "", err
+	}
+
+	after, err := g.stashHead()
+	if err != nil || after == before {
+		return "", err
+	}
+	return after, nil
+}
+
+// StashPop applies and drops the stash entry with the object name returned by StashPush. Nothing is done when the
+// entry is no longer in the stash. When applying the entry fails, for example due to conflicts, the entry is kept.
+func (g *GitCLI) StashPop(ref string) error {
+	output, err := g.silentRunOutput("stash", "list", "--format=%H")
+	if err != nil {
+		return err
+	}
+	for i, sha := range strings.Split(strings.TrimSpace(output), "\n") {
+		if sha != "" && sha == ref {
+			return g.run("stash", "pop", fmt.Sprintf("stash@{%d}", i))
+		}
+	}
+	return nil
+}
+
+// stashHead returns the object name of the most recent stash entry, or empty when the stash is empty
+func (g *GitCLI) stashHead() (string, error) {
+	output, err := g.silentRunOutput("rev-parse", "--verify", "--quiet", "refs/stash")
+	if e := (&exec.ExitError{}); err != nil && errors.As(err, &e) {
+		return "", nil
+	}
+	return strings.TrimSpace(output), err
+}
+
 func (g *GitCLI) Log1(format ...string) (string, error) {
 	a := []string{"log", "-1"}
 	a = append(a, format...)
@@ -442,6 +1615,40 @@ func (g *GitCLI) Log1(format ...string) (string, error) {
 	return g.runOutput(a...)
 }
 
+// CommitInfo is the metadata of a commit as reported by git log
+type CommitInfo struct {
+	AuthorName    string    `json:"author-name"`
+	AuthorEmail   string    `json:"author-email"`
+	CommitterDate time.Time `json:"committer-date"`
+	Subject       string    `json:"subject"`
+}
+
+// Log1Structured returns the metadata of the HEAD commit
+func (g *GitCLI) Log1Structured() (*CommitInfo, error) {
+	output, err := g.silentRunOutput("log", "-1", "--format=%an%n%ae%n%ct%n%s")
+	if err != nil {
+		return nil, err
+	}
+	return parseCommitInfo(output)
+}
+
+func parseCommitInfo(output string) (*CommitInfo, error) {
+	lines := strings.SplitN(strings.TrimSuffix(output, "\n"), "\n", 4)
+	if len(lines) != 4 {
+		return nil, fmt.Errorf("unexpected git log output: %q", output)
+	}
+	committed, err := strconv.ParseInt(lines[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected git log committer date %q: %w", lines[2], err)
+	}
+	return &CommitInfo{
+		AuthorName:    lines[0],
+		AuthorEmail:   lines[1],
+		CommitterDate: time.Unix(committed, 0).UTC(),
+		Subject:       lines[3],
+	}, nil
+}
+
 func (g *GitCLI) Reset() error {
 	return g.run("reset", "--hard", "HEAD")
 }
@@ -450,12 +1657,86 @@ func (g *GitCLI) Init(path string) error {
 	return g.run("init", "--quiet", path)
 }
 
+func (g *GitCLI) InitBare(path string) error {
+	return g.run("init", "--quiet", "--bare", path)
+}
+
+// WorktreeAdd adds a worktree at path with ref checked out as a detached HEAD
+func (g *GitCLI) WorktreeAdd(path string, ref string) error {
+	return g.run("worktree", "add", "--force", "--detach", path, ref)
+}
+
+// WorktreeRemove removes the worktree at path, along with any local modifications in it
+func (g *GitCLI) WorktreeRemove(path string) error {
+	return g.run("worktree", "remove", "--force", path)
+}
+
+// WorktreePrune removes the administrative files of worktrees whose directories no longer exist
+func (g *GitCLI) WorktreePrune() error {
+	return g.run("worktree", "prune")
+}
+
+// WorktreeList returns the paths of all the worktrees of the repository
+func (g *GitCLI) WorktreeList() ([]string, error) {
+	output, err := g.silentRunOutput("worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "worktree ") {
+			result = append(result, strings.TrimPrefix(line, "worktree "))
+		}
+	}
+	return result, nil
+}
+
 func (g *GitCLI) RemoteAdd(name string, url string) error {
 	return g.run("remote", "add", name, url)
 }
 
+// RemoteSetURL changes the URL of the remote
+func (g *GitCLI) RemoteSetURL(name string, url string) error {
+	return g.run("remote", "set-url", name, url)
+}
+
+// RemoteGetURL returns the URL of the remote, with any url.<base>.insteadOf rewrites applied. Use GetRemoteURL
+// for the URL as configured.
+func (g *GitCLI) RemoteGetURL(name string) (string, error) {
+	output, err := g.silentRunOutput("remote", "get-url", name)
+	return strings.TrimSpace(output), err
+}
+
+// ErrRemoteNotFound is returned when a remote is not configured in the repository
+var ErrRemoteNotFound = errors.New("remote not found")
+
+// GetRemoteURL returns the configured URL of the remote, or ErrRemoteNotFound if there is no such remote
+func (g *GitCLI) GetRemoteURL(name string) (string, error) {
+	output, err := g.GetConfig(false, "remote."+name+".url")
+	if e := (&exec.ExitError{}); errors.As(err, &e) && e.ExitCode() == 1 {
+		return "", fmt.Errorf("%w: %s", ErrRemoteNotFound, name)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// RemoteList returns the names of the configured remotes
+func (g *GitCLI) RemoteList() ([]string, error) {
+	output, err := g.runOutput("remote")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(output), nil
+}
+
 func (g *GitCLI) Merge(repositoryURL, commitSha string, fetchDepth int, credsHelperCmd string) (string, error) {
 	mergeBinary, err := exec.LookPath("cloudbees-git-pr-merge-backfill")
+	if err != nil && g.dryRun {
+		// the binary is never executed in a dry run
+		mergeBinary, err = "cloudbees-git-pr-merge-backfill", nil
+	}
 	if err != nil && !errors.Is(err, exec.ErrDot) {
 		return "", err
 	} else if errors.Is(err, exec.ErrDot) {
@@ -476,9 +1757,73 @@ type FetchOptions struct {
 	Filter          string
 	FetchDepth      int
 	LocalRepository string
+	// Deepen extends the history of a shallow repository by the supplied number of commits
+	Deepen int
+	// ShallowSince limits the history to commits more recent than the supplied date
+	ShallowSince string
+	// ShallowExclude limits the history to exclude commits reachable from the supplied revisions
+	ShallowExclude []string
+	// FetchNotes also fetches the git notes under refs/notes/
+	FetchNotes bool
+	// Atomic updates either all the refs or none of them, requires Git 2.31 or newer
+	Atomic bool
+}
+
+// validate checks that at most one of the depth-control options has been set
+func (o FetchOptions) validate() error {
+	var set []string
+	if o.FetchDepth > 0 {
+		set = append(set, "FetchDepth")
+	}
+	if o.Deepen > 0 {
+		set = append(set, "Deepen")
+	}
+	if o.ShallowSince != "" {
+		set = append(set, "ShallowSince")
+	}
+	if len(o.ShallowExclude) > 0 {
+		set = append(set, "ShallowExclude")
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("only one of FetchDepth, Deepen, ShallowSince or ShallowExclude can be set but found %s", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// IsShallow returns true if the repository is a shallow clone, with history truncated by a depth or date
+func (g *GitCLI) IsShallow() (bool, error) {
+	out, err := g.runOutput("rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+	shallow, _ := strconv.ParseBool(strings.TrimSpace(out))
+	return shallow, nil
+}
+
+// FetchMultiple fetches several refspecs from the same remote with a single git fetch, to save round-trips
+func (g *GitCLI) FetchMultiple(refSpecs [][]string, options FetchOptions) error {
+	var combined []string
+	for _, refSpec := range refSpecs {
+		for _, r := range refSpec {
+			if !slices.Contains(combined, r) {
+				combined = append(combined, r)
+			}
+		}
+	}
+	if len(combined) == 0 {
+		return nil
+	}
+	return g.Fetch(combined, options)
 }
 
 func (g *GitCLI) Fetch(refSpec []string, options FetchOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if options.Atomic && !g.version.AtLeast(atomicFetchVersion) {
+		return fmt.Errorf("atomic fetches require git version %s or newer, found %s", atomicFetchVersion, g.version)
+	}
+
 	args := []string{"-c", "protocol.version=2", "fetch"}
 
 	tags := false
@@ -495,18 +1840,34 @@ func (g *GitCLI) Fetch(refSpec []string, options FetchOptions) error {
 
 	args = append(args, "--prune", "--progress", "--no-recurse-submodules")
 
+	if options.Atomic {
+		args = append(args, "--atomic")
+	}
+
 	if options.Filter != "" {
 		args = append(args, "--filter="+options.Filter)
 	}
 
-	if options.FetchDepth > 0 {
-		args = append(args, fmt.Sprintf("--depth=%d", options.FetchDepth))
-	} else {
-		out, err := g.runOutput("rev-parse", "--is-shallow-repository")
-		if err != nil {
+	switch {
+	case options.Deepen > 0:
+		// a complete repository has no history to extend
+		if shallow, err := g.IsShallow(); err != nil {
 			return err
+		} else if shallow {
+			args = append(args, fmt.Sprintf("--deepen=%d", options.Deepen))
 		}
-		if shallow, _ := strconv.ParseBool(strings.TrimSpace(out)); shallow {
+	case options.ShallowSince != "":
+		args = append(args, "--shallow-since="+options.ShallowSince)
+	case len(options.ShallowExclude) > 0:
+		for _, rev := range options.ShallowExclude {
+			args = append(args, "--shallow-exclude="+rev)
+		}
+	case options.FetchDepth > 0:
+		args = append(args, fmt.Sprintf("--depth=%d", options.FetchDepth))
+	default:
+		if shallow, err := g.IsShallow(); err != nil {
+			return err
+		} else if shallow {
 			args = append(args, "--unshallow")
 		}
 	}
@@ -517,6 +1878,9 @@ func (g *GitCLI) Fetch(refSpec []string, options FetchOptions) error {
 		args = append(args, "origin")
 	}
 	args = append(args, refSpec...)
+	if options.FetchNotes {
+		args = append(args, "+refs/notes/*:refs/notes/*")
+	}
 
 	return g.run(args...)
 }
@@ -1,24 +1,41 @@
 package git
 
 import (
+	"slices"
 	"strings"
+
+	"github.com/cloudbees-io/checkout/internal/core"
 )
 
 // envEntriesToMap is a helper method that takes a slice of KEY=VAL environment entries and turns them into a map
 func envEntriesToMap(entries []string) map[string]string {
 	r := make(map[string]string, len(entries))
 	for _, e := range entries {
+		if e == "" {
+			continue
+		}
 		s := strings.SplitN(e, "=", 2)
+		if len(s) != 2 {
+			core.Debug("ignoring environment entry %s without a value", e)
+			continue
+		}
 		r[s[0]] = s[1]
 	}
 	return r
 }
 
 // envMapToEntries is a helper method that takes a map and converts it into a slice of KEY=VAL environment
+// entries, sorted by key so that the environment of each git command is deterministic
 func envMapToEntries(entries map[string]string) []string {
-	r := make([]string, len(entries))
-	for k, v := range entries {
-		r = append(r, k+"="+v)
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	r := make([]string, 0, len(entries))
+	for _, k := range keys {
+		r = append(r, k+"="+entries[k])
 	}
 	return r
 }
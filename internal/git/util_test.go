@@ -0,0 +1,38 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_envMapToEntries(t *testing.T) {
+	env := map[string]string{
+		"PATH":                "/usr/bin",
+		"HOME":                "/home/user",
+		"GIT_TERMINAL_PROMPT": "0",
+		"LANG":                "C",
+		"A":                   "x=y",
+	}
+
+	want := []string{"A=x=y", "GIT_TERMINAL_PROMPT=0", "HOME=/home/user", "LANG=C", "PATH=/usr/bin"}
+	for i := 0; i < 100; i++ {
+		require.Equal(t, want, envMapToEntries(env))
+	}
+
+	require.Empty(t, envMapToEntries(map[string]string{}))
+}
+
+func Test_envEntriesToMap_roundTrip(t *testing.T) {
+	entries := []string{"PATH=/usr/bin", "HOME=/home/user", "A=x=y", "LANG=C"}
+
+	require.Equal(t, []string{"A=x=y", "HOME=/home/user", "LANG=C", "PATH=/usr/bin"}, envMapToEntries(envEntriesToMap(entries)))
+}
+
+func Test_envEntriesToMap(t *testing.T) {
+	require.Equal(t, map[string]string{
+		"PATH":   "/usr/bin",
+		"BASE64": "abc=def==",
+		"EMPTY":  "",
+	}, envEntriesToMap([]string{"PATH=/usr/bin", "", "BARE", "BASE64=abc=def==", "EMPTY="}))
+}
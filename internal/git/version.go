@@ -0,0 +1,50 @@
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// minimumGitVersion is the oldest version of git that supports all the features used by the checkout
+const minimumGitVersion = "2.28.0"
+
+// atomicFetchVersion is the oldest version of git that supports git fetch --atomic
+var atomicFetchVersion = GitVersion{Major: 2, Minor: 31}
+
+var gitVersionRegex = regexp.MustCompile(`git version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// GitVersion is the version of the Git command line executable
+type GitVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v GitVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns true if the version is the same as or newer than the supplied version
+func (v GitVersion) AtLeast(o GitVersion) bool {
+	if v.Major != o.Major {
+		return v.Major > o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor > o.Minor
+	}
+	return v.Patch >= o.Patch
+}
+
+// parseGitVersion parses the output of `git version`, ignoring any platform specific suffix
+func parseGitVersion(output string) (GitVersion, error) {
+	matches := gitVersionRegex.FindStringSubmatch(output)
+	if matches == nil {
+		return GitVersion{}, fmt.Errorf("unable to parse git version from '%s'", output)
+	}
+	// the regex guarantees that each submatch is a number so Atoi cannot error out
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	patch, _ := strconv.Atoi(matches[3])
+	return GitVersion{Major: major, Minor: minor, Patch: patch}, nil
+}
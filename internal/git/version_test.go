@@ -0,0 +1,68 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseGitVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    GitVersion
+		wantErr bool
+	}{
+		{
+			name:   "linux",
+			output: "git version 2.39.5\n",
+			want:   GitVersion{Major: 2, Minor: 39, Patch: 5},
+		},
+		{
+			name:   "apple",
+			output: "git version 2.39.2 (Apple Git-143)\n",
+			want:   GitVersion{Major: 2, Minor: 39, Patch: 2},
+		},
+		{
+			name:   "windows",
+			output: "git version 2.45.1.windows.1\n",
+			want:   GitVersion{Major: 2, Minor: 45, Patch: 1},
+		},
+		{
+			name:   "no-patch",
+			output: "git version 2.28",
+			want:   GitVersion{Major: 2, Minor: 28},
+		},
+		{
+			name:   "release-candidate",
+			output: "git version 2.47.0.rc1",
+			want:   GitVersion{Major: 2, Minor: 47, Patch: 0},
+		},
+		{
+			name:    "garbage",
+			output:  "command not found",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGitVersion(tt.output)
+
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGitVersion_AtLeast(t *testing.T) {
+	minimum := GitVersion{Major: 2, Minor: 28, Patch: 0}
+	require.True(t, GitVersion{Major: 2, Minor: 28, Patch: 0}.AtLeast(minimum))
+	require.True(t, GitVersion{Major: 2, Minor: 39, Patch: 5}.AtLeast(minimum))
+	require.True(t, GitVersion{Major: 3, Minor: 0, Patch: 0}.AtLeast(minimum))
+	require.False(t, GitVersion{Major: 2, Minor: 27, Patch: 9}.AtLeast(minimum))
+	require.False(t, GitVersion{Major: 1, Minor: 99, Patch: 0}.AtLeast(minimum))
+}
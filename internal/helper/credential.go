@@ -32,6 +32,12 @@ type GitCredential struct {
 	// treat this attribute as confidential like the password attribute. Git itself has no special behaviour for this
 	// attribute.
 	OAuthRefreshToken string
+	// AuthType The authentication scheme, for example Bearer, used with Credential instead of Username and Password.
+	// Requires Git 2.41 or newer.
+	AuthType string
+	// Credential A pre-encoded credential, suitable for the AuthType scheme. Helpers must treat this attribute as
+	// confidential like the password attribute.
+	Credential string
 	// WwwAuth When an HTTP response is received by Git that includes one or more WWW-Authenticate authentication
 	// headers, these will be passed by Git to credential helpers. The order of the attributes is the same as they
 	// appear in the HTTP response. This attribute is one-way from Git to pass additional information to credential
@@ -66,6 +72,14 @@ func (c *GitCredential) WriteTo(w io.Writer) (int64, error) {
 		return n, fmt.Errorf("oauth_refresh_token cannot contain NUL character or newline")
 	}
 
+	if isValidGitCredentialHelperValue(c.AuthType) {
+		return n, fmt.Errorf("authtype cannot contain NUL character or newline")
+	}
+
+	if isValidGitCredentialHelperValue(c.Credential) {
+		return n, fmt.Errorf("credential cannot contain NUL character or newline")
+	}
+
 	if c.Protocol != "" {
 		i, err := io.WriteString(w, fmt.Sprintf("protocol=%s\n", c.Protocol))
 
@@ -136,6 +150,26 @@ func (c *GitCredential) WriteTo(w io.Writer) (int64, error) {
 		}
 	}
 
+	if c.AuthType != "" {
+		i, err := io.WriteString(w, fmt.Sprintf("authtype=%s\n", c.AuthType))
+
+		n += int64(i)
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if c.Credential != "" {
+		i, err := io.WriteString(w, fmt.Sprintf("credential=%s\n", c.Credential))
+
+		n += int64(i)
+
+		if err != nil {
+			return n, err
+		}
+	}
+
 	// url is an alternative to protocol and host, we have parsed urls so no need to write back
 
 	// wwwauth[] is one-way from git to the helper, so we should never write it out
@@ -165,7 +199,7 @@ func ReadCredential(r io.Reader) (*GitCredential, error) {
 			return nil, err
 		}
 
-		key = strings.TrimSuffix(key, "=")
+		key = strings.TrimSuffix(strings.TrimSuffix(key, "="), "\r")
 
 		val, err := rd.ReadString('\n')
 		if err != nil {
@@ -176,7 +210,8 @@ func ReadCredential(r io.Reader) (*GitCredential, error) {
 			return nil, err
 		}
 
-		val = strings.TrimSuffix(val, "\n")
+		// tolerate CRLF line endings, but only strip the CR that is part of the line ending
+		val = strings.TrimSuffix(strings.TrimSuffix(val, "\n"), "\r")
 
 		switch key {
 		case "protocol":
@@ -199,6 +234,10 @@ func ReadCredential(r io.Reader) (*GitCredential, error) {
 			c.PasswordExpiry = &t
 		case "oauth_refresh_token":
 			c.OAuthRefreshToken = val
+		case "authtype":
+			c.AuthType = val
+		case "credential":
+			c.Credential = val
 		case "url":
 			ep, err := transport.NewEndpoint(val)
 			if err != nil {
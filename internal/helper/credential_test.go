@@ -93,6 +93,37 @@ oauth_refresh_token=cafebabe-deadbeef
 			want:    ``,
 			wantErr: true,
 		},
+		{
+			name: "bearer",
+			fields: GitCredential{
+				Protocol:   "https",
+				Host:       "git.example.com",
+				AuthType:   "Bearer",
+				Credential: "eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo",
+			},
+			want: `protocol=https
+host=git.example.com
+authtype=Bearer
+credential=eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo
+`,
+			wantErr: false,
+		},
+		{
+			name: "bad-authtype",
+			fields: GitCredential{
+				AuthType: "Bea\nrer",
+			},
+			want:    ``,
+			wantErr: true,
+		},
+		{
+			name: "bad-credential",
+			fields: GitCredential{
+				Credential: "ht\x00tps",
+			},
+			want:    ``,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -104,6 +135,8 @@ oauth_refresh_token=cafebabe-deadbeef
 				Password:          tt.fields.Password,
 				PasswordExpiry:    tt.fields.PasswordExpiry,
 				OAuthRefreshToken: tt.fields.OAuthRefreshToken,
+				AuthType:          tt.fields.AuthType,
+				Credential:        tt.fields.Credential,
 				WwwAuth:           tt.fields.WwwAuth,
 			}
 			w := &bytes.Buffer{}
@@ -220,6 +253,50 @@ wwwauth[]=fu:manchu
 				},
 			},
 		},
+		{
+			name: "bearer",
+			input: `protocol=https
+host=git.example.com
+authtype=Bearer
+credential=eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo
+`,
+			want: &GitCredential{
+				Protocol:   "https",
+				Host:       "git.example.com",
+				AuthType:   "Bearer",
+				Credential: "eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo",
+			},
+		},
+		{
+			name:  "full-crlf",
+			input: "protocol=https\r\nhost=git.example.com:8443\r\npath=~/git/example.git\r\nusername=git\r\npassword=secr3t\r\npassword_expiry_utc=987654321\r\noauth_refresh_token=cafebabe-deadbeef\r\n",
+			want: &GitCredential{
+				Protocol:          "https",
+				Host:              "git.example.com:8443",
+				Path:              "~/git/example.git",
+				Username:          "git",
+				Password:          "secr3t",
+				PasswordExpiry:    &testDate,
+				OAuthRefreshToken: "cafebabe-deadbeef",
+			},
+		},
+		{
+			name:  "crlf-url",
+			input: "url=https://git.example.com/org/repo.git\r\nusername=git\r\n",
+			want: &GitCredential{
+				Protocol: "https",
+				Host:     "git.example.com",
+				Path:     "org/repo.git",
+				Username: "git",
+			},
+		},
+		{
+			name:  "cr-inside-value-is-preserved",
+			input: "password=sec\rr3t\r\n",
+			want: &GitCredential{
+				Password: "sec\rr3t",
+			},
+		},
 		{
 			name:    "key-must-always-be-followed-by-equals",
 			input:   "standalone-key",
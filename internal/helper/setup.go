@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/cloudbees-io/checkout/internal/core"
 	format "github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 )
@@ -21,6 +22,9 @@ func uniqueId(serverURL string) string {
 	return fmt.Sprintf("%x", bs)[0:16]
 }
 
+// ioCopy is the copy function used by copyFileHelper, tests replace it to simulate a failed copy
+var ioCopy = io.Copy
+
 func copyFileHelper(dst string, src string) (err error) {
 	s, err := os.Open(src)
 	if err != nil {
@@ -33,30 +37,82 @@ func copyFileHelper(dst string, src string) (err error) {
 		}
 	}(s)
 
+	// Write to a temporary file next to the destination and rename it into place, so that concurrent jobs
+	// installing the same helper never observe a partially written executable
+	tmp := fmt.Sprintf("%s.tmp.%d", dst, os.Getpid())
+
+	d, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0555)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = forceRemove(tmp)
+		}
+	}()
+
+	if _, err = ioCopy(d, s); err != nil {
+		_ = d.Close()
+		return err
+	}
+	if err = d.Close(); err != nil {
+		return err
+	}
+
+	if err = verifyFileCopy(src, tmp); err != nil {
+		return err
+	}
+
 	if stat, err := os.Stat(dst); err == nil {
-		// set up to force delete
+		// the existing helper is read-only, make it writable so that it can be replaced
 		if err := os.Chmod(dst, stat.Mode()|0222); err != nil {
 			return err
 		}
-		if err := os.Remove(dst); err != nil {
-			return err
-		}
 	}
 
-	// Create the destination file with default permission
-	d, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0555)
+	return os.Rename(tmp, dst)
+}
+
+// verifyFileCopy checks that dst has the same SHA-256 checksum as src
+func verifyFileCopy(src, dst string) error {
+	srcSum, err := fileChecksum(src)
 	if err != nil {
 		return err
 	}
-	defer func(f *os.File) {
-		err2 := f.Close()
-		if err2 != nil && err == nil {
-			err = err2
-		}
-	}(d)
+	dstSum, err := fileChecksum(dst)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return fmt.Errorf("checksum of %s does not match %s: %x != %x", dst, src, dstSum, srcSum)
+	}
+	return nil
+}
+
+func fileChecksum(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
 
-	_, err = io.Copy(d, s)
-	return err
+func forceRemove(name string) error {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	// set up to force delete
+	if err := os.Chmod(name, stat.Mode()|0222); err != nil {
+		return err
+	}
+	return os.Remove(name)
 }
 
 func noOpClean() error {
@@ -65,7 +121,7 @@ func noOpClean() error {
 
 func removeFilesClean(files ...string) func() error {
 	return func() error {
-		fmt.Println("🔄 Removing credentials helper ...")
+		core.StartGroup("Removing credentials helper ...")
 		var errs []error
 		for _, f := range files {
 			if stat, err := os.Stat(f); err == nil {
@@ -81,16 +137,23 @@ func removeFilesClean(files ...string) func() error {
 		if len(errs) > 0 {
 			return errors.Join(errs...)
 		}
-		fmt.Println("✅ Credentials helper removed")
+		core.EndGroup("Credentials helper removed")
 		return nil
 	}
 }
 
+// HelperExecutableName is the file name of the helper installed into each subdirectory of InstallDir
+const HelperExecutableName = "git-credential-helper"
+
+// InstallDir returns the directory under which credential helpers are installed, one subdirectory per server URL
+func InstallDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".cloudbees-checkout")
+}
+
 func InstallHelperFor(serverURL string, options map[string][]string) (string, func() error, error) {
-	homePath := os.Getenv("HOME")
-	actionPath := filepath.Join(homePath, ".cloudbees-checkout", uniqueId(serverURL))
+	actionPath := filepath.Join(InstallDir(), uniqueId(serverURL))
 
-	fmt.Println("🔄 Installing credentials helper ...")
+	core.StartGroup("Installing credentials helper ...")
 
 	self, err := os.Executable()
 	if err != nil {
@@ -101,7 +164,7 @@ func InstallHelperFor(serverURL string, options map[string][]string) (string, fu
 		return "", noOpClean, err
 	}
 
-	helperExecutable := filepath.Join(actionPath, "git-credential-helper")
+	helperExecutable := filepath.Join(actionPath, HelperExecutableName)
 	if a, err := filepath.Abs(helperExecutable); err != nil {
 		helperExecutable = a
 	}
@@ -111,7 +174,7 @@ func InstallHelperFor(serverURL string, options map[string][]string) (string, fu
 		return "", noOpClean, err
 	}
 
-	fmt.Println("✅ Credentials helper installed")
+	core.EndGroup("Credentials helper installed")
 
 	helperConfig := &format.Config{}
 	helperConfigFile := helperExecutable + ".cfg"
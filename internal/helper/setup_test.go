@@ -0,0 +1,64 @@
+package helper
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_copyFileHelper(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "git-credential-helper")
+	require.NoError(t, os.WriteFile(src, []byte("new helper"), 0755))
+	require.NoError(t, os.WriteFile(dst, []byte("old helper"), 0555))
+
+	require.NoError(t, copyFileHelper(dst, src))
+
+	content, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "new helper", string(content))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "no temporary files are left behind")
+}
+
+func Test_copyFileHelper_copyFails(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "git-credential-helper")
+	require.NoError(t, os.WriteFile(src, []byte("a helper binary that is copied halfway"), 0755))
+
+	orig := ioCopy
+	t.Cleanup(func() { ioCopy = orig })
+	ioCopy = func(w io.Writer, r io.Reader) (int64, error) {
+		n, _ := io.CopyN(w, r, 8)
+		return n, errors.New("disk full")
+	}
+
+	require.ErrorContains(t, copyFileHelper(dst, src), "disk full")
+
+	require.NoFileExists(t, dst)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no partial files are left behind")
+}
+
+func Test_verifyFileCopy(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	require.NoError(t, os.WriteFile(a, []byte("same"), 0644))
+	require.NoError(t, os.WriteFile(b, []byte("same"), 0644))
+	require.NoError(t, verifyFileCopy(a, b))
+
+	require.NoError(t, os.WriteFile(b, []byte("different"), 0644))
+	require.ErrorContains(t, verifyFileCopy(a, b), "checksum")
+
+	require.Error(t, verifyFileCopy(a, filepath.Join(dir, "missing")))
+}
@@ -0,0 +1,18 @@
+// Package version holds the build information of the checkout binary, populated with -ldflags at build time
+package version
+
+import "fmt"
+
+var (
+	// Version is the released version of the binary
+	Version = "dev"
+	// Commit is the SHA of the commit the binary was built from
+	Commit = "unknown"
+	// BuildDate is when the binary was built
+	BuildDate = "unknown"
+)
+
+// String returns the build information in a form suitable for bug reports
+func String() string {
+	return fmt.Sprintf("cloudbees-checkout version %s (commit %s, built %s)", Version, Commit, BuildDate)
+}